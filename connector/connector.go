@@ -0,0 +1,225 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Delivers events from an event store to external systems. A connector
+// tails a set of streams and hands every event to a sink, retrying with
+// backoff until the sink accepts it. How far each connector has come is
+// stored as checkpoints in the event store, so delivery resumes where it
+// left off after a restart.
+package connector
+
+import (
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+	"github.com/JensRantil/gorewind/eventstore"
+)
+
+// Default delay before the first redelivery of a failed event.
+const DefaultInitialBackoff = 100 * time.Millisecond
+
+// Default upper bound for the delay between redeliveries.
+const DefaultMaxBackoff = 30 * time.Second
+
+// Returned by handlers when a connector was asked to stop while
+// retrying.
+var errStopped = errors.New("connector stopped")
+
+// A destination that events are delivered to. Deliver must return an
+// error if the event was not delivered, in which case it will be
+// retried.
+type Sink interface {
+	Deliver(event eventstore.StoredEvent) error
+}
+
+// Implemented by sinks whose deliveries may take long, such as
+// HTTPSink and ExecSink. Stop calls Cancel to interrupt the delivery in progress.
+type Canceler interface {
+	Cancel()
+}
+
+// Tails streams and delivers their events to a sink.
+type Connector struct {
+	// Unique name of the connector. Used for storing checkpoints.
+	Name string
+
+	// The streams to deliver. A nil filter means all streams.
+	Filter eventstore.StreamFilter
+
+	Sink Sink
+
+	// Delay before the first redelivery of a failed event. Doubled for
+	// every subsequent failure, up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// Number of delivery attempts before an event is parked and
+	// delivery continues with the next event. Attempts are counted
+	// across restarts. Zero means retrying forever.
+	MaxAttempts int
+
+	store *eventstore.EventStore
+	stopChan chan bool
+	waiter sync.WaitGroup
+	err error
+}
+
+// Create a new connector. The connector is not started. It's up to the
+// caller to execute Start() on the returned connector.
+func New(estore *eventstore.EventStore, name string, sink Sink) *Connector {
+	return &Connector{
+		Name: name,
+		Sink: sink,
+		InitialBackoff: DefaultInitialBackoff,
+		MaxBackoff: DefaultMaxBackoff,
+		store: estore,
+		// Buffered to not block when the connector already has
+		// stopped because of an error.
+		stopChan: make(chan bool, 1),
+	}
+}
+
+// The name under which a connector stores its checkpoints and parked
+// events.
+func checkpointName(name string) string {
+	return "connector/" + name
+}
+
+func (c *Connector) checkpointName() string {
+	return checkpointName(c.Name)
+}
+
+// Start delivering events in the background.
+func (c *Connector) Start() {
+	c.waiter.Add(1)
+	go func() {
+		defer c.waiter.Done()
+		err := c.store.Follow(c.checkpointName(), c.Filter, c.handle,
+		c.stopChan)
+		if err != errStopped {
+			c.err = err
+		}
+	}()
+}
+
+// Stop the connector and block until it has stopped. Cancels the
+// delivery in progress if the sink implements Canceler, and closes the
+// sink if it implements io.Closer.
+func (c *Connector) Stop() error {
+	select {
+	case c.stopChan <- true:
+	default:
+	}
+	if canceler, ok := c.Sink.(Canceler); ok {
+		canceler.Cancel()
+	}
+	err := c.Wait()
+	if closer, ok := c.Sink.(io.Closer); ok {
+		if cerr := closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Block until the connector has stopped. Returns the error that made it
+// stop, if any.
+func (c *Connector) Wait() error {
+	c.waiter.Wait()
+	return c.err
+}
+
+// Deliver a single event, retrying until it succeeds or MaxAttempts is
+// reached, and checkpoint it.
+func (c *Connector) handle(event eventstore.StoredEvent) error {
+	name := c.checkpointName()
+	backoff := c.InitialBackoff
+	for {
+		err := c.Sink.Deliver(event)
+		if err == nil {
+			return c.store.Acknowledge(name, event)
+		}
+		// A delivery interrupted by Stop is not a failed attempt.
+		select {
+		case <-c.stopChan:
+			return errStopped
+		default:
+		}
+		log.Println("Connector", c.Name, "could not deliver event:", err)
+
+		if c.MaxAttempts > 0 {
+			attempts, rerr := c.store.IncrementRetries(name, event)
+			if rerr != nil {
+				return rerr
+			}
+			if attempts >= c.MaxAttempts {
+				log.Println("Connector", c.Name, "parked event after",
+				attempts, "attempts.")
+				_, perr := c.store.Park(name, eventstore.ParkedEvent{
+					Stream: event.Stream,
+					Id: event.Id,
+					Data: event.Data,
+					Attempts: attempts,
+					Error: err.Error(),
+					Time: time.Now(),
+				})
+				return perr
+			}
+		}
+
+		select {
+		case <-c.stopChan:
+			return errStopped
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > c.MaxBackoff {
+			backoff = c.MaxBackoff
+		}
+	}
+}
+
+// List the events this connector has parked, oldest first.
+func (c *Connector) Parked() ([]eventstore.ParkedEvent, error) {
+	return c.store.ParkedEvents(c.checkpointName())
+}
+
+// Make a single attempt to deliver a parked event again. On success, the
+// event is no longer parked.
+func (c *Connector) Replay(parkId []byte) error {
+	p, err := c.store.ParkedEvent(c.checkpointName(), parkId)
+	if err != nil {
+		return err
+	}
+	event := eventstore.StoredEvent{
+		Id: p.Id,
+		Event: eventstore.Event{
+			Stream: p.Stream,
+			Data: p.Data,
+		},
+	}
+	if err := c.Sink.Deliver(event); err != nil {
+		return err
+	}
+	return c.store.Unpark(c.checkpointName(), parkId)
+}
+
+// Forget a parked event without delivering it.
+func (c *Connector) Discard(parkId []byte) error {
+	return c.store.Unpark(c.checkpointName(), parkId)
+}
@@ -0,0 +1,353 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package connector
+
+
+import (
+	"testing"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+	"github.com/JensRantil/gorewind/eventstore"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+
+func setupInMemoryeventstore() *eventstore.EventStore {
+	stor := &storage.MemStorage{}
+	es, err := eventstore.New(stor, nil)
+	if err != nil {
+		panic(err)
+	}
+	return es
+}
+
+// A local stand-in sink that records deliveries and fails a configurable
+// number of times first.
+type recordingSink struct {
+	lock sync.Mutex
+	failures int
+	attempts int
+	delivered []eventstore.StoredEvent
+}
+
+func (s *recordingSink) Deliver(event eventstore.StoredEvent) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.attempts++
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("temporary failure")
+	}
+	s.delivered = append(s.delivered, event)
+	return nil
+}
+
+func (s *recordingSink) waitForDeliveries(t *testing.T, n int) []eventstore.StoredEvent {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		s.lock.Lock()
+		count := len(s.delivered)
+		s.lock.Unlock()
+		if count >= n {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]eventstore.StoredEvent(nil), s.delivered...)
+}
+
+func TestConnectorDelivers(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	stream := eventstore.StreamName("mystream")
+	if _, err := es.Add(eventstore.Event{Stream: stream, Data: []byte("first")}); err != nil {
+		t.Fatal(err)
+	}
+
+	sink := &recordingSink{}
+	conn := New(es, "test", sink)
+	conn.Start()
+	if _, err := es.Add(eventstore.Event{Stream: stream, Data: []byte("second")}); err != nil {
+		t.Fatal(err)
+	}
+
+	delivered := sink.waitForDeliveries(t, 2)
+	if err := conn.Stop(); err != nil {
+		t.Error(err)
+	}
+	if len(delivered) != 2 {
+		t.Fatal("Wrong number of deliveries:", len(delivered))
+	}
+	if string(delivered[0].Data) != "first" || string(delivered[1].Data) != "second" {
+		t.Error("Events delivered out of order.")
+	}
+
+	// A restarted connector continues after its checkpoint.
+	sink = &recordingSink{}
+	conn = New(es, "test", sink)
+	conn.Start()
+	if _, err := es.Add(eventstore.Event{Stream: stream, Data: []byte("third")}); err != nil {
+		t.Fatal(err)
+	}
+	delivered = sink.waitForDeliveries(t, 1)
+	if err := conn.Stop(); err != nil {
+		t.Error(err)
+	}
+	if len(delivered) != 1 || string(delivered[0].Data) != "third" {
+		t.Error("Restarted connector redelivered events:", delivered)
+	}
+}
+
+func TestConnectorRetries(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	stream := eventstore.StreamName("mystream")
+	if _, err := es.Add(eventstore.Event{Stream: stream, Data: []byte("data")}); err != nil {
+		t.Fatal(err)
+	}
+
+	sink := &recordingSink{failures: 3}
+	conn := New(es, "test", sink)
+	conn.InitialBackoff = time.Millisecond
+	conn.Start()
+	delivered := sink.waitForDeliveries(t, 1)
+	if err := conn.Stop(); err != nil {
+		t.Error(err)
+	}
+	if len(delivered) != 1 {
+		t.Fatal("Event was never delivered.")
+	}
+	if sink.attempts != 4 {
+		t.Error("Wrong number of attempts:", sink.attempts)
+	}
+}
+
+func TestConnectorStopsWhileRetrying(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	stream := eventstore.StreamName("mystream")
+	if _, err := es.Add(eventstore.Event{Stream: stream, Data: []byte("data")}); err != nil {
+		t.Fatal(err)
+	}
+
+	sink := &recordingSink{failures: 1000000}
+	conn := New(es, "test", sink)
+	conn.InitialBackoff = time.Millisecond
+	conn.Start()
+	time.Sleep(50 * time.Millisecond)
+	if err := conn.Stop(); err != nil {
+		t.Error("Stopping while retrying is not an error:", err)
+	}
+
+	id, err := es.Checkpoint(conn.checkpointName(), stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != nil {
+		t.Error("An undelivered event was checkpointed.")
+	}
+}
+
+func TestNewFromSpec(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	conn, err := NewFromSpec(es, "hook:http:http://127.0.0.1:8080/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.Name != "hook" {
+		t.Error("Wrong name:", conn.Name)
+	}
+	httpSink, ok := conn.Sink.(*HTTPSink)
+	if !ok {
+		t.Fatal("Wrong sink type.")
+	}
+	if httpSink.URL != "http://127.0.0.1:8080/events" {
+		t.Error("Wrong URL:", httpSink.URL)
+	}
+
+	malformed := []string{"", "nokind", ":stdout:", "x:unknown:y"}
+	for _, spec := range malformed {
+		if _, err := NewFromSpec(es, spec); err == nil {
+			t.Error("Expected error for spec:", spec)
+		}
+	}
+}
+
+func TestConnectorParksEvents(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	stream := eventstore.StreamName("mystream")
+	if _, err := es.Add(eventstore.Event{Stream: stream, Data: []byte("poison")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := es.Add(eventstore.Event{Stream: stream, Data: []byte("fine")}); err != nil {
+		t.Fatal(err)
+	}
+
+	sink := &recordingSink{failures: 3}
+	conn := New(es, "test", sink)
+	conn.InitialBackoff = time.Millisecond
+	conn.MaxAttempts = 3
+	conn.Start()
+	delivered := sink.waitForDeliveries(t, 1)
+	if err := conn.Stop(); err != nil {
+		t.Error(err)
+	}
+	if len(delivered) != 1 || string(delivered[0].Data) != "fine" {
+		t.Fatal("Connector did not move on:", delivered)
+	}
+
+	parked, err := conn.Parked()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parked) != 1 || string(parked[0].Data) != "poison" {
+		t.Fatal("Event was not parked:", parked)
+	}
+	if parked[0].Attempts != 3 {
+		t.Error("Wrong number of attempts:", parked[0].Attempts)
+	}
+
+	if err := conn.Replay(parked[0].ParkId); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.delivered) != 2 || string(sink.delivered[1].Data) != "poison" {
+		t.Error("Parked event was not replayed.")
+	}
+	if parked, _ = conn.Parked(); len(parked) != 0 {
+		t.Error("Replayed event is still parked.")
+	}
+}
+
+func TestConnectorDiscardsParkedEvents(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	stream := eventstore.StreamName("mystream")
+	if _, err := es.Add(eventstore.Event{Stream: stream, Data: []byte("poison")}); err != nil {
+		t.Fatal(err)
+	}
+
+	sink := &recordingSink{failures: 1}
+	conn := New(es, "test", sink)
+	conn.MaxAttempts = 1
+	conn.Start()
+
+	var parked []eventstore.ParkedEvent
+	deadline := time.Now().Add(5 * time.Second)
+	for len(parked) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		parked, _ = conn.Parked()
+	}
+	if err := conn.Stop(); err != nil {
+		t.Error(err)
+	}
+	if len(parked) != 1 {
+		t.Fatal("Event was not parked.")
+	}
+
+	if err := conn.Discard(parked[0].ParkId); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Discard(parked[0].ParkId); err != eventstore.ErrNoSuchParkedEvent {
+		t.Error("Expected ErrNoSuchParkedEvent, got:", err)
+	}
+	if len(sink.delivered) != 0 {
+		t.Error("Discarded event was delivered.")
+	}
+}
+
+func TestConnectorStopInterruptsDelivery(t *testing.T) {
+	t.Parallel()
+
+	unblock := make(chan bool)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}
+	ts := httptest.NewServer(http.HandlerFunc(handler))
+	defer ts.Close()
+	defer close(unblock)
+
+	es := setupInMemoryeventstore()
+	stream := eventstore.StreamName("mystream")
+	if _, err := es.Add(eventstore.Event{Stream: stream, Data: []byte("data")}); err != nil {
+		t.Fatal(err)
+	}
+	conn := New(es, "test", NewHTTPSink(ts.URL))
+	conn.MaxAttempts = 1
+	conn.Start()
+	time.Sleep(50 * time.Millisecond)
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- conn.Stop()
+	}()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop waited for the delivery in progress.")
+	}
+	if parked, _ := conn.Parked(); len(parked) != 0 {
+		t.Error("Interrupted delivery was counted as a failure:", parked)
+	}
+}
+
+func TestConnectorStopInterruptsExec(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	stream := eventstore.StreamName("mystream")
+	if _, err := es.Add(eventstore.Event{Stream: stream, Data: []byte("data")}); err != nil {
+		t.Fatal(err)
+	}
+	// Hangs while holding on to its output, like a command that
+	// started a child.
+	conn := New(es, "test", NewExecSink("sh", "-c", "sleep 60 & sleep 60"))
+	conn.MaxAttempts = 1
+	conn.Start()
+	time.Sleep(50 * time.Millisecond)
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- conn.Stop()
+	}()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop waited for the hung command.")
+	}
+	if parked, _ := conn.Parked(); len(parked) != 0 {
+		t.Error("Interrupted delivery was counted as a failure:", parked)
+	}
+}
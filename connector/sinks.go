@@ -0,0 +1,325 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+	"github.com/JensRantil/gorewind/eventstore"
+)
+
+// Implements Canceler for sinks that embed it.
+type cancelSignal struct {
+	lock sync.Mutex
+	// Closed by Cancel. Interrupts the delivery in progress, if any.
+	cancel chan struct{}
+}
+
+// The channel that is closed once the sink has been cancelled.
+func (s *cancelSignal) cancelled() chan struct{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.cancel == nil {
+		s.cancel = make(chan struct{})
+	}
+	return s.cancel
+}
+
+// Interrupt the delivery in progress, if any, and make all later
+// deliveries fail.
+func (s *cancelSignal) Cancel() {
+	cancel := s.cancelled()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	select {
+	case <-cancel:
+		// Already cancelled.
+	default:
+		close(cancel)
+	}
+}
+
+// Create a sink from a kind and a kind specific target. Known kinds are
+// "stdout", "file" (target is a path), "http" (target is a URL) and
+// "exec" (target is a command line).
+func NewSink(kind, target string) (Sink, error) {
+	switch kind {
+	case "stdout":
+		return NewWriterSink(os.Stdout), nil
+	case "file":
+		return NewFileSink(target)
+	case "http":
+		return NewHTTPSink(target), nil
+	case "exec":
+		args := strings.Fields(target)
+		if len(args) == 0 {
+			return nil, errors.New("Missing command for exec sink.")
+		}
+		return NewExecSink(args[0], args[1:]...), nil
+	}
+	return nil, errors.New("Unknown sink kind: " + kind)
+}
+
+// Parse a connector specification on the form "name:kind:target" and
+// create a connector delivering all streams. See NewSink for the
+// available kinds.
+func NewFromSpec(estore *eventstore.EventStore, spec string) (*Connector, error) {
+	pieces := strings.SplitN(spec, ":", 3)
+	if len(pieces) < 2 || pieces[0] == "" {
+		msg := "Connector must be specified as name:kind:target: "
+		return nil, errors.New(msg + spec)
+	}
+	target := ""
+	if len(pieces) == 3 {
+		target = pieces[2]
+	}
+	sink, err := NewSink(pieces[1], target)
+	if err != nil {
+		return nil, err
+	}
+	return New(estore, pieces[0], sink), nil
+}
+
+// The format each event is written in by WriterSink.
+type jsonEvent struct {
+	Stream string `json:"stream"`
+	Id []byte `json:"id"`
+	Data []byte `json:"data"`
+}
+
+// Writes every event as a line of JSON to a writer. Event id and data
+// are base64 encoded since they are arbitrary bytes.
+type WriterSink struct {
+	lock sync.Mutex
+	w io.Writer
+}
+
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+func (s *WriterSink) Deliver(event eventstore.StoredEvent) error {
+	line, err := json.Marshal(jsonEvent{
+		string(event.Stream),
+		event.Id,
+		event.Data,
+	})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, err = s.w.Write(line)
+	return err
+}
+
+// Appends every event as a line of JSON to a file. See WriterSink.
+type FileSink struct {
+	WriterSink
+	file *os.File
+}
+
+// Open a file sink. The file is created if it does not exist.
+func NewFileSink(path string) (*FileSink, error) {
+	flags := os.O_WRONLY | os.O_APPEND | os.O_CREATE
+	file, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	sink := &FileSink{file: file}
+	sink.w = file
+	return sink, nil
+}
+
+func (s *FileSink) Close() error {
+	return s.file.Close()
+}
+
+// POSTs the data of every event to a URL. The stream and the base64
+// encoded event id are sent in the X-Gorewind-Stream and X-Gorewind-Id
+// headers. Any non-2xx response is considered a failed delivery.
+type HTTPSink struct {
+	URL string
+	Client *http.Client
+
+	// If set, every request is signed using HMAC-SHA256 over the
+	// stream and id headers and the request body. The hex encoded
+	// signature is sent in the X-Gorewind-Signature header as
+	// "sha256=<signature>". See Signature.
+	Secret []byte
+
+	cancelSignal
+}
+
+// How long an HTTPSink created by NewHTTPSink waits for a response
+// before considering the delivery failed.
+const DefaultHTTPTimeout = 30 * time.Second
+
+// Compute the value of the X-Gorewind-Signature header from the values
+// of the X-Gorewind-Stream and X-Gorewind-Id headers and the body. The
+// signed message is the stream, a newline, the id, a newline and the
+// body. Header values can't contain newlines, so the parts can't be
+// shifted into each other.
+func Signature(secret []byte, stream, id string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(stream + "\n" + id + "\n"))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func NewHTTPSink(url string) *HTTPSink {
+	return &HTTPSink{
+		URL: url,
+		Client: &http.Client{Timeout: DefaultHTTPTimeout},
+	}
+}
+
+// Build the request used to deliver an event.
+func (s *HTTPSink) newRequest(event eventstore.StoredEvent) (*http.Request, error) {
+	req, err := http.NewRequest("POST", s.URL, bytes.NewReader(event.Data))
+	if err != nil {
+		return nil, err
+	}
+	req.Cancel = s.cancelled()
+	stream := string(event.Stream)
+	id := base64.StdEncoding.EncodeToString(event.Id)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Gorewind-Stream", stream)
+	req.Header.Set("X-Gorewind-Id", id)
+	if s.Secret != nil {
+		signature := Signature(s.Secret, stream, id, event.Data)
+		req.Header.Set("X-Gorewind-Signature", signature)
+	}
+	return req, nil
+}
+
+func (s *HTTPSink) Deliver(event eventstore.StoredEvent) error {
+	req, err := s.newRequest(event)
+	if err != nil {
+		return err
+	}
+	return s.do(req)
+}
+
+func (s *HTTPSink) do(req *http.Request) error {
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s responded %s", s.URL, resp.Status)
+	}
+	return nil
+}
+
+// Runs a command for every event. The event data is written to the
+// command's stdin, and the stream and base64 encoded event id are set in
+// the GOREWIND_STREAM and GOREWIND_ID environment variables. A non-zero
+// exit status is considered a failed delivery.
+type ExecSink struct {
+	Command string
+	Args []string
+
+	// The command is killed and the delivery considered failed if it
+	// runs for longer than this. Zero means no timeout.
+	Timeout time.Duration
+
+	cancelSignal
+}
+
+// How long a command run by an ExecSink created by NewExecSink may run
+// before it is killed.
+const DefaultExecTimeout = 30 * time.Second
+
+// Why an ExecSink killed its command.
+var (
+	errExecTimeout = errors.New("timed out")
+	errExecCancelled = errors.New("cancelled")
+)
+
+func NewExecSink(command string, args ...string) *ExecSink {
+	return &ExecSink{
+		Command: command,
+		Args: args,
+		Timeout: DefaultExecTimeout,
+	}
+}
+
+func (s *ExecSink) Deliver(event eventstore.StoredEvent) error {
+	cancel := s.cancelled()
+	select {
+	case <-cancel:
+		return fmt.Errorf("%s: %s", s.Command, errExecCancelled)
+	default:
+	}
+
+	var out bytes.Buffer
+	cmd := exec.Command(s.Command, s.Args...)
+	cmd.Stdin = bytes.NewReader(event.Data)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	cmd.Env = append(os.Environ(),
+		"GOREWIND_STREAM=" + string(event.Stream),
+		"GOREWIND_ID=" + base64.StdEncoding.EncodeToString(event.Id),
+	)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("%s: %s", s.Command, err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	var timeout <-chan time.Time
+	if s.Timeout > 0 {
+		timer := time.NewTimer(s.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var err error
+	select {
+	case err = <-done:
+		if err == nil {
+			return nil
+		}
+		return fmt.Errorf("%s: %s: %s", s.Command, err, out.Bytes())
+	case <-timeout:
+		err = errExecTimeout
+	case <-cancel:
+		err = errExecCancelled
+	}
+	// Not waiting for the command to exit, since Wait also waits for
+	// any children that inherited its output to exit.
+	cmd.Process.Kill()
+	return fmt.Errorf("%s: %s", s.Command, err)
+}
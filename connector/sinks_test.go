@@ -0,0 +1,225 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package connector
+
+
+import (
+	"testing"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+	"github.com/JensRantil/gorewind/eventstore"
+)
+
+
+var testEvent = eventstore.StoredEvent{
+	Id: eventstore.EventId([]byte{0, 1}),
+	Event: eventstore.Event{
+		Stream: eventstore.StreamName("mystream"),
+		Data: []byte("data"),
+	},
+}
+
+func checkJSONLine(t *testing.T, line []byte) {
+	var parsed jsonEvent
+	if err := json.Unmarshal(line, &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Stream != "mystream" {
+		t.Error("Wrong stream:", parsed.Stream)
+	}
+	if bytes.Compare(parsed.Id, testEvent.Id) != 0 {
+		t.Error("Wrong id:", parsed.Id)
+	}
+	if bytes.Compare(parsed.Data, testEvent.Data) != 0 {
+		t.Error("Wrong data:", parsed.Data)
+	}
+}
+
+func TestWriterSink(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	sink := NewWriterSink(&buf)
+	if err := sink.Deliver(testEvent); err != nil {
+		t.Fatal(err)
+	}
+	line := buf.Bytes()
+	if line[len(line)-1] != '\n' {
+		t.Error("Line was not terminated.")
+	}
+	checkJSONLine(t, line)
+}
+
+func TestFileSink(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gorewind")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.log")
+
+	sink, err := NewFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Deliver(testEvent); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkJSONLine(t, content)
+}
+
+func TestHTTPSink(t *testing.T) {
+	t.Parallel()
+
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}
+	ts := httptest.NewServer(http.HandlerFunc(handler))
+	defer ts.Close()
+
+	sink := NewHTTPSink(ts.URL)
+	if err := sink.Deliver(testEvent); err != nil {
+		t.Fatal(err)
+	}
+	req := <-received
+	if req.Method != "POST" {
+		t.Error("Wrong method:", req.Method)
+	}
+	if req.Header.Get("X-Gorewind-Stream") != "mystream" {
+		t.Error("Wrong stream header:", req.Header.Get("X-Gorewind-Stream"))
+	}
+	if req.Header.Get("X-Gorewind-Id") != "AAE=" {
+		t.Error("Wrong id header:", req.Header.Get("X-Gorewind-Id"))
+	}
+	if body := <-bodies; string(body) != "data" {
+		t.Error("Wrong body:", string(body))
+	}
+	if req.Header.Get("X-Gorewind-Signature") != "" {
+		t.Error("Unsigned request had a signature.")
+	}
+
+	sink.Secret = []byte("secret")
+	if err := sink.Deliver(testEvent); err != nil {
+		t.Fatal(err)
+	}
+	req = <-received
+	<-bodies
+	expected := Signature(sink.Secret, "mystream", "AAE=", testEvent.Data)
+	if req.Header.Get("X-Gorewind-Signature") != expected {
+		t.Error("Wrong signature:", req.Header.Get("X-Gorewind-Signature"))
+	}
+	// Swapping the stream must invalidate the signature.
+	if Signature(sink.Secret, "other", "AAE=", testEvent.Data) == expected {
+		t.Error("The stream was not signed.")
+	}
+}
+
+func TestHTTPSinkFailure(t *testing.T) {
+	t.Parallel()
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(handler))
+	defer ts.Close()
+
+	sink := NewHTTPSink(ts.URL)
+	if err := sink.Deliver(testEvent); err == nil {
+		t.Error("Expected a failed delivery.")
+	}
+}
+
+func TestExecSink(t *testing.T) {
+	t.Parallel()
+
+	script := `test "$GOREWIND_STREAM" = mystream && test "$(cat)" = data`
+	sink := NewExecSink("sh", "-c", script)
+	if err := sink.Deliver(testEvent); err != nil {
+		t.Error(err)
+	}
+
+	sink = NewExecSink("false")
+	if err := sink.Deliver(testEvent); err == nil {
+		t.Error("Expected a failed delivery.")
+	}
+}
+
+func TestExecSinkTimeout(t *testing.T) {
+	t.Parallel()
+
+	sink := NewExecSink("sleep", "60")
+	sink.Timeout = 50 * time.Millisecond
+	start := time.Now()
+	if err := sink.Deliver(testEvent); err == nil {
+		t.Error("Expected a failed delivery.")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("Command was not killed.")
+	}
+}
+
+func TestHTTPSinkCancel(t *testing.T) {
+	t.Parallel()
+
+	unblock := make(chan bool)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}
+	ts := httptest.NewServer(http.HandlerFunc(handler))
+	defer ts.Close()
+	defer close(unblock)
+
+	sink := NewHTTPSink(ts.URL)
+	delivered := make(chan error, 1)
+	go func() {
+		delivered <- sink.Deliver(testEvent)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	sink.Cancel()
+	sink.Cancel()
+	select {
+	case err := <-delivered:
+		if err == nil {
+			t.Error("Cancelled delivery succeeded.")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Delivery was not interrupted.")
+	}
+	if err := sink.Deliver(testEvent); err == nil {
+		t.Error("Delivery succeeded after cancelling.")
+	}
+}
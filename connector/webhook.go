@@ -0,0 +1,216 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"errors"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+	"github.com/JensRantil/gorewind/eventstore"
+)
+
+// Default number of delivery attempts before an event is parked.
+const DefaultWebhookAttempts = 10
+
+// Delivers events to all webhook subscriptions stored in an event store.
+// Every subscription is delivered by its own connector. Events that
+// could not be delivered after MaxAttempts are parked by the connector.
+// Parked events make up the dead-letter list of the subscription.
+type WebhookManager struct {
+	MaxAttempts int
+	InitialBackoff time.Duration
+
+	store *eventstore.EventStore
+
+	lock sync.Mutex
+	started bool
+	connectors map[string]*Connector
+}
+
+func NewWebhookManager(estore *eventstore.EventStore) *WebhookManager {
+	return &WebhookManager{
+		MaxAttempts: DefaultWebhookAttempts,
+		InitialBackoff: DefaultInitialBackoff,
+		store: estore,
+		connectors: make(map[string]*Connector),
+	}
+}
+
+// The name of the connector delivering a webhook.
+func webhookConnectorName(id string) string {
+	return "webhook-" + id
+}
+
+// Start delivering to all stored webhook subscriptions.
+func (m *WebhookManager) Start() error {
+	webhooks, err := m.store.Webhooks()
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.started {
+		return errors.New("Webhooks already started.")
+	}
+	m.started = true
+	for _, w := range webhooks {
+		m.startConnector(w)
+	}
+	return nil
+}
+
+// Stop delivering to all webhook subscriptions.
+func (m *WebhookManager) Stop() error {
+	// Not stopping connectors with the lock held, since that waits
+	// for deliveries in progress.
+	m.lock.Lock()
+	connectors := m.connectors
+	m.connectors = make(map[string]*Connector)
+	m.started = false
+	m.lock.Unlock()
+
+	var firstErr error
+	for _, conn := range connectors {
+		if err := conn.Stop(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Must be called with lock held.
+func (m *WebhookManager) startConnector(w eventstore.Webhook) {
+	sink := NewHTTPSink(w.URL)
+	sink.Secret = w.Secret
+
+	name := webhookConnectorName(w.Id)
+	conn := New(m.store, name, sink)
+	conn.Filter = w.Filter()
+	conn.MaxAttempts = m.MaxAttempts
+	conn.InitialBackoff = m.InitialBackoff
+	m.connectors[w.Id] = conn
+	conn.Start()
+}
+
+// Persist a new webhook subscription and start delivering to it. Only
+// streams starting with streamPrefix are delivered. Requests are signed
+// with secret, unless it is empty. Only events added after the
+// registration are delivered, unless replay is set, in which case all
+// events already stored are delivered first.
+func (m *WebhookManager) Register(rawurl string, streamPrefix, secret []byte, replay bool) (eventstore.Webhook, error) {
+	parsed, err := url.Parse(rawurl)
+	if err != nil {
+		return eventstore.Webhook{}, err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		msg := "Webhook URL must be http or https: " + rawurl
+		return eventstore.Webhook{}, errors.New(msg)
+	}
+	if len(secret) == 0 {
+		secret = nil
+	}
+
+	var checkpoint func(string) string
+	if !replay {
+		checkpoint = func(id string) string {
+			return checkpointName(webhookConnectorName(id))
+		}
+	}
+	w, err := m.store.AddWebhook(eventstore.Webhook{
+		URL: rawurl,
+		StreamPrefix: streamPrefix,
+		Secret: secret,
+	}, checkpoint)
+	if err != nil {
+		return w, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.started {
+		m.startConnector(w)
+	}
+	return w, nil
+}
+
+// Stop delivering to a webhook subscription and remove it, along with
+// its checkpoints, retry counts and dead letters.
+func (m *WebhookManager) Unregister(id string) error {
+	// Stopped before removing, so that it can't store a checkpoint
+	// after its state was removed. Not stopping the connector with the
+	// lock held, since that waits for the delivery in progress.
+	m.lock.Lock()
+	conn, exists := m.connectors[id]
+	delete(m.connectors, id)
+	m.lock.Unlock()
+	var stopErr error
+	if exists {
+		stopErr = conn.Stop()
+	}
+
+	name := checkpointName(webhookConnectorName(id))
+	if err := m.store.RemoveWebhook(id, name); err != nil {
+		if exists {
+			m.restart(id)
+		}
+		return err
+	}
+	return stopErr
+}
+
+// Start delivering to a stored webhook subscription again.
+func (m *WebhookManager) restart(id string) {
+	webhooks, err := m.store.Webhooks()
+	if err != nil {
+		log.Println("Could not restart webhook", id+":", err)
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, w := range webhooks {
+		if w.Id == id && m.started {
+			m.startConnector(w)
+		}
+	}
+}
+
+// List all webhook subscriptions.
+func (m *WebhookManager) List() ([]eventstore.Webhook, error) {
+	return m.store.Webhooks()
+}
+
+// Find the running connector with the given name. Returns nil if there
+// is none.
+func (m *WebhookManager) Lookup(name string) *Connector {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, conn := range m.connectors {
+		if conn.Name == name {
+			return conn
+		}
+	}
+	return nil
+}
+
+// List the events that could not be delivered to a webhook.
+func (m *WebhookManager) DeadLetters(id string) ([]eventstore.ParkedEvent, error) {
+	name := checkpointName(webhookConnectorName(id))
+	return m.store.ParkedEvents(name)
+}
@@ -0,0 +1,168 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package connector
+
+
+import (
+	"testing"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+	"github.com/JensRantil/gorewind/eventstore"
+)
+
+
+func TestWebhookDeadLetters(t *testing.T) {
+	t.Parallel()
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(handler))
+	defer ts.Close()
+
+	es := setupInMemoryeventstore()
+	manager := NewWebhookManager(es)
+	manager.MaxAttempts = 2
+	manager.InitialBackoff = time.Millisecond
+	if err := manager.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Stop()
+
+	w, err := manager.Register(ts.URL, nil, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := eventstore.StreamName("mystream")
+	id, err := es.Add(eventstore.Event{Stream: stream, Data: []byte("data")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var deadLetters []eventstore.ParkedEvent
+	deadline := time.Now().Add(5 * time.Second)
+	for len(deadLetters) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		deadLetters, err = manager.DeadLetters(w.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(deadLetters) != 1 {
+		t.Fatal("Wrong number of dead letters:", len(deadLetters))
+	}
+	if string(deadLetters[0].Id) != string(id) {
+		t.Error("Wrong event was dead lettered.")
+	}
+
+	if err := manager.Unregister(w.Id); err != nil {
+		t.Fatal(err)
+	}
+	if deadLetters, _ = manager.DeadLetters(w.Id); len(deadLetters) != 0 {
+		t.Error("Dead letters were kept after unregistering:", deadLetters)
+	}
+	name := checkpointName(webhookConnectorName(w.Id))
+	if checkpoint, _ := es.Checkpoint(name, stream); checkpoint != nil {
+		t.Error("Checkpoint was kept after unregistering.")
+	}
+}
+
+func TestWebhookRegistrationSurvivesRestart(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	manager := NewWebhookManager(es)
+	w, err := manager.Register("http://localhost/hook", []byte("orders"), nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := manager.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if _, running := manager.connectors[w.Id]; !running {
+		t.Error("Stored webhook was not started.")
+	}
+	if err := manager.Stop(); err != nil {
+		t.Error(err)
+	}
+
+	if err := manager.Unregister(w.Id); err != nil {
+		t.Fatal(err)
+	}
+	webhooks, err := manager.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(webhooks) != 0 {
+		t.Error("Webhook was not removed.")
+	}
+}
+
+func TestWebhookStartsAtHeadUnlessReplaying(t *testing.T) {
+	t.Parallel()
+
+	bodies := make(chan string, 10)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- string(body)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(handler))
+	defer ts.Close()
+
+	es := setupInMemoryeventstore()
+	stream := eventstore.StreamName("mystream")
+	if _, err := es.Add(eventstore.Event{Stream: stream, Data: []byte("old")}); err != nil {
+		t.Fatal(err)
+	}
+	manager := NewWebhookManager(es)
+	if err := manager.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Stop()
+
+	if _, err := manager.Register(ts.URL, nil, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := es.Add(eventstore.Event{Stream: stream, Data: []byte("new")}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case body := <-bodies:
+		if body != "new" {
+			t.Error("Webhook got an event added before it:", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Event was never delivered.")
+	}
+
+	if _, err := manager.Register(ts.URL, nil, nil, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"old", "new"} {
+		select {
+		case body := <-bodies:
+			if body != expected {
+				t.Error("Wrong replayed event:", body)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Event was never replayed.")
+		}
+	}
+}
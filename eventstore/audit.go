@@ -0,0 +1,89 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Streams whose names start with this prefix are maintained by Gorewind
+// itself. They can be queried, but events can't be added to them.
+var ReservedStreamPrefix []byte = []byte("$")
+
+// The append-only stream holding the audit log.
+var AuditStream StreamName = StreamName("$audit")
+
+// Returned when trying to write to a reserved stream.
+var ErrReservedStream = errors.New("stream name is reserved")
+
+// Whether a stream is maintained by Gorewind itself.
+func IsReservedStream(stream StreamName) bool {
+	return bytes.HasPrefix(stream, ReservedStreamPrefix)
+}
+
+// Streams whose names start with this prefix can't be written to. The
+// events of tenants are published under topics with this prefix, which
+// a stream of the default tenant must not be mistaken for.
+var TenantTopicPrefix []byte = []byte("@")
+
+// Return ErrReservedStream if any of the streams is reserved, or starts
+// with TenantTopicPrefix.
+func checkNotReserved(streams ...StreamName) error {
+	for _, stream := range streams {
+		if IsReservedStream(stream) {
+			return ErrReservedStream
+		}
+		if bytes.HasPrefix(stream, TenantTopicPrefix) {
+			return ErrReservedStream
+		}
+	}
+	return nil
+}
+
+// A single entry in the audit log. Stored as JSON in AuditStream.
+type AuditEntry struct {
+	Time time.Time `json:"time"`
+
+	// Identifies who made the change, for example the ZeroMQ identity
+	// of a client.
+	Client string `json:"client"`
+
+	// The operation, for example the name of a server command.
+	Action string `json:"action"`
+
+	// The arguments of the operation that are safe to keep forever.
+	// Secrets and event data are left out.
+	Arguments []string `json:"arguments,omitempty"`
+}
+
+// Append an entry to the audit log. Time is set to now unless given.
+func (v *EventStore) Audit(entry AuditEntry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return v.updateStreams([]StreamName{AuditStream}, func(b *writeBatch) error {
+		_, err := b.add(Event{AuditStream, data})
+		return err
+	})
+}
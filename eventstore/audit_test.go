@@ -0,0 +1,80 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+
+import (
+	"testing"
+	"encoding/json"
+)
+
+
+func TestAudit(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	entry := AuditEntry{
+		Client: "abcd",
+		Action: "RENAME_STREAM",
+		Arguments: []string{"old", "new"},
+	}
+	if err := es.Audit(entry); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := es.Query(QueryRequest{Stream: AuditStream})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := popAllEvents(res, t)
+	if len(events) != 1 {
+		t.Fatal("Wrong number of audit entries:", len(events))
+	}
+	var stored AuditEntry
+	if err := json.Unmarshal(events[0].Data, &stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.Client != "abcd" || stored.Action != "RENAME_STREAM" || len(stored.Arguments) != 2 {
+		t.Error("Wrong audit entry:", stored)
+	}
+	if stored.Time.IsZero() {
+		t.Error("Audit entry time was not set.")
+	}
+}
+
+func TestReservedStreamsAreNotWritable(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	addEvents(t, es, "mystream", "a")
+	if err := es.Audit(AuditEntry{Action: "TEST"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := es.Add(Event{AuditStream, []byte("forged")}); err != ErrReservedStream {
+		t.Error("Expected ErrReservedStream when adding, was:", err)
+	}
+	if err := es.RenameStream(AuditStream, StreamName("other")); err != ErrReservedStream {
+		t.Error("Expected ErrReservedStream when renaming, was:", err)
+	}
+	if err := es.CopyStream(StreamName("mystream"), StreamName("$copy")); err != ErrReservedStream {
+		t.Error("Expected ErrReservedStream when copying, was:", err)
+	}
+	if err := es.CopyStream(AuditStream, StreamName("auditcopy")); err != nil {
+		t.Error("Expected copying from a reserved stream to work:", err)
+	}
+}
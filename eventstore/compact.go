@@ -0,0 +1,111 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// The groups that hold keys per stream.
+var streamGroups = [][]byte{
+	streamPrefix,
+	eventPrefix,
+	positionPrefix,
+	redactionPrefix,
+	streamUsagePrefix,
+	streamMetadataPrefix,
+}
+
+// A range of streams, from Start up to but not including Limit. A nil
+// Start or Limit leaves the range open in that direction.
+type StreamRange struct {
+	Start StreamName
+	Limit StreamName
+}
+
+// The LevelDB properties reported by Properties.
+var reportedProperties = []string{
+	"leveldb.num-files-at-level0",
+	"leveldb.num-files-at-level1",
+	"leveldb.num-files-at-level2",
+	"leveldb.num-files-at-level3",
+	"leveldb.num-files-at-level4",
+	"leveldb.num-files-at-level5",
+	"leveldb.num-files-at-level6",
+	"leveldb.stats",
+}
+
+// Compact the stored keys of a range of streams of the tenant. LevelDB
+// compacts by itself over time. Compacting manually is only useful to
+// reclaim space right away, for example after renaming or redacting
+// many events. Blocks until done.
+func (v *EventStore) Compact(r StreamRange) error {
+	if v.ReadOnly() {
+		return ErrReadOnly
+	}
+	for _, group := range streamGroups {
+		if err := v.rawDB.CompactRange(v.groupRange(group, r)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The raw key range of a stream range within a group of the tenant.
+func (v *EventStore) groupRange(group []byte, r StreamRange) leveldb.Range {
+	group = (&eventStoreKey{group, nil, nil}).withTenant(v.tenant).groupKey
+
+	// An empty keyId is smaller than all others.
+	start := eventStoreKey{
+		group,
+		r.Start,
+		loadByteCounter([]byte{}),
+	}
+	limit := eventStoreKey{
+		group,
+		r.Limit,
+		loadByteCounter([]byte{}),
+	}
+	if r.Limit == nil {
+		// The rest of the group. Compacting a few keys too many
+		// would not hurt anyway.
+		limit = eventStoreKey{
+			append(append([]byte{}, group...), 0),
+			nil,
+			nil,
+		}
+	}
+	return leveldb.Range{
+		Start: start.toBytes(),
+		Limit: limit.toBytes(),
+	}
+}
+
+// Report a selection of LevelDB properties, such as the number of files
+// at each level. The properties concern the whole database, shared by
+// all tenants.
+func (v *EventStore) Properties() (map[string]string, error) {
+	props := make(map[string]string, len(reportedProperties))
+	for _, name := range reportedProperties {
+		value, err := v.rawDB.GetProperty(name)
+		if err != nil {
+			return nil, err
+		}
+		props[name] = value
+	}
+	return props, nil
+}
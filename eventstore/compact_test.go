@@ -0,0 +1,86 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+import (
+	"testing"
+)
+
+func TestGroupRange(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	acme, err := es.Tenant("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmp := &eventStreamComparer{}
+	id := loadByteCounter([]byte{1})
+	inRange := func(v *EventStore, r StreamRange, key eventStoreKey) bool {
+		raw := v.groupRange(eventPrefix, r)
+		k := key.toBytes()
+		return cmp.Compare(raw.Start, k) <= 0 && cmp.Compare(k, raw.Limit) < 0
+	}
+
+	bounded := StreamRange{StreamName("b"), StreamName("c")}
+	tests := []struct {
+		store *EventStore
+		r StreamRange
+		key eventStoreKey
+		expected bool
+	}{
+		{es, bounded, eventStoreKey{eventPrefix, []byte("b"), id}, true},
+		{es, bounded, eventStoreKey{eventPrefix, []byte("a"), id}, false},
+		{es, bounded, eventStoreKey{eventPrefix, []byte("c"), id}, false},
+		{es, bounded, eventStoreKey{positionPrefix, []byte("b"), id}, false},
+		{es, StreamRange{}, eventStoreKey{eventPrefix, []byte("z"), id}, true},
+		{es, StreamRange{}, eventStoreKey{[]byte("event@acme"), []byte("b"), id}, false},
+		{acme, bounded, eventStoreKey{[]byte("event@acme"), []byte("b"), id}, true},
+		{acme, bounded, eventStoreKey{eventPrefix, []byte("b"), id}, false},
+		{acme, StreamRange{}, eventStoreKey{[]byte("event@acme"), []byte("z"), id}, true},
+	}
+	for _, test := range tests {
+		if inRange(test.store, test.r, test.key) != test.expected {
+			t.Error("Wrong range membership of", string(test.key.toBytes()),
+			"in", test.r, "of tenant", test.store.TenantName())
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	addEvents(t, es, "a", "1", "2")
+	addEvents(t, es, "b", "3")
+	if err := es.Compact(StreamRange{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := es.Compact(StreamRange{Start: StreamName("b")}); err != nil {
+		t.Fatal(err)
+	}
+	checkStreamData(t, es, "a", "1", "2")
+	checkStreamData(t, es, "b", "3")
+
+	props, err := es.Properties()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := props["leveldb.num-files-at-level0"]; !exists {
+		t.Error("Missing property:", props)
+	}
+}
@@ -6,6 +6,10 @@ import (
 	"github.com/syndtr/goleveldb/leveldb/comparer"
 )
 
+// Orders keys by group, key and keyId. Keys written by the event store
+// always come from eventStoreKey.toBytes, so keys that compare equal are
+// also equal byte by byte. That is what bloom filters, which hash the
+// raw keys, require of a comparer.
 type eventStreamComparer struct {
 }
 
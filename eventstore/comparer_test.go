@@ -204,3 +204,32 @@ func TestComparator(t *testing.T) {
 
 	}
 }
+
+// Bloom filters hash raw keys, so keys that compare equal must be equal
+// byte by byte.
+func TestComparatorBloomFilterCompatible(t *testing.T) {
+	t.Parallel()
+
+	keys := []eventStoreKey{
+		eventStoreKey{[]byte("g"), []byte("a"), nil},
+		eventStoreKey{[]byte("g"), []byte("a"), loadByteCounter([]byte{})},
+		eventStoreKey{[]byte("g"), []byte("a"), loadByteCounter([]byte{1})},
+		eventStoreKey{[]byte("g"), []byte("a"), loadByteCounter([]byte{0, 1})},
+		eventStoreKey{[]byte("g"), []byte("a"), loadByteCounter([]byte{1, 0})},
+		eventStoreKey{[]byte("g"), []byte("a:b"), loadByteCounter([]byte{1})},
+		eventStoreKey{[]byte("g"), []byte("a"), loadByteCounter([]byte{'b'})},
+		eventStoreKey{[]byte("g"), []byte(""), nil},
+		eventStoreKey{[]byte("g@t"), []byte("a"), loadByteCounter([]byte{1})},
+	}
+
+	comparer := eventStreamComparer{}
+	for _, a := range keys {
+		for _, b := range keys {
+			ba, bb := a.toBytes(), b.toBytes()
+			equal := comparer.Compare(ba, bb) == 0
+			if equal != bytes.Equal(ba, bb) {
+				t.Errorf("Inconsistent equality of %q and %q", ba, bb)
+			}
+		}
+	}
+}
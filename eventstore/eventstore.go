@@ -31,79 +31,135 @@ import (
 )
 
 // Instance of an event store. All of its functions are threadsafe.
+//
+// An event store is always scoped to a single tenant. The instance
+// returned by New is scoped to the default tenant. Use Tenant to get
+// instances for other tenants.
 type EventStore struct {
+	*sharedState
+
+	// The tenant this instance is scoped to. nil for the default
+	// tenant.
+	tenant []byte
+
+	idGenerator *streamIdGenerator
+
+	// nil for snapshots, which read what they see instead.
+	usageCache *usageCache
+
+	db *tenantDB
+}
+
+// The state shared by the instances of all tenants.
+type sharedState struct {
+	// See EventStore.SoftQuotaWarnings. Accessed atomically, which
+	// is why it comes first. That keeps it 64-bit aligned.
+	softQuotaWarnings int64
+
 	eventPublishersLock sync.RWMutex
 	// Using a map to avoid registering a channel multiple times
-	eventPublishers map[chan StoredEvent]chan StoredEvent
+	eventPublishers map[chan StoredEvent]publisherScope
 
-	idGenerator *streamIdGenerator
+	// The commit position that will be given to the next event
+	// written. Orders all events in the store, across streams.
+	commits *atomicbyteCounter
+
+	// The commit position of the last event written, and a channel
+	// closed whenever it changes. See WaitForPosition.
+	positionLock sync.Mutex
+	applied Position
+	appliedChanged chan bool
+
+	// Serializes all writes. Makes it safe to read what is stored
+	// while staging a batch, and keeps commit positions in the same
+	// order as the writes.
+	writeLock sync.Mutex
 
-	db *leveldb.DB
+	// Signalled whenever a new event has been scheduled. Buffered
+	// with a capacity of one (1) so that scheduling never blocks.
+	scheduleNotify chan bool
+
+	// The instances of all tenants in use, indexed by tenant name.
+	tenantsLock sync.Mutex
+	tenants map[string]*EventStore
+
+	// See AddInterceptor. Guarded by writeLock.
+	interceptors []Interceptor
+
+	// See Options.MaxCachedStreams.
+	maxCachedStreams int
+
+	// See SetReadOnly and Options.ReadOnly. Guarded by writeLock.
+	readOnly bool
+	openedReadOnly bool
+
+	rawDB *leveldb.DB
 }
 
-// Create a new event store instance.
-func New(stor storage.Storage) (*EventStore, error) {
+// Create a new event store instance. `options` may be nil for the
+// LevelDB defaults with a bloom filter of DefaultBloomFilterBits.
+func New(stor storage.Storage, options *Options) (*EventStore, error) {
 	estore := new(EventStore)
+	estore.sharedState = new(sharedState)
 
-	ePublishers := make(map[chan StoredEvent]chan StoredEvent)
+	ePublishers := make(map[chan StoredEvent]publisherScope)
 	estore.eventPublishers = ePublishers
+	estore.scheduleNotify = make(chan bool, 1)
+	estore.tenants = make(map[string]*EventStore)
+	estore.tenants[""] = estore
 
-	options := &opt.Options{
-		Flag: opt.OFCreateIfMissing,
-		Comparer: &eventStreamComparer{},
-	}
-	db, err := leveldb.Open(stor, options)
+	db, err := leveldb.Open(stor, options.leveldbOptions())
 	if err != nil {
 		return nil, err
 	}
-	estore.db = db
+	estore.rawDB = db
+	estore.db = &tenantDB{db, nil, nil}
 
-	estore.idGenerator, err = initStreamIdGenerator(db)
+	estore.maxCachedStreams = options.streamCacheSize()
+	estore.readOnly = options != nil && options.ReadOnly
+	estore.openedReadOnly = estore.readOnly
+	estore.idGenerator = newStreamIdGenerator(estore.loadNextId,
+	estore.maxCachedStreams)
+	estore.usageCache = newUsageCache(estore.maxCachedStreams)
+
+	estore.commits, err = initCommitCounter(estore)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	estore.applied, err = estore.get(commitHeadKey)
 	if err != nil {
 		db.Close()
 		return nil, err
 	}
+	estore.appliedChanged = make(chan bool)
 
 	return estore, nil
 }
 
-// Helper function to initialize a streamIdGenerator.
-func initStreamIdGenerator(db *leveldb.DB) (*streamIdGenerator, error) {
-	gen := newStreamIdGenerator()
+// Close the underlying database. Neither this event store, nor the
+// instances of any other tenant, must be used afterwards.
+func (v *EventStore) Close() error {
+	return v.rawDB.Close()
+}
 
-	searchKey := eventStoreKey{
+// Load the next unused id of a stream from its head. Stream heads are
+// loaded on demand rather than at startup, since there can be millions
+// of streams.
+func (v *EventStore) loadNextId(stream StreamName) (byteCounter, error) {
+	streamKey := eventStoreKey{
 		streamPrefix,
-		nil,
+		stream,
 		nil,
 	}
-
-	ro := &opt.ReadOptions{}
-	it := db.NewIterator(ro)
-	it.Seek(searchKey.toBytes())
-	for it.Valid() {
-		key, err := newEventStoreKey(it.Key())
-		if err != nil {
-			log.Println("A key could not be deserialized:")
-			log.Println(string(it.Key()))
-			return nil, err
-		}
-		if bytes.Compare(key.groupKey, streamPrefix) != 0 {
-			// We have reached the end of the stream listing
-			break
-		}
-
-		stream := key.key
-		latestId := loadByteCounter(it.Value())
-		nextId := latestId.NewIncrementedCounter()
-		err = gen.Register(stream, nextId)
-		if err != nil {
-			return nil, err
-		}
-
-		it.Next()
+	head, err := v.get(streamKey)
+	if err != nil {
+		return nil, err
 	}
-
-	return gen, nil
+	if head == nil {
+		return newByteCounter(), nil
+	}
+	return loadByteCounter(head).NewIncrementedCounter(), nil
 }
 
 // An event that has not yet been persisted to disk.
@@ -124,31 +180,191 @@ type StoredEvent struct {
 
 	// The event that was persisted.
 	Event
+
+	// Whether the data of the event has been replaced. See
+	// EventStore.Redact.
+	Redacted bool
+
+	// The commit position of the event. Only set on published events
+	// and events returned by Append.
+	Position Position
+
+	// The tenant the event belongs to. Only set on published events.
+	// Empty for the default tenant.
+	Tenant string
+}
+
+// Which published events a channel receives.
+type publisherScope struct {
+	tenant string
+	allTenants bool
 }
 
 // Register a channel where are published events will be pushed to.
-// Multiple channels can be registered.
+// Multiple channels can be registered. Only the events of the tenant of
+// this event store are pushed.
 func (v *EventStore) RegisterPublishedEventsChannel(publisher chan StoredEvent) {
 	v.eventPublishersLock.Lock()
 	defer v.eventPublishersLock.Unlock()
-	v.eventPublishers[publisher] = publisher
+	v.eventPublishers[publisher] = publisherScope{tenant: string(v.tenant)}
+}
+
+// Like RegisterPublishedEventsChannel, but the events of all tenants are
+// pushed.
+func (v *EventStore) RegisterAllPublishedEventsChannel(publisher chan StoredEvent) {
+	v.eventPublishersLock.Lock()
+	defer v.eventPublishersLock.Unlock()
+	v.eventPublishers[publisher] = publisherScope{allTenants: true}
+}
+
+// Unregister a channel previously registered using
+// RegisterPublishedEventsChannel or RegisterAllPublishedEventsChannel.
+// The channel must keep being drained until this function has returned.
+func (v *EventStore) UnregisterPublishedEventsChannel(publisher chan StoredEvent) {
+	v.eventPublishersLock.Lock()
+	defer v.eventPublishersLock.Unlock()
+	delete(v.eventPublishers, publisher)
+}
+
+// Push a stored event to all registered publishing channels.
+func (v *EventStore) publish(storedEvent StoredEvent) {
+	v.eventPublishersLock.RLock()
+	defer v.eventPublishersLock.RUnlock()
+	for pubchan, scope := range v.eventPublishers {
+		if scope.allTenants || scope.tenant == storedEvent.Tenant {
+			pubchan <- storedEvent
+		}
+	}
 }
 
 var streamPrefix []byte = []byte("stream")
 var eventPrefix []byte = []byte("event")
+var positionPrefix []byte = []byte("position")
+var commitPrefix []byte = []byte("commit")
+
+// The key under which an event is stored.
+func eventKey(stream StreamName, id []byte) eventStoreKey {
+	return eventStoreKey{
+		eventPrefix,
+		stream,
+		loadByteCounter(id),
+	}
+}
+
+// The key under which the commit position of an event is stored.
+func positionKey(stream StreamName, id EventId) eventStoreKey {
+	return eventStoreKey{
+		positionPrefix,
+		stream,
+		loadByteCounter(id),
+	}
+}
+
+// The key under which the last commit position is stored.
+var commitHeadKey = eventStoreKey{
+	commitPrefix,
+	[]byte("head"),
+	nil,
+}
+
+// Helper function to initialize the commit position counter.
+func initCommitCounter(v *EventStore) (*atomicbyteCounter, error) {
+	head, err := v.get(commitHeadKey)
+	if err != nil {
+		return nil, err
+	}
+	if head == nil {
+		return newAtomicbyteCounter(newByteCounter()), nil
+	}
+	next := loadByteCounter(head).NewIncrementedCounter()
+	return newAtomicbyteCounter(next), nil
+}
 
 type EventId []byte
 
 // Store an event to the event store. Returns the unique event id that
 // the event was stored under. As long as no error occurred, of course.
+// Fails with ErrLeaseHeld while the stream is leased, see AcquireLease.
 func (v *EventStore) Add(event Event) (EventId, error) {
-	newId, err := v.idGenerator.Allocate(event.Stream)
+	stored, err := v.Append(event)
 	if err != nil {
 		return nil, err
 	}
+	return stored.Id, nil
+}
+
+// A set of writes that are persisted atomically. Events added to the
+// batch are published once the batch has been written.
+type writeBatch struct {
+	store *EventStore
+	batch *tenantBatch
+	added []StoredEvent
+
+	// The streams the batch may allocate ids for.
+	ids *idReservation
+
+	// Called, in order, once the batch has been written.
+	onCommit []func()
+
+	// The greatest commit position written by the batch, if any.
+	position Position
 
-	batch := new(leveldb.Batch)
+	// The fencing token of the lease the batch is written under. See
+	// AppendFenced.
+	fence FencingToken
 
+	// How much the batch changes what the tenant, and every stream
+	// written to, stores.
+	usage Usage
+	streamUsage map[string]*Usage
+}
+
+// Stage an event to be appended to its stream. Returns the event as it
+// will be stored once the batch has been written, after interception.
+// Reserved streams can't be written to, and neither can streams leased
+// by someone else.
+func (b *writeBatch) Add(event Event) (StoredEvent, error) {
+	stream := event.Stream
+	if err := b.store.intercept(&event); err != nil {
+		return StoredEvent{}, err
+	}
+	if err := checkNotReserved(event.Stream); err != nil {
+		return StoredEvent{}, err
+	}
+	if !bytes.Equal(event.Stream, stream) {
+		return StoredEvent{}, ErrStreamIntercepted
+	}
+	if err := b.checkLease(event.Stream); err != nil {
+		return StoredEvent{}, err
+	}
+	return b.add(event)
+}
+
+// Like Add, but also allows writing to reserved streams. Sealed streams
+// can't be written to.
+func (b *writeBatch) add(event Event) (StoredEvent, error) {
+	if err := b.store.checkNotSealed(event.Stream); err != nil {
+		return StoredEvent{}, err
+	}
+	newId, err := b.ids.Allocate(event.Stream)
+	if err != nil {
+		return StoredEvent{}, err
+	}
+
+	storedEvent := StoredEvent{
+		Id: EventId(newId),
+		Event: event,
+		Position: Position(b.store.commits.Next()),
+	}
+	b.put(storedEvent, byteCounter(storedEvent.Position))
+	b.account(event.Stream, 1, int64(len(event.Data)))
+	b.added = append(b.added, storedEvent)
+	return storedEvent, nil
+}
+
+// Stage the keys of a single event. The event becomes the head of its
+// stream.
+func (b *writeBatch) put(event StoredEvent, position byteCounter) {
 	// TODO: Benchmark how much impact this write has. We could also
 	// check if it exists and not write it in that case, which is
 	// probably faster. Especially if we are using bloom filter.
@@ -157,33 +373,146 @@ func (v *EventStore) Add(event Event) (EventId, error) {
 		event.Stream,
 		nil,
 	}
-	batch.Put(streamKey.toBytes(), newId.toBytes())
+	b.batch.Put(streamKey.toBytes(), event.Id)
 
 	evKey := eventStoreKey{
 		eventPrefix,
 		event.Stream,
-		newId.toBytes(),
+		loadByteCounter(event.Id),
+	}
+	b.batch.Put(evKey.toBytes(), event.Data)
+
+	if position != nil {
+		posKey := positionKey(event.Stream, event.Id)
+		b.batch.Put(posKey.toBytes(), position)
+		// Shared by all tenants.
+		b.batch.Batch.Put(commitHeadKey.toBytes(), position)
+		b.position = Position(position)
 	}
-	batch.Put(evKey.toBytes(), event.Data)
+}
 
-	wo := &opt.WriteOptions{}
-	err = v.db.Write(batch, wo)
+// Atomically persist everything staged by fn. Nothing is written if fn
+// returns an error, in which case that error is returned. fn must not
+// append events, see updateStreams.
+func (v *EventStore) update(fn func(b *writeBatch) error) error {
+	return v.updateStreams(nil, fn)
+}
+
+// Like update, but fn may append events to streams, or otherwise change
+// their ids. The counters of the streams are reserved, and loaded if
+// needed, before taking the write lock. Until then, only writes to
+// streams sharing a shard of the id generator wait for each other.
+func (v *EventStore) updateStreams(streams []StreamName, fn func(b *writeBatch) error) error {
+	if v.db.snapshot != nil {
+		return ErrReadOnly
+	}
+	ids, err := v.idGenerator.Reserve(streams...)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	b := &writeBatch{
+		store: v,
+		batch: &tenantBatch{new(leveldb.Batch), v.tenant},
+		ids: ids,
 	}
 
-	storedEvent := StoredEvent{
-		[]byte(newId),
-		event,
+	v.writeLock.Lock()
+	err = v.write(b, fn)
+	ids.Release(err == nil)
+	v.writeLock.Unlock()
+	if err != nil {
+		return err
 	}
 
-	v.eventPublishersLock.RLock()
-	defer v.eventPublishersLock.RUnlock()
-	for pubchan := range v.eventPublishers {
-		pubchan <- storedEvent
+	for _, storedEvent := range b.added {
+		storedEvent.Tenant = string(v.tenant)
+		v.publish(storedEvent)
 	}
+	return nil
+}
+
+// Stage everything with fn and write it. The write lock must be held.
+func (v *EventStore) write(b *writeBatch, fn func(b *writeBatch) error) error {
+	if v.readOnly {
+		return ErrReadOnly
+	}
+	if err := fn(b); err != nil {
+		return err
+	}
+	if err := b.applyUsage(); err != nil {
+		return err
+	}
+	wo := &opt.WriteOptions{}
+	if err := v.db.Write(b.batch.Batch, wo); err != nil {
+		return err
+	}
+	for _, commit := range b.onCommit {
+		commit()
+	}
+	if b.position != nil {
+		v.setApplied(b.position)
+	}
+	return nil
+}
+
+// Read a single value. Returns nil, without an error, if the key does
+// not exist.
+func (v *EventStore) get(key eventStoreKey) ([]byte, error) {
+	ro := &opt.ReadOptions{}
+	value, err := v.db.Get(key.toBytes(), ro)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	return value, err
+}
 
-	return EventId(newId), nil
+// Whether a key exists. Unlike get, this tells keys with empty values
+// from missing ones.
+func (v *EventStore) has(key eventStoreKey) (bool, error) {
+	ro := &opt.ReadOptions{}
+	_, err := v.db.Get(key.toBytes(), ro)
+	if err == leveldb.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Returned by scanGroup callbacks to stop scanning without an error.
+var errStopScan = errors.New("stop scanning")
+
+// Call fn for every key/value pair in a group, starting with the
+// smallest key that is greater or equal to start. Stops at the end of
+// the group or when fn returns an error. errStopScan stops the scan
+// without returning an error. fn must not retain the key or value.
+func (v *EventStore) scanGroup(group, start []byte, fn func(*eventStoreKey, []byte) error) error {
+	ro := &opt.ReadOptions{}
+	it := v.db.NewIterator(ro)
+
+	// An empty keyId is smaller than all others, while a nil keyId is
+	// greater.
+	seekKey := eventStoreKey{
+		group,
+		start,
+		loadByteCounter([]byte{}),
+	}
+	it.Seek(seekKey.toBytes())
+	for it.Valid() {
+		key, err := newEventStoreKey(it.Key())
+		if err != nil {
+			return err
+		}
+		if bytes.Compare(key.groupKey, group) != 0 {
+			break
+		}
+		if err := fn(key, it.Value()); err != nil {
+			if err == errStopScan {
+				return nil
+			}
+			return err
+		}
+		it.Next()
+	}
+	return nil
 }
 
 // List the available streams through a stream.
@@ -221,6 +550,10 @@ func (v* EventStore) ListStreams(start StreamName, maxItems int) chan StreamName
 
 
 // A query request.
+//
+// FromId and ToId are both inclusive and must be ids of events in
+// Stream; ids of other streams are refused as missing. Setting both to
+// the same id returns that single event.
 type QueryRequest struct {
 	Stream []byte
 	FromId []byte
@@ -238,68 +571,91 @@ type QueryRequest struct {
 // TODO: Also make the error checking asynchronously, to
 // minimize IO blocking when calling this function.
 func (v *EventStore) Query(req QueryRequest) (chan StoredEvent, error) {
-	ro := &opt.ReadOptions{}
-	it := v.db.NewIterator(ro)
-
-	// To key
-	var toKeyBytes []byte
+	// Existence is checked through point lookups rather than seeks,
+	// since they are answered by the bloom filter for most missing
+	// events.
+	toKey := eventKey(req.Stream, req.ToId)
 	if req.ToId != nil {
-		seekKey := eventStoreKey{
-			streamPrefix,
-			req.Stream,
-			loadByteCounter(req.ToId),
+		exists, err := v.has(toKey)
+		if err != nil {
+			return nil, err
 		}
-		toKeyBytes = seekKey.toBytes()
-		it.Seek(toKeyBytes)
-		if bytes.Compare(toKeyBytes, it.Key()) != 0 {
-			bToId := string(toKeyBytes)
+		if !exists {
+			bToId := string(toKey.toBytes())
 			msg := fmt.Sprint("to key did not exist:", bToId)
 			return nil, errors.New(msg)
 		}
 	}
 
-	// From key
-	var fromKeyBytes []byte
+	fromKey := eventKey(req.Stream, newByteCounter())
 	if req.FromId != nil {
-		seekKey := eventStoreKey{
-			eventPrefix,
-			req.Stream,
-			loadByteCounter(req.FromId),
+		fromKey = eventKey(req.Stream, req.FromId)
+		exists, err := v.has(fromKey)
+		if err != nil {
+			return nil, err
 		}
-		fromKeyBytes = seekKey.toBytes()
-		it.Seek(fromKeyBytes)
-		if bytes.Compare(fromKeyBytes, it.Key()) != 0 {
-			bFromId := string(fromKeyBytes)
+		if !exists {
+			bFromId := string(fromKey.toBytes())
 			msg := fmt.Sprint("from key did not exist:", bFromId)
 			return nil, errors.New(msg)
 		}
-	} else {
-		seekKey := eventStoreKey{
-			eventPrefix,
-			req.Stream,
-			newByteCounter(),
-		}
-		fromKeyBytes = seekKey.toBytes()
-		it.Seek(fromKeyBytes)
 	}
 
 	if req.FromId != nil && req.ToId != nil {
-		diff := new(eventStreamComparer).Compare(fromKeyBytes, toKeyBytes)
-		if diff >= -1 {
+		if fromKey.Compare(&toKey) > 0 {
 			msg := "The query was done in wrong chronological order."
 			return nil, errors.New(msg)
 		}
 	}
 
+	ro := &opt.ReadOptions{}
+	it := v.db.NewIterator(ro)
+	it.Seek(fromKey.toBytes())
+
+	// Read after the iterator was created, so that no redaction it
+	// sees can be missed. Markers are looked up for every event if the
+	// metadata can't be read.
+	meta, err := v.StreamMetadata(req.Stream)
+	if err != nil {
+		log.Println("Could not load stream metadata:", err)
+		meta.Redacted = true
+	}
+
 	res := make(chan StoredEvent)
-	go safeQuery(it, req, res)
+	go v.safeQuery(it, req, meta.Redacted, res)
 
 	return res, nil
 }
 
+// Get a single event. Returns ErrNoSuchEvent if it does not exist.
+func (v *EventStore) Get(stream StreamName, id EventId) (*StoredEvent, error) {
+	ro := &opt.ReadOptions{}
+	key := eventKey(stream, id)
+	data, err := v.db.Get(key.toBytes(), ro)
+	if err == leveldb.ErrNotFound {
+		return nil, ErrNoSuchEvent
+	}
+	if err != nil {
+		return nil, err
+	}
+	marker, err := v.get(redactionKey(stream, id))
+	if err != nil {
+		return nil, err
+	}
+	event := &StoredEvent{
+		Id: id,
+		Event: Event{
+			Stream: stream,
+			Data: data,
+		},
+		Redacted: marker != nil,
+	}
+	return event, nil
+}
+
 // Make the actual query. Sanity checks of the iterator i is expected to
 // have been done before calling this function.
-func safeQuery(i iter.Iterator, req QueryRequest, res chan StoredEvent) {
+func (v *EventStore) safeQuery(i iter.Iterator, req QueryRequest, redacted bool, res chan StoredEvent) {
 	defer close(res)
 	for i.Valid() {
 		curKey, err := newEventStoreKey(i.Key())
@@ -319,12 +675,19 @@ func safeQuery(i iter.Iterator, req QueryRequest, res chan StoredEvent) {
 		}
 
 		resEvent := StoredEvent{
-			curKey.keyId.toBytes(),
-			Event{
+			Id: curKey.keyId.toBytes(),
+			Event: Event{
 				curKey.key,
 				[]byte(i.Value()),
 			},
 		}
+		if redacted {
+			marker, err := v.get(redactionKey(curKey.key, resEvent.Id))
+			if err != nil {
+				log.Println("Could not look up redaction:", err)
+			}
+			resEvent.Redacted = marker != nil
+		}
 		res <- resEvent
 
 		keyId := curKey.keyId.toBytes()
@@ -21,6 +21,9 @@ import (
 	"testing"
 	"bytes"
 	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
 	"sync"
 	"github.com/syndtr/goleveldb/leveldb/storage"
 )
@@ -28,7 +31,7 @@ import (
 
 func setupInMemoryeventstore() *EventStore {
 	stor := &storage.MemStorage{}
-	es, err := New(stor)
+	es, err := New(stor, nil)
 	if err != nil {
 		// so that calling test does not have to deal with this.
 		panic(err)
@@ -70,6 +73,246 @@ func TestQueryingEmptyStream(t *testing.T) {
 	}
 }
 
+func TestGet(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	stream := StreamName("mystream")
+	id, err := es.Add(Event{stream, []byte("data")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	emptyId, err := es.Add(Event{stream, []byte{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event, err := es.Get(stream, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(event.Data) != "data" || !bytes.Equal(event.Id, id) {
+		t.Error("Wrong event:", event)
+	}
+	if _, err := es.Get(stream, emptyId); err != nil {
+		t.Error("Event without data was not found:", err)
+	}
+	if _, err := es.Get(StreamName("other"), id); err != ErrNoSuchEvent {
+		t.Error("Expected ErrNoSuchEvent, was:", err)
+	}
+	if _, err := es.Get(stream, EventId([]byte{42})); err != ErrNoSuchEvent {
+		t.Error("Expected ErrNoSuchEvent, was:", err)
+	}
+}
+
+func TestQueryRange(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	stream := StreamName("mystream")
+	addEvents(t, es, "mystream", "1", "2", "3", "4")
+	addEvents(t, es, "other", "5")
+	events := checkStreamData(t, es, "mystream", "1", "2", "3", "4")
+
+	res, err := es.Query(QueryRequest{
+		Stream: stream,
+		FromId: events[1].Id,
+		ToId: events[2].Id,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sliced := popAllEvents(res, t)
+	if len(sliced) != 2 || string(sliced[0].Data) != "2" || string(sliced[1].Data) != "3" {
+		t.Error("Wrong slice:", sliced)
+	}
+
+	res, err = es.Query(QueryRequest{Stream: stream, ToId: events[0].Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sliced := popAllEvents(res, t); len(sliced) != 1 {
+		t.Error("Wrong slice:", sliced)
+	}
+
+	malformed := []QueryRequest{
+		{Stream: stream, FromId: []byte{42}},
+		{Stream: stream, ToId: []byte{42}},
+		{Stream: StreamName("other"), FromId: events[3].Id},
+		{Stream: stream, FromId: events[2].Id, ToId: events[1].Id},
+	}
+	for _, req := range malformed {
+		if _, err := es.Query(req); err == nil {
+			t.Error("Expected an error for:", req)
+		}
+	}
+}
+
+func TestQueryRangeBounds(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	stream := StreamName("mystream")
+	addEvents(t, es, "mystream", "1", "2", "3")
+	addEvents(t, es, "other", "4")
+	events := checkStreamData(t, es, "mystream", "1", "2", "3")
+
+	// A range of a single event used to be refused as being in the
+	// wrong order.
+	res, err := es.Query(QueryRequest{
+		Stream: stream,
+		FromId: events[1].Id,
+		ToId: events[1].Id,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sliced := popAllEvents(res, t)
+	if len(sliced) != 1 || string(sliced[0].Data) != "2" {
+		t.Error("Wrong slice:", sliced)
+	}
+
+	// The ids exist in "mystream", but not in these streams.
+	missing := []QueryRequest{
+		{Stream: StreamName("other"), ToId: events[2].Id},
+		{Stream: StreamName("other"), FromId: events[0].Id, ToId: events[2].Id},
+		{Stream: StreamName("nonexisting"), ToId: events[0].Id},
+	}
+	for _, req := range missing {
+		if _, err := es.Query(req); err == nil {
+			t.Error("Expected an error for:", req)
+		}
+	}
+}
+
+func TestStreamHeadEviction(t *testing.T) {
+	t.Parallel()
+
+	stor := &storage.MemStorage{}
+	options := &Options{MaxCachedStreams: 2}
+	es, err := New(stor, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streams := []string{"a", "b", "c", "d", "e"}
+	for _, stream := range streams {
+		addEvents(t, es, stream, "1")
+	}
+	if es.idGenerator.Len() > 2 {
+		t.Error("Stream heads were not evicted:", es.idGenerator.Len())
+	}
+	for _, stream := range streams {
+		addEvents(t, es, stream, "2")
+	}
+	es.Close()
+
+	if es, err = New(stor, options); err != nil {
+		t.Fatal(err)
+	}
+	defer es.Close()
+	if es.idGenerator.Len() != 0 {
+		t.Error("Stream heads were loaded at startup.")
+	}
+	for _, stream := range streams {
+		addEvents(t, es, stream, "3")
+		events := checkStreamData(t, es, stream, "1", "2", "3")
+		for i, event := range events {
+			if bytes.Compare(event.Id, []byte{byte(i)}) != 0 {
+				t.Error("Wrong id of event", i, "in", stream, ":", event.Id)
+			}
+		}
+	}
+}
+
+// Appending to many streams at once while their heads are evicted. An
+// id allocated twice would overwrite an event. Best run with the race
+// detector.
+func TestConcurrentAppends(t *testing.T) {
+	t.Parallel()
+
+	options := &Options{MaxCachedStreams: 4}
+	es, err := New(&storage.MemStorage{}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer es.Close()
+
+	streams, workers, perWorker := 10, 8, 50
+	wgroup := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wgroup.Add(1)
+		go func(w int) {
+			defer wgroup.Done()
+			for i := 0; i < perWorker; i++ {
+				stream := StreamName(fmt.Sprint("stream", (w + i) % streams))
+				if _, err := es.Add(Event{stream, []byte(fmt.Sprint(w, i))}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wgroup.Wait()
+
+	total := 0
+	for s := 0; s < streams; s++ {
+		res, err := es.Query(QueryRequest{Stream: StreamName(fmt.Sprint("stream", s))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += len(popAllEvents(res, t))
+	}
+	if total != workers * perWorker {
+		t.Error("Events were lost:", total)
+	}
+}
+
+func TestConcurrentAddWithEviction(t *testing.T) {
+	t.Parallel()
+
+	es, err := New(&storage.MemStorage{}, &Options{MaxCachedStreams: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	streams := 10
+	writers := 8
+	perWriter := 25
+
+	wgroup := sync.WaitGroup{}
+	for w := 0; w < writers; w++ {
+		wgroup.Add(1)
+		go func(w int) {
+			defer wgroup.Done()
+			for i := 0; i < perWriter; i++ {
+				stream := StreamName(fmt.Sprint("stream", (w + i) % streams))
+				if _, err := es.Add(Event{stream, []byte("data")}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wgroup.Wait()
+
+	total := 0
+	for i := 0; i < streams; i++ {
+		res, err := es.Query(QueryRequest{Stream: StreamName(fmt.Sprint("stream", i))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		events := popAllEvents(res, t)
+		for j := 1; j < len(events); j++ {
+			if bytes.Compare(events[j-1].Id, events[j].Id) == 0 {
+				t.Error("Duplicate id in stream", i, ":", events[j].Id)
+			}
+		}
+		total += len(events)
+	}
+	if total != writers * perWriter {
+		t.Error("Events were lost or overwritten:", total)
+	}
+}
+
 func randBytes(n int) []byte {
 	res := make([]byte, n)
 	rand.Reader.Read(res)
@@ -91,8 +334,8 @@ func testAddAndQuery(t *testing.T, es *EventStore, stream StreamName, n int) {
 		}
 
 		events = append(events, StoredEvent{
-			id,
-			Event{
+			Id: id,
+			Event: Event{
 				stream,
 				testEvent.Data,
 			},
@@ -196,3 +439,111 @@ func testConcurrentAddAndQuery(t *testing.T) {
 	}
 	wgroup.Wait()
 }
+
+// The number of events stored by the benchmarks. Bloom filters pay off
+// once the events are spread over several levels of tables on disk.
+const benchmarkEvents = 20000
+
+// An on-disk event store holding benchmarkEvents events spread over 100
+// streams. Returns the stored events and a function that removes the
+// store.
+func setupBenchmarkStore(b *testing.B, options *Options) (*EventStore, []StoredEvent, func()) {
+	dir, err := ioutil.TempDir("", "gorewind-benchmark")
+	if err != nil {
+		b.Fatal(err)
+	}
+	stor, err := storage.OpenFile(dir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	es, err := New(stor, options)
+	if err != nil {
+		b.Fatal(err)
+	}
+	cleanup := func() {
+		es.Close()
+		stor.Close()
+		os.RemoveAll(dir)
+	}
+
+	events := make([]StoredEvent, 0, benchmarkEvents)
+	data := randBytes(100)
+	for i := 0; i < benchmarkEvents; i++ {
+		stream := StreamName(fmt.Sprint("stream", i % 100))
+		id, err := es.Add(Event{stream, data})
+		if err != nil {
+			cleanup()
+			b.Fatal(err)
+		}
+		events = append(events, StoredEvent{
+			Id: id,
+			Event: Event{Stream: stream},
+		})
+	}
+	b.ResetTimer()
+	return es, events, cleanup
+}
+
+func benchmarkGet(b *testing.B, options *Options, missing bool) {
+	es, events, cleanup := setupBenchmarkStore(b, options)
+	defer cleanup()
+
+	for i := 0; i < b.N; i++ {
+		event := events[i % len(events)]
+		stream := event.Stream
+		if missing {
+			// Same ids, but in streams that don't exist.
+			stream = StreamName(fmt.Sprint("missing", i % 100))
+		}
+		_, err := es.Get(stream, event.Id)
+		if missing && err != ErrNoSuchEvent {
+			b.Fatal("Expected ErrNoSuchEvent, was:", err)
+		} else if !missing && err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	benchmarkGet(b, nil, false)
+}
+
+func BenchmarkGetWithoutBloomFilter(b *testing.B) {
+	benchmarkGet(b, &Options{}, false)
+}
+
+func BenchmarkGetMissing(b *testing.B) {
+	benchmarkGet(b, nil, true)
+}
+
+func BenchmarkGetMissingWithoutBloomFilter(b *testing.B) {
+	benchmarkGet(b, &Options{}, true)
+}
+
+func benchmarkQueryValidation(b *testing.B, options *Options) {
+	es, events, cleanup := setupBenchmarkStore(b, options)
+	defer cleanup()
+
+	for i := 0; i < b.N; i++ {
+		event := events[i % len(events)]
+		req := QueryRequest{
+			Stream: event.Stream,
+			FromId: event.Id,
+			ToId: event.Id,
+		}
+		res, err := es.Query(req)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _ = range res {
+		}
+	}
+}
+
+func BenchmarkQueryValidation(b *testing.B) {
+	benchmarkQueryValidation(b, nil)
+}
+
+func BenchmarkQueryValidationWithoutBloomFilter(b *testing.B) {
+	benchmarkQueryValidation(b, &Options{})
+}
@@ -18,7 +18,10 @@ package eventstore
 
 import (
 	"bytes"
-	"errors"
+	"container/list"
+	"hash/fnv"
+	"log"
+	"sort"
 	"sync"
 )
 
@@ -111,56 +114,228 @@ func (c *atomicbyteCounter) Next() byteCounter {
 	return res
 }
 
-// Keeps track of ordered set of byteCounters, one per registered stream.
+// Loads the next unused counter of a stream from storage.
+type counterLoader func(name StreamName) (byteCounter, error)
+
+// The next unused counter of a stream.
+type streamCounter struct {
+	name string
+	next byteCounter
+}
+
+// The number of shards of a streamIdGenerator. Ids of streams in
+// different shards can be allocated at the same time.
+const idGeneratorShards = 16
+
+// Keeps track of the next unused byteCounter of recently used streams.
+// Counters are loaded on first use, and the least recently used ones are
+// evicted once there are more than `capacity` of them.
+//
+// Streams are spread over shards by the hash of their name. Counters
+// are only used through a reservation of their shards, see Reserve,
+// which is held until the allocated ids have been persisted. This keeps
+// the ids of a stream persisted in the order they were allocated, and
+// counters from being evicted before their ids were persisted. Each
+// shard evicts on its own, so the least recently used counters are only
+// evicted first within a shard.
 type streamIdGenerator struct {
+	shards []*idShard
+}
+
+// The counters of the streams hashing to a shard.
+type idShard struct {
+	load counterLoader
+	capacity int
+
 	// key type must be string because []byte is not a valid key
-	// data type.
-	counters map[string]*atomicbyteCounter
+	// data type. The values are elements of recent.
+	counters map[string]*list.Element
+	// streamCounters, most recently used first.
+	recent *list.List
 
-	// lock for counters
-	lock sync.RWMutex
+	// Held by the reservation using the shard, and for counters and
+	// recent. Also held while loading, so that a counter is only ever
+	// loaded once.
+	lock sync.Mutex
 }
 
-func newStreamIdGenerator() (s *streamIdGenerator) {
-	s = new(streamIdGenerator)
-	s.counters = make(map[string]*atomicbyteCounter)
-	return
+func newStreamIdGenerator(load counterLoader, capacity int) *streamIdGenerator {
+	nshards := idGeneratorShards
+	if capacity < nshards {
+		nshards = capacity
+	}
+	return newShardedStreamIdGenerator(load, capacity, nshards)
 }
 
-// Check whether a named counter previously has been registered.
-func (g *streamIdGenerator) isRegistered(name StreamName) (exists bool) {
-	g.lock.RLock()
-	defer g.lock.RUnlock()
-	_, exists = g.counters[string(name)]
-	return
+// Create a streamIdGenerator with a specific number of shards, sharing
+// the capacity between them.
+func newShardedStreamIdGenerator(load counterLoader, capacity, nshards int) *streamIdGenerator {
+	if nshards < 1 {
+		nshards = 1
+	}
+	g := &streamIdGenerator{make([]*idShard, nshards)}
+	for i := range g.shards {
+		g.shards[i] = &idShard{
+			load: load,
+			capacity: capacity / nshards,
+			counters: make(map[string]*list.Element),
+			recent: list.New(),
+		}
+	}
+	return g
+}
+
+// The index of the shard of a stream.
+func (g *streamIdGenerator) shardIndex(name StreamName) int {
+	h := fnv.New32a()
+	h.Write(name)
+	return int(h.Sum32() % uint32(len(g.shards)))
+}
+
+// Reserve the shards of streams and load their counters. Blocks until
+// earlier reservations of the same shards have been released. Shards
+// are locked in order, so that reservations never deadlock. Unless an
+// error is returned, the reservation must be released.
+func (g *streamIdGenerator) Reserve(names ...StreamName) (*idReservation, error) {
+	r := &idReservation{gen: g}
+	for _, name := range names {
+		i := g.shardIndex(name)
+		if !r.reserved(i) {
+			r.indices = append(r.indices, i)
+		}
+	}
+	sort.Ints(r.indices)
+	for _, i := range r.indices {
+		g.shards[i].lock.Lock()
+	}
+	for _, name := range names {
+		if _, err := r.shard(name).counter(name); err != nil {
+			r.Release(false)
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// The number of counters in memory.
+func (g *streamIdGenerator) Len() int {
+	n := 0
+	for _, shard := range g.shards {
+		shard.lock.Lock()
+		n += shard.recent.Len()
+		shard.lock.Unlock()
+	}
+	return n
 }
 
-// Register a new byteCounter.
-func (g *streamIdGenerator) Register(name StreamName, init byteCounter) error {
-	if g.isRegistered(name) {
-		// TODO: Constantify this error
-		return errors.New("name already registered")
+// Get the counter of a stream, loading it if needed. s.lock must be
+// held.
+func (s *idShard) counter(name StreamName) (*streamCounter, error) {
+	if elem, exists := s.counters[string(name)]; exists {
+		s.recent.MoveToFront(elem)
+		return elem.Value.(*streamCounter), nil
+	}
+	next, err := s.load(name)
+	if err != nil {
+		return nil, err
 	}
+	counter := &streamCounter{string(name), next}
+	s.counters[counter.name] = s.recent.PushFront(counter)
+	return counter, nil
+}
 
-	g.lock.Lock()
-	defer g.lock.Unlock()
-	g.counters[string(name)] = newAtomicbyteCounter(init)
+// Forget the counter of a stream. s.lock must be held.
+func (s *idShard) remove(name StreamName) {
+	if elem, exists := s.counters[string(name)]; exists {
+		s.recent.Remove(elem)
+		delete(s.counters, string(name))
+	}
+}
 
-	return nil
+// Evict the least recently used counters until no more than capacity
+// are left. s.lock must be held, and all allocated counters must have
+// been persisted.
+func (s *idShard) trim() {
+	for s.recent.Len() > s.capacity {
+		elem := s.recent.Back()
+		s.recent.Remove(elem)
+		delete(s.counters, elem.Value.(*streamCounter).name)
+	}
 }
 
-// Allocate a new unused counter for a specific stream.
-//
-// TODO: Remove error return value. It never happens.
-func (g *streamIdGenerator) Allocate(name StreamName) (byteCounter, error) {
-	if !g.isRegistered(name) {
-		// Auto registering
-		g.Register(name, []byte{0})
+// The shards of a streamIdGenerator locked by Reserve. Using a stream
+// that was not reserved is a bug, and panics.
+type idReservation struct {
+	gen *streamIdGenerator
+	// The indices of the locked shards.
+	indices []int
+	// The streams ids were allocated for.
+	allocated []StreamName
+}
+
+func (r *idReservation) reserved(i int) bool {
+	for _, index := range r.indices {
+		if index == i {
+			return true
+		}
+	}
+	return false
+}
+
+// The shard of a reserved stream.
+func (r *idReservation) shard(name StreamName) *idShard {
+	i := r.gen.shardIndex(name)
+	if !r.reserved(i) {
+		log.Panicf("Stream %q was not reserved.", name)
 	}
+	return r.gen.shards[i]
+}
 
-	g.lock.RLock()
-	defer g.lock.RUnlock()
-	counter := g.counters[string(name)]
-	res := counter.Next()
+// Allocate a new unused counter for a reserved stream.
+func (r *idReservation) Allocate(name StreamName) (byteCounter, error) {
+	counter, err := r.shard(name).counter(name)
+	if err != nil {
+		return nil, err
+	}
+	r.allocated = append(r.allocated, name)
+	res := counter.next
+	counter.next = res.NewIncrementedCounter()
 	return res, nil
 }
+
+// Set the next counter of a reserved stream.
+func (r *idReservation) Set(name StreamName, next byteCounter) {
+	shard := r.shard(name)
+	if elem, exists := shard.counters[string(name)]; exists {
+		shard.recent.MoveToFront(elem)
+		elem.Value.(*streamCounter).next = next
+		return
+	}
+	counter := &streamCounter{string(name), next}
+	shard.counters[counter.name] = shard.recent.PushFront(counter)
+}
+
+// Forget a reserved stream. Its counter is loaded again on next
+// allocation.
+func (r *idReservation) Remove(name StreamName) {
+	r.shard(name).remove(name)
+}
+
+// Unlock the reserved shards. Once the allocated ids have been
+// persisted, the shards evict their least recently used counters.
+// Otherwise the counters ids were allocated from are forgotten, to be
+// loaded again from what was persisted.
+func (r *idReservation) Release(persisted bool) {
+	if !persisted {
+		for _, name := range r.allocated {
+			r.Remove(name)
+		}
+	}
+	for _, i := range r.indices {
+		shard := r.gen.shards[i]
+		if persisted {
+			shard.trim()
+		}
+		shard.lock.Unlock()
+	}
+}
@@ -21,7 +21,10 @@ import (
 	"testing"
 	"testing/quick"
 	"bytes"
+	"fmt"
 	"sort"
+	"sync"
+	"time"
 )
 
 func TestReverseBytes(t *testing.T) {
@@ -100,19 +103,31 @@ func (b byteSorter) Swap(i, j int) {
 	b[i], b[j] = b[j], b[i]
 }
 
+// Allocate a single id in a reservation of its own.
+func allocateOnce(t *testing.T, gen *streamIdGenerator, name string) byteCounter {
+	r, err := gen.Reserve(StreamName(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Release(true)
+	id, err := r.Allocate(StreamName(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
 func TestIdGenerator(t *testing.T) {
 	t.Parallel()
 
-	gen := newStreamIdGenerator()
+	gen := newStreamIdGenerator(func(StreamName) (byteCounter, error) {
+		return newByteCounter(), nil
+	}, 10)
 
 	n := 10
 	ids := make(byteSorter, 0, n)
 	for i:=0 ; i < n ; i++ {
-		id, err := gen.Allocate([]byte("mystream"))
-		if err != nil {
-			t.Fatal(err)
-		}
-		ids = append(ids, id)
+		ids = append(ids, allocateOnce(t, gen, "mystream"))
 	}
 	sort.Sort(ids)
 	for i:=1 ; i < n ; i++ {
@@ -122,6 +137,229 @@ func TestIdGenerator(t *testing.T) {
 	}
 }
 
+func TestIdGeneratorEviction(t *testing.T) {
+	t.Parallel()
+
+	// Stands in for what has been persisted.
+	persisted := map[string]byteCounter{}
+	loads := 0
+	gen := newShardedStreamIdGenerator(func(name StreamName) (byteCounter, error) {
+		loads++
+		if last, exists := persisted[string(name)]; exists {
+			return last.NewIncrementedCounter(), nil
+		}
+		return newByteCounter(), nil
+	}, 2, 1)
+	allocate := func(name string) byteCounter {
+		id := allocateOnce(t, gen, name)
+		persisted[name] = id
+		return id
+	}
+
+	for _, name := range []string{"a", "b", "c"} {
+		allocate(name)
+	}
+	if loads != 3 || gen.Len() != 2 {
+		t.Error("Counters were not evicted on release:", loads, gen.Len())
+	}
+
+	// "a" was least recently used.
+	id := allocate("a")
+	if loads != 4 || bytes.Compare(id, []byte{1}) != 0 {
+		t.Error("Evicted counter was not reloaded:", loads, id)
+	}
+	id = allocate("c")
+	if loads != 4 || bytes.Compare(id, []byte{1}) != 0 {
+		t.Error("Counter was not kept:", loads, id)
+	}
+
+	// Ids that were not persisted are allocated again.
+	r, err := gen.Reserve(StreamName("c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Allocate(StreamName("c")); err != nil {
+		t.Fatal(err)
+	}
+	r.Release(false)
+	if id := allocate("c"); bytes.Compare(id, []byte{2}) != 0 {
+		t.Error("Released counter was not reloaded:", id)
+	}
+
+	if r, err = gen.Reserve(StreamName("d")); err != nil {
+		t.Fatal(err)
+	}
+	r.Set(StreamName("d"), []byte{5})
+	r.Release(true)
+	if id := allocate("d"); bytes.Compare(id, []byte{5}) != 0 {
+		t.Error("Set was not respected:", id)
+	}
+	if r, err = gen.Reserve(StreamName("d")); err != nil {
+		t.Fatal(err)
+	}
+	r.Remove(StreamName("d"))
+	r.Release(true)
+	if id := allocate("d"); bytes.Compare(id, []byte{6}) != 0 {
+		t.Error("Removed counter was not reloaded:", id)
+	}
+}
+
+func TestIdGeneratorUnreservedStream(t *testing.T) {
+	t.Parallel()
+
+	gen := newShardedStreamIdGenerator(func(StreamName) (byteCounter, error) {
+		return newByteCounter(), nil
+	}, 2, 2)
+	// Streams in different shards.
+	a, b := StreamName("a"), StreamName("b")
+	for i := 0; gen.shardIndex(a) == gen.shardIndex(b); i++ {
+		b = StreamName(fmt.Sprint("b", i))
+	}
+	r, err := gen.Reserve(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Release(false)
+	defer func() {
+		if recover() == nil {
+			t.Error("Allocating for an unreserved stream did not panic.")
+		}
+	}()
+	r.Allocate(b)
+}
+
+// Check that the allocated ids of each stream are unique. Returns the
+// total number of ids.
+func checkUniqueIds(t *testing.T, allocated map[string]byteSorter) int {
+	total := 0
+	for name, ids := range allocated {
+		sort.Sort(ids)
+		for i := 1; i < len(ids); i++ {
+			if bytes.Compare(ids[i-1], ids[i]) == 0 {
+				t.Error("Duplicate id in", name, ":", ids[i])
+			}
+		}
+		total += len(ids)
+	}
+	return total
+}
+
+// Many goroutines allocating from the same new streams at once. Every
+// stream must be loaded once, or its counter would be reset. Best run
+// with the race detector.
+func TestIdGeneratorConcurrentRegistration(t *testing.T) {
+	t.Parallel()
+
+	var loadsLock sync.Mutex
+	loads := map[string]int{}
+	gen := newStreamIdGenerator(func(name StreamName) (byteCounter, error) {
+		// Widens the window for racing registrations.
+		time.Sleep(time.Millisecond)
+		loadsLock.Lock()
+		loads[string(name)]++
+		loadsLock.Unlock()
+		return newByteCounter(), nil
+	}, 100)
+
+	streams, workers, perWorker := 5, 20, 50
+	var allocatedLock sync.Mutex
+	allocated := map[string]byteSorter{}
+	wgroup := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wgroup.Add(1)
+		go func(w int) {
+			defer wgroup.Done()
+			for i := 0; i < perWorker; i++ {
+				name := fmt.Sprint("stream", (w + i) % streams)
+				id := allocateOnce(t, gen, name)
+				allocatedLock.Lock()
+				allocated[name] = append(allocated[name], id)
+				allocatedLock.Unlock()
+			}
+		}(w)
+	}
+	wgroup.Wait()
+
+	for name, n := range loads {
+		if n != 1 {
+			t.Error("Stream", name, "was loaded", n, "times.")
+		}
+	}
+	if total := checkUniqueIds(t, allocated); total != workers * perWorker {
+		t.Error("Wrong number of ids:", total)
+	}
+}
+
+// Allocating from many streams, some of them in the same reservation,
+// while evicting. Mirrors how the event store uses the generator: ids
+// are persisted before the reservation is released, and so must be in
+// the order they were allocated. Best run with the race detector.
+func TestIdGeneratorConcurrentEviction(t *testing.T) {
+	t.Parallel()
+
+	var persistedLock sync.Mutex
+	persisted := map[string]byteCounter{}
+	gen := newStreamIdGenerator(func(name StreamName) (byteCounter, error) {
+		persistedLock.Lock()
+		defer persistedLock.Unlock()
+		if last, exists := persisted[string(name)]; exists {
+			return last.NewIncrementedCounter(), nil
+		}
+		return newByteCounter(), nil
+	}, 8)
+
+	streams, workers, perWorker := 50, 10, 100
+	var allocatedLock sync.Mutex
+	allocated := map[string]byteSorter{}
+	wgroup := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wgroup.Add(1)
+		go func(w int) {
+			defer wgroup.Done()
+			for i := 0; i < perWorker; i++ {
+				names := []StreamName{StreamName(fmt.Sprint("stream", (w * 7 + i) % streams))}
+				if i % 5 == 0 {
+					// Reserved in the opposite order by other workers.
+					other := StreamName(fmt.Sprint("stream", (w * 3 + i) % streams))
+					names = append(names, other)
+				}
+				r, err := gen.Reserve(names...)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				for _, name := range names {
+					id, err := r.Allocate(name)
+					if err != nil {
+						t.Error(err)
+						continue
+					}
+					persistedLock.Lock()
+					if last, exists := persisted[string(name)]; exists && last.Compare(id) >= 0 {
+						t.Error("Id persisted out of order:", string(name), id)
+					}
+					persisted[string(name)] = id
+					persistedLock.Unlock()
+
+					allocatedLock.Lock()
+					allocated[string(name)] = append(allocated[string(name)], id)
+					allocatedLock.Unlock()
+				}
+				r.Release(true)
+			}
+		}(w)
+	}
+	wgroup.Wait()
+
+	total := workers * perWorker + workers * perWorker / 5
+	if n := checkUniqueIds(t, allocated); n != total {
+		t.Error("Wrong number of ids:", n)
+	}
+	if gen.Len() > 8 {
+		t.Error("Counters were not evicted:", gen.Len())
+	}
+}
+
 func TestAtomicByteCounter(t *testing.T) {
 	t.Parallel()
 
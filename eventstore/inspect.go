@@ -0,0 +1,171 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+import (
+	"bytes"
+	"sort"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// Orders keys like eventStreamComparer, but falls back to plain byte
+// ordering instead of panicing on keys that can't be deserialized. This
+// makes it possible to read a database containing malformed keys. The
+// resulting order is not necessarily consistent, so it must never be
+// used for writing.
+type tolerantComparer struct {
+	eventStreamComparer
+}
+
+func (v *tolerantComparer) Compare(a, b []byte) int {
+	keyA, errA := newEventStoreKey(a)
+	keyB, errB := newEventStoreKey(b)
+	if errA != nil || errB != nil {
+		return bytes.Compare(a, b)
+	}
+	return keyA.Compare(keyB)
+}
+
+// Number of keys and their total size for a key group.
+type GroupReport struct {
+	Keys int
+	Bytes int64
+}
+
+// What was found for a single stream.
+type StreamReport struct {
+	// Empty for the default tenant.
+	Tenant string
+	Name StreamName
+	// The latest event id according to the stream key. nil if the
+	// stream key is missing.
+	Head []byte
+	// The id of the last event actually found.
+	LastEvent []byte
+	Events int
+	// Total size of the event data.
+	Bytes int64
+}
+
+// Whether the stream head agrees with the events found.
+func (r *StreamReport) Consistent() bool {
+	return bytes.Compare(r.Head, r.LastEvent) == 0
+}
+
+// A key that could not be deserialized.
+type MalformedKey struct {
+	Key []byte
+	Error string
+}
+
+// The result of inspecting a database.
+type InspectReport struct {
+	// Indexed by group key, including the tenant if any.
+	Groups map[string]*GroupReport
+	// Grouped by tenant, and sorted by name within each tenant.
+	Streams []*StreamReport
+	Malformed []MalformedKey
+}
+
+// Inspect the raw content of a database without an EventStore. Unlike
+// New, this neither fails nor panics on malformed keys, which are
+// reported instead. The database is not created if it does not exist.
+//
+// LevelDB can't open a database read-only. Opening it may replay its
+// journal and compact it, which would order its tables by the tolerant
+// ordering above rather than the one the event store expects. Only ever
+// inspect a copy of a database.
+func Inspect(stor storage.Storage) (*InspectReport, error) {
+	options := &opt.Options{
+		Comparer: &tolerantComparer{},
+	}
+	db, err := leveldb.Open(stor, options)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	report := &InspectReport{
+		Groups: make(map[string]*GroupReport),
+		Streams: make([]*StreamReport, 0),
+		Malformed: make([]MalformedKey, 0),
+	}
+	// Indexed by "tenant@stream". Tenant names never contain '@'.
+	streams := make(map[string]*StreamReport)
+	getStream := func(tenant, name []byte) *StreamReport {
+		index := string(tenant) + "@" + string(name)
+		sr, exists := streams[index]
+		if !exists {
+			sr = &StreamReport{
+				Tenant: string(tenant),
+				Name: StreamName(name),
+			}
+			streams[index] = sr
+		}
+		return sr
+	}
+
+	ro := &opt.ReadOptions{}
+	it := db.NewIterator(ro)
+	for it.First(); it.Valid(); it.Next() {
+		rawKey := append([]byte(nil), it.Key()...)
+		key, err := newEventStoreKey(rawKey)
+		if err != nil {
+			report.Malformed = append(report.Malformed,
+			MalformedKey{rawKey, err.Error()})
+			continue
+		}
+
+		group, exists := report.Groups[string(key.groupKey)]
+		if !exists {
+			group = new(GroupReport)
+			report.Groups[string(key.groupKey)] = group
+		}
+		group.Keys++
+		group.Bytes += int64(len(rawKey) + len(it.Value()))
+
+		baseGroup, tenant := key.splitTenant()
+		switch {
+		case bytes.Compare(baseGroup, streamPrefix) == 0:
+			sr := getStream(tenant, key.key)
+			sr.Head = append([]byte(nil), it.Value()...)
+		case bytes.Compare(baseGroup, eventPrefix) == 0:
+			sr := getStream(tenant, key.key)
+			sr.Events++
+			sr.Bytes += int64(len(it.Value()))
+			lastId := byteCounter(sr.LastEvent)
+			if sr.LastEvent == nil || lastId.Compare(key.keyId) < 0 {
+				sr.LastEvent = key.keyId.toBytes()
+			}
+		}
+	}
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(streams))
+	for name := range streams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		report.Streams = append(report.Streams, streams[name])
+	}
+	return report, nil
+}
@@ -0,0 +1,111 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+
+import (
+	"testing"
+	"bytes"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+
+func TestInspect(t *testing.T) {
+	t.Parallel()
+
+	stor := &storage.MemStorage{}
+	es, err := New(stor, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{"a", "bb", "ccc"} {
+		if _, err := es.Add(Event{StreamName("mystream"), []byte(data)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := es.Add(Event{StreamName("other"), []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := es.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Inspect(stor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Malformed) != 0 {
+		t.Error("Unexpected malformed keys:", report.Malformed)
+	}
+	if report.Groups["event"].Keys != 4 || report.Groups["stream"].Keys != 2 {
+		t.Error("Wrong key counts:", report.Groups)
+	}
+	if len(report.Streams) != 2 {
+		t.Fatal("Wrong number of streams:", len(report.Streams))
+	}
+	sr := report.Streams[0]
+	if string(sr.Name) != "mystream" || sr.Events != 3 || sr.Bytes != 6 {
+		t.Error("Wrong stream report:", sr)
+	}
+	if bytes.Compare(sr.Head, []byte{2}) != 0 || !sr.Consistent() {
+		t.Error("Wrong stream head:", sr.Head, sr.LastEvent)
+	}
+}
+
+func TestInspectMalformedKeys(t *testing.T) {
+	t.Parallel()
+
+	// Malformed keys can't be written through an EventStore, since its
+	// comparer panics on them.
+	stor := &storage.MemStorage{}
+	options := &opt.Options{
+		Flag: opt.OFCreateIfMissing,
+		Comparer: &tolerantComparer{},
+	}
+	db, err := leveldb.Open(stor, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wo := &opt.WriteOptions{}
+	evKey := eventStoreKey{eventPrefix, []byte("mystream"), []byte{0}}
+	if err := db.Put(evKey.toBytes(), []byte("data"), wo); err != nil {
+		t.Fatal(err)
+	}
+	malformed := []byte("event:mystream:!!!")
+	if err := db.Put(malformed, []byte("data"), wo); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Inspect(stor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Malformed) != 1 {
+		t.Fatal("Wrong number of malformed keys:", report.Malformed)
+	}
+	if bytes.Compare(report.Malformed[0].Key, malformed) != 0 {
+		t.Error("Wrong malformed key:", report.Malformed[0].Key)
+	}
+	if len(report.Streams) != 1 || report.Streams[0].Consistent() {
+		t.Error("Missing stream head was not detected:", report.Streams)
+	}
+}
@@ -0,0 +1,57 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+import (
+	"errors"
+)
+
+// Returned when an interceptor moves an event to another stream.
+var ErrStreamIntercepted = errors.New("interceptor changed the stream")
+
+// Inspects an event before it is appended to a stream of a tenant,
+// empty for the default tenant. The interceptor may modify the event,
+// for example to add metadata to its data, or return an error to reject
+// it. The error is returned from Add as it is. The stream can't be
+// changed, since its ids are allocated before interceptors are called.
+//
+// Interceptors are called while all writes are blocked, so they should
+// be quick and must not write to the event store themselves. They
+// should replace Data rather than modify it in place, since it is
+// shared with the caller of Add.
+type Interceptor func(tenant string, event *Event) error
+
+// Add an interceptor, called for every event appended to any tenant
+// after the interceptors added before it. Events appended by Add,
+// MergeStreams and sagas are intercepted. Scheduled events are
+// intercepted by Schedule, rather than when due. Copied and renamed
+// streams, as well as the audit log, are not.
+func (v *EventStore) AddInterceptor(interceptor Interceptor) {
+	v.writeLock.Lock()
+	defer v.writeLock.Unlock()
+	v.interceptors = append(v.interceptors, interceptor)
+}
+
+// Run an event through all interceptors. The write lock must be held.
+func (v *EventStore) intercept(event *Event) error {
+	for _, interceptor := range v.interceptors {
+		if err := interceptor(v.TenantName(), event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
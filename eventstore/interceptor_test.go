@@ -0,0 +1,141 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestInterceptorModifies(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	es.AddInterceptor(func(tenant string, event *Event) error {
+		event.Data = append([]byte("first "), event.Data...)
+		return nil
+	})
+	es.AddInterceptor(func(tenant string, event *Event) error {
+		event.Data = append([]byte("second "), event.Data...)
+		return nil
+	})
+	published := make(chan StoredEvent, 1)
+	es.RegisterPublishedEventsChannel(published)
+	defer es.UnregisterPublishedEventsChannel(published)
+
+	addEvents(t, es, "mystream", "data")
+	checkStreamData(t, es, "mystream", "second first data")
+	if event := <-published; string(event.Data) != "second first data" {
+		t.Error("The original event was published:", string(event.Data))
+	}
+}
+
+func TestInterceptorRejects(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	errInvalid := errors.New("invalid event")
+	var tenants []string
+	es.AddInterceptor(func(tenant string, event *Event) error {
+		tenants = append(tenants, tenant)
+		if string(event.Data) == "invalid" {
+			return errInvalid
+		}
+		return nil
+	})
+	acme, err := es.Tenant("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := es.Add(Event{StreamName("mystream"), []byte("invalid")}); err != errInvalid {
+		t.Error("Expected the event to be rejected, was:", err)
+	}
+	if _, err := acme.Add(Event{StreamName("mystream"), []byte("valid")}); err != nil {
+		t.Error(err)
+	}
+	checkStreamData(t, es, "mystream")
+	checkStreamData(t, acme, "mystream", "valid")
+	if len(tenants) != 2 || tenants[0] != "" || tenants[1] != "acme" {
+		t.Error("Wrong tenants were intercepted:", tenants)
+	}
+
+	// Rejected when scheduled, not when due.
+	later := time.Now().Add(time.Hour)
+	if _, err := es.Schedule(Event{StreamName("mystream"), []byte("invalid")}, later); err != errInvalid {
+		t.Error("Expected the scheduled event to be rejected, was:", err)
+	}
+	if scheduled, err := es.ScheduledEvents(10); err != nil || len(scheduled) != 0 {
+		t.Error("Rejected event was scheduled:", scheduled, err)
+	}
+}
+
+func TestInterceptorReservedStream(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	es.AddInterceptor(func(tenant string, event *Event) error {
+		event.Stream = AuditStream
+		return nil
+	})
+	if _, err := es.Add(Event{StreamName("mystream"), []byte("data")}); err != ErrReservedStream {
+		t.Error("Expected ErrReservedStream, was:", err)
+	}
+}
+
+func TestInterceptorChangingStream(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	es.AddInterceptor(func(tenant string, event *Event) error {
+		event.Stream = StreamName("other")
+		return nil
+	})
+	if _, err := es.Add(Event{StreamName("mystream"), []byte("data")}); err != ErrStreamIntercepted {
+		t.Error("Expected ErrStreamIntercepted, was:", err)
+	}
+	checkStreamData(t, es, "other")
+}
+
+func TestInterceptorCopyAndRename(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	addEvents(t, es, "a", "data", "invalid")
+	errInvalid := errors.New("invalid event")
+	es.AddInterceptor(func(tenant string, event *Event) error {
+		if string(event.Data) == "invalid" {
+			return errInvalid
+		}
+		event.Data = append([]byte("checked "), event.Data...)
+		return nil
+	})
+
+	// Moved data is neither rejected nor rewritten.
+	if err := es.CopyStream(StreamName("a"), StreamName("b")); err != nil {
+		t.Fatal(err)
+	}
+	checkStreamData(t, es, "b", "data", "invalid")
+	if err := es.RenameStream(StreamName("b"), StreamName("c")); err != nil {
+		t.Fatal(err)
+	}
+	checkStreamData(t, es, "c", "data", "invalid")
+	if u, err := es.StreamUsage(StreamName("c")); err != nil || u.Bytes != 11 {
+		t.Error("Wrong usage of the renamed stream:", u, err)
+	}
+}
@@ -0,0 +1,125 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+import (
+	"bytes"
+	"github.com/syndtr/goleveldb/leveldb"
+	iter "github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// Tenants share a database, but only ever see their own keys. The types
+// in this file translate between the keys used by the rest of the
+// package, which know nothing about tenants, and the keys actually
+// stored. See eventStoreKey.withTenant.
+
+// Qualify a serialized key with a tenant.
+func qualifyKey(key, tenant []byte) []byte {
+	if tenant == nil {
+		return key
+	}
+	parsed, err := newEventStoreKey(key)
+	if err != nil {
+		// The comparer would not accept it anyway.
+		panic(err)
+	}
+	return parsed.withTenant(tenant).toBytes()
+}
+
+// Strip the tenant from a stored key. Keys belonging to other tenants
+// are returned as they are. Their group then differs from every group
+// used by the package, which makes scans stop at them.
+func unqualifyKey(key, tenant []byte) []byte {
+	if tenant == nil {
+		return key
+	}
+	parsed, err := newEventStoreKey(key)
+	if err != nil {
+		return key
+	}
+	group, keyTenant := parsed.splitTenant()
+	if !bytes.Equal(keyTenant, tenant) {
+		return key
+	}
+	parsed.groupKey = group
+	return parsed.toBytes()
+}
+
+// A database as seen by a single tenant. Reads go through the snapshot
+// instead, if there is one.
+type tenantDB struct {
+	*leveldb.DB
+	tenant []byte
+	snapshot *leveldb.Snapshot
+}
+
+func (db *tenantDB) Get(key []byte, ro *opt.ReadOptions) ([]byte, error) {
+	if db.snapshot != nil {
+		return db.snapshot.Get(qualifyKey(key, db.tenant), ro)
+	}
+	return db.DB.Get(qualifyKey(key, db.tenant), ro)
+}
+
+func (db *tenantDB) Put(key, value []byte, wo *opt.WriteOptions) error {
+	return db.DB.Put(qualifyKey(key, db.tenant), value, wo)
+}
+
+func (db *tenantDB) Delete(key []byte, wo *opt.WriteOptions) error {
+	return db.DB.Delete(qualifyKey(key, db.tenant), wo)
+}
+
+func (db *tenantDB) NewIterator(ro *opt.ReadOptions) iter.Iterator {
+	if db.snapshot != nil {
+		return &tenantIterator{db.snapshot.NewIterator(ro), db.tenant}
+	}
+	return &tenantIterator{db.DB.NewIterator(ro), db.tenant}
+}
+
+// An iterator as seen by a single tenant. Only seeking and keys need
+// translation.
+type tenantIterator struct {
+	iter.Iterator
+	tenant []byte
+}
+
+func (it *tenantIterator) Seek(key []byte) bool {
+	return it.Iterator.Seek(qualifyKey(key, it.tenant))
+}
+
+func (it *tenantIterator) Key() []byte {
+	key := it.Iterator.Key()
+	if key == nil {
+		return nil
+	}
+	return unqualifyKey(key, it.tenant)
+}
+
+// A batch as seen by a single tenant. The embedded batch can be used
+// for writing keys shared by all tenants.
+type tenantBatch struct {
+	*leveldb.Batch
+	tenant []byte
+}
+
+func (b *tenantBatch) Put(key, value []byte) {
+	b.Batch.Put(qualifyKey(key, b.tenant), value)
+}
+
+func (b *tenantBatch) Delete(key []byte) {
+	b.Batch.Delete(qualifyKey(key, b.tenant))
+}
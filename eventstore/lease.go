@@ -0,0 +1,150 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+import (
+	"errors"
+	"time"
+)
+
+// Returned when a stream is leased by someone else.
+var ErrLeaseHeld = errors.New("stream is leased")
+
+// Returned when writing with, or renewing, a lease that has expired or
+// has been superseded by a later lease.
+var ErrStaleFencingToken = errors.New("stale fencing token")
+
+// Identifies a lease. The leases of a stream are given increasing
+// tokens, so a writer holding an expired lease can be told apart from
+// the current one.
+type FencingToken uint64
+
+// A lease giving a single writer the exclusive right to add events to a
+// stream until it expires.
+type Lease struct {
+	Stream StreamName
+	Token FencingToken
+	Expires time.Time
+}
+
+// Whether a lease recorded in stream metadata is in effect.
+func (m *StreamMetadata) leased(now time.Time) bool {
+	return m.LeaseToken != 0 && now.Before(m.LeaseExpires)
+}
+
+// Acquire a lease on a stream for `ttl`. While the lease is in effect,
+// events can only be added to the stream through AppendFenced with the
+// token of the lease. Returns ErrLeaseHeld if the stream already is
+// leased. The stream does not need to exist. Scheduled events are added
+// regardless of leases.
+func (v *EventStore) AcquireLease(stream StreamName, ttl time.Duration) (Lease, error) {
+	if err := checkNotReserved(stream); err != nil {
+		return Lease{}, err
+	}
+	if ttl <= 0 {
+		return Lease{}, errors.New("lease time must be positive")
+	}
+	var lease Lease
+	err := v.update(func(b *writeBatch) error {
+		meta, err := v.StreamMetadata(stream)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if meta.leased(now) {
+			return ErrLeaseHeld
+		}
+		meta.LeaseToken++
+		meta.LeaseExpires = now.Add(ttl).UTC()
+		lease = Lease{stream, meta.LeaseToken, meta.LeaseExpires}
+		return b.setStreamMetadata(stream, meta)
+	})
+	return lease, err
+}
+
+// Extend a lease that still is in effect by `ttl`, counting from now.
+// Returns ErrStaleFencingToken if the lease has expired.
+func (v *EventStore) RenewLease(stream StreamName, token FencingToken, ttl time.Duration) (Lease, error) {
+	if ttl <= 0 {
+		return Lease{}, errors.New("lease time must be positive")
+	}
+	var lease Lease
+	err := v.update(func(b *writeBatch) error {
+		meta, err := v.StreamMetadata(stream)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if meta.LeaseToken != token || !meta.leased(now) {
+			return ErrStaleFencingToken
+		}
+		meta.LeaseExpires = now.Add(ttl).UTC()
+		lease = Lease{stream, meta.LeaseToken, meta.LeaseExpires}
+		return b.setStreamMetadata(stream, meta)
+	})
+	return lease, err
+}
+
+// Give up a lease before it expires. Returns ErrStaleFencingToken if it
+// already has expired.
+func (v *EventStore) ReleaseLease(stream StreamName, token FencingToken) error {
+	return v.update(func(b *writeBatch) error {
+		meta, err := v.StreamMetadata(stream)
+		if err != nil {
+			return err
+		}
+		if meta.LeaseToken != token || !meta.leased(time.Now()) {
+			return ErrStaleFencingToken
+		}
+		// The token is kept, so that the next lease gets a greater
+		// one.
+		meta.LeaseExpires = time.Time{}
+		return b.setStreamMetadata(stream, meta)
+	})
+}
+
+// Like Append, but on behalf of the holder of a lease. Fails with
+// ErrStaleFencingToken unless the lease with the token is in effect.
+func (v *EventStore) AppendFenced(event Event, token FencingToken) (StoredEvent, error) {
+	var stored StoredEvent
+	err := v.updateStreams([]StreamName{event.Stream}, func(b *writeBatch) (err error) {
+		b.fence = token
+		stored, err = b.Add(event)
+		return
+	})
+	return stored, err
+}
+
+// Make sure that the batch may add events to a stream. A fence of 0
+// means the batch holds no lease.
+func (b *writeBatch) checkLease(stream StreamName) error {
+	meta, err := b.store.StreamMetadata(stream)
+	if err != nil {
+		return err
+	}
+	leased := meta.leased(time.Now())
+	if b.fence == 0 {
+		if leased {
+			return ErrLeaseHeld
+		}
+		return nil
+	}
+	if !leased || meta.LeaseToken != b.fence {
+		return ErrStaleFencingToken
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLease(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	stream := StreamName("order")
+	event := Event{stream, []byte("data")}
+	addEvents(t, es, "order", "placed")
+
+	lease, err := es.AcquireLease(stream, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.Token == 0 || !lease.Expires.After(time.Now()) {
+		t.Error("Wrong lease:", lease)
+	}
+	if _, err := es.AcquireLease(stream, time.Hour); err != ErrLeaseHeld {
+		t.Error("Leased a stream twice:", err)
+	}
+	if _, err := es.Add(event); err != ErrLeaseHeld {
+		t.Error("Added to a leased stream without a token:", err)
+	}
+	if _, err := es.AppendFenced(event, lease.Token + 1); err != ErrStaleFencingToken {
+		t.Error("Added with a wrong token:", err)
+	}
+	if _, err := es.AppendFenced(event, lease.Token); err != nil {
+		t.Error("Lease holder could not add:", err)
+	}
+
+	if err := es.ReleaseLease(stream, lease.Token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := es.AppendFenced(event, lease.Token); err != ErrStaleFencingToken {
+		t.Error("Added with a released lease:", err)
+	}
+	if _, err := es.RenewLease(stream, lease.Token, time.Hour); err != ErrStaleFencingToken {
+		t.Error("Renewed a released lease:", err)
+	}
+	addEvents(t, es, "order", "unleased")
+
+	next, err := es.AcquireLease(stream, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Token <= lease.Token {
+		t.Error("Fencing token did not increase:", next.Token)
+	}
+	checkStreamData(t, es, "order", "placed", "data", "unleased")
+
+	if _, err := es.AcquireLease(AuditStream, time.Hour); err != ErrReservedStream {
+		t.Error("Leased a reserved stream:", err)
+	}
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	stream := StreamName("order")
+	event := Event{stream, []byte("data")}
+	ttl := 20 * time.Millisecond
+
+	old, err := es.AcquireLease(stream, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	renewed, err := es.RenewLease(stream, old.Token, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed.Token != old.Token || renewed.Expires.Before(old.Expires) {
+		t.Error("Wrong renewed lease:", renewed)
+	}
+	time.Sleep(2 * ttl)
+
+	// Expired leases no longer fence off other writers.
+	if _, err := es.AppendFenced(event, old.Token); err != ErrStaleFencingToken {
+		t.Error("Added with an expired lease:", err)
+	}
+	if _, err := es.RenewLease(stream, old.Token, ttl); err != ErrStaleFencingToken {
+		t.Error("Renewed an expired lease:", err)
+	}
+	addEvents(t, es, "order", "unleased")
+
+	current, err := es.AcquireLease(stream, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := es.AppendFenced(event, old.Token); err != ErrStaleFencingToken {
+		t.Error("Added with a superseded lease:", err)
+	}
+	if _, err := es.AppendFenced(event, current.Token); err != nil {
+		t.Error("Lease holder could not add:", err)
+	}
+}
+
+func TestLeaseCopyAndRename(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	addEvents(t, es, "a", "1")
+
+	// A leased stream can't be written to by copying or renaming.
+	if _, err := es.AcquireLease(StreamName("b"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := es.CopyStream(StreamName("a"), StreamName("b")); err != ErrLeaseHeld {
+		t.Error("Copied to a leased stream:", err)
+	}
+	if err := es.RenameStream(StreamName("a"), StreamName("b")); err != ErrLeaseHeld {
+		t.Error("Renamed to a leased stream:", err)
+	}
+
+	// The lease moves along with the stream.
+	lease, err := es.AcquireLease(StreamName("a"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := es.RenameStream(StreamName("a"), StreamName("c")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := es.Add(Event{StreamName("c"), []byte("2")}); err != ErrLeaseHeld {
+		t.Error("Lease was not moved:", err)
+	}
+	if _, err := es.AppendFenced(Event{StreamName("c"), []byte("2")}, lease.Token); err != nil {
+		t.Error("Lease holder could not add:", err)
+	}
+	// The old name keeps its token.
+	next, err := es.AcquireLease(StreamName("a"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Token <= lease.Token {
+		t.Error("Fencing token of the old name regressed:", next.Token)
+	}
+
+	// A lease is dropped rather than given a token the new name has
+	// already handed out.
+	for i := 0; i < 2; i++ {
+		l, err := es.AcquireLease(StreamName("d"), time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := es.ReleaseLease(StreamName("d"), l.Token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addEvents(t, es, "e", "1")
+	lease, err = es.AcquireLease(StreamName("e"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := es.RenameStream(StreamName("e"), StreamName("d")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := es.AppendFenced(Event{StreamName("d"), []byte("2")}, lease.Token); err != ErrStaleFencingToken {
+		t.Error("Added with a token the stream had handed out before:", err)
+	}
+	next, err = es.AcquireLease(StreamName("d"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Token <= 2 {
+		t.Error("Fencing token of the new name regressed:", next.Token)
+	}
+}
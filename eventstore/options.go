@@ -0,0 +1,106 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+import (
+	"github.com/syndtr/goleveldb/leveldb/cache"
+	"github.com/syndtr/goleveldb/leveldb/filter"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// The number of bits per key of the bloom filter used unless told
+// otherwise. Gives about one percent false positives.
+const DefaultBloomFilterBits = 10
+
+// The number of stream heads kept in memory per tenant unless told
+// otherwise.
+const DefaultMaxCachedStreams = 100000
+
+// Tuning of the event store and the underlying LevelDB database. Zero
+// values leave the defaults in place.
+type Options struct {
+	// Number of streams per tenant whose next event id is kept in
+	// memory. The least recently written streams are evicted beyond
+	// that, and read from disk again when next written to. See
+	// DefaultMaxCachedStreams.
+	MaxCachedStreams int
+	// Size in bytes of the cache of uncompressed blocks. LevelDB
+	// defaults to 8 MiB.
+	BlockCacheSize int
+	// Number of bits per key in the bloom filter used to skip reading
+	// blocks that can't contain a key when looking up single events.
+	// See DefaultBloomFilterBits. No filter is used if 0.
+	BloomFilterBits int
+	// Number of bytes to keep in memory before writing them to a
+	// sorted table on disk. LevelDB defaults to 4 MiB.
+	WriteBufferSize int
+	// Number of files LevelDB may keep open. LevelDB defaults to 1000.
+	MaxOpenFiles int
+	// Disable the Snappy compression of blocks.
+	DisableCompression bool
+	// Open an existing database in read-only mode, which can't be
+	// switched off. See EventStore.SetReadOnly. The database is not
+	// created if missing. LevelDB still locks the database and may
+	// tidy up its own files, so another process can't have it open.
+	// Serve a copy instead.
+	ReadOnly bool
+}
+
+// The options used if New is given nil.
+func defaultOptions() *Options {
+	return &Options{
+		BloomFilterBits: DefaultBloomFilterBits,
+	}
+}
+
+// The number of stream heads to keep in memory.
+func (o *Options) streamCacheSize() int {
+	if o == nil || o.MaxCachedStreams <= 0 {
+		return DefaultMaxCachedStreams
+	}
+	return o.MaxCachedStreams
+}
+
+// The LevelDB options of the event store.
+func (o *Options) leveldbOptions() *opt.Options {
+	options := &opt.Options{
+		Flag: opt.OFCreateIfMissing,
+		Comparer: &eventStreamComparer{},
+	}
+	if o == nil {
+		o = defaultOptions()
+	}
+	if o.ReadOnly {
+		options.Flag &^= opt.OFCreateIfMissing
+	}
+	if o.BlockCacheSize > 0 {
+		options.BlockCache = cache.NewLRUCache(o.BlockCacheSize)
+	}
+	if o.BloomFilterBits > 0 {
+		options.Filter = filter.NewBloomFilter(o.BloomFilterBits)
+	}
+	if o.WriteBufferSize > 0 {
+		options.WriteBuffer = o.WriteBufferSize
+	}
+	if o.MaxOpenFiles > 0 {
+		options.MaxOpenFiles = o.MaxOpenFiles
+	}
+	if o.DisableCompression {
+		options.CompressionType = opt.NoCompression
+	}
+	return options
+}
@@ -0,0 +1,83 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+import (
+	"testing"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestDefaultOptions(t *testing.T) {
+	t.Parallel()
+
+	var options *Options
+	lopts := options.leveldbOptions()
+	if lopts.Flag != opt.OFCreateIfMissing {
+		t.Error("Database would not be created:", lopts.Flag)
+	}
+	if _, ok := lopts.Comparer.(*eventStreamComparer); !ok {
+		t.Error("Wrong comparer:", lopts.Comparer)
+	}
+	if lopts.Filter == nil {
+		t.Error("Bloom filter was not enabled by default.")
+	}
+	if lopts.BlockCache != nil || lopts.WriteBuffer != 0 {
+		t.Error("Defaults were overridden:", lopts)
+	}
+
+	lopts = (&Options{}).leveldbOptions()
+	if lopts.Filter != nil {
+		t.Error("Bloom filter was not disabled.")
+	}
+}
+
+func TestOptions(t *testing.T) {
+	t.Parallel()
+
+	options := &Options{
+		BlockCacheSize: 1 << 20,
+		BloomFilterBits: 10,
+		WriteBufferSize: 1 << 22,
+		MaxOpenFiles: 100,
+		DisableCompression: true,
+	}
+	lopts := options.leveldbOptions()
+	if lopts.BlockCache == nil {
+		t.Error("Block cache was not set.")
+	}
+	if lopts.Filter == nil {
+		t.Error("Bloom filter was not set.")
+	}
+	if lopts.WriteBuffer != 1 << 22 {
+		t.Error("Wrong write buffer size:", lopts.WriteBuffer)
+	}
+	if lopts.MaxOpenFiles != 100 {
+		t.Error("Wrong max open files:", lopts.MaxOpenFiles)
+	}
+	if lopts.CompressionType != opt.NoCompression {
+		t.Error("Compression was not disabled.")
+	}
+
+	es, err := New(&storage.MemStorage{}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer es.Close()
+	addEvents(t, es, "mystream", "data")
+	checkStreamData(t, es, "mystream", "data")
+}
@@ -0,0 +1,220 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+)
+
+var parkedPrefix []byte = []byte("parked")
+var retriesPrefix []byte = []byte("retries")
+
+// Returned when referring to a parked event that does not exist.
+var ErrNoSuchParkedEvent = errors.New("no such parked event")
+
+// An event that a subscriber repeatedly failed to handle, and that was
+// put aside so that the subscriber could move on.
+type ParkedEvent struct {
+	// Identifies the parked event among the ones parked by the same
+	// subscriber. Assigned when parking.
+	ParkId []byte `json:"-"`
+
+	Stream StreamName `json:"stream"`
+	Id EventId `json:"id"`
+	Data []byte `json:"data"`
+
+	// Number of failed attempts before the event was parked.
+	Attempts int `json:"attempts"`
+	// Description of the last failure.
+	Error string `json:"error"`
+	Time time.Time `json:"time"`
+}
+
+func parkedKey(subscriber string, parkId []byte) eventStoreKey {
+	return eventStoreKey{
+		parkedPrefix,
+		[]byte(subscriber),
+		loadByteCounter(parkId),
+	}
+}
+
+// The key for the retry count of an event. The stream name is length
+// prefixed, since both it and the event id are arbitrary bytes.
+func retriesKey(subscriber string, event StoredEvent) eventStoreKey {
+	keyId := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(keyId, uint64(len(event.Stream)))
+	keyId = append(keyId[:n], event.Stream...)
+	keyId = append(keyId, event.Id...)
+	return eventStoreKey{
+		retriesPrefix,
+		[]byte(subscriber),
+		loadByteCounter(keyId),
+	}
+}
+
+// Count another failed attempt of a subscriber to handle an event.
+// Returns the number of failed attempts so far. Since the count is
+// persisted, it survives restarts.
+func (v *EventStore) IncrementRetries(subscriber string, event StoredEvent) (int, error) {
+	key := retriesKey(subscriber, event)
+	value, err := v.get(key)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	if value != nil {
+		if count, err = strconv.Atoi(string(value)); err != nil {
+			return 0, err
+		}
+	}
+	count++
+
+	err = v.update(func(b *writeBatch) error {
+		b.batch.Put(key.toBytes(), []byte(strconv.Itoa(count)))
+		return nil
+	})
+	return count, err
+}
+
+// Mark an event as handled by a subscriber. Atomically forgets its retry
+// count and moves the subscriber's checkpoint past it.
+func (v *EventStore) Acknowledge(subscriber string, event StoredEvent) error {
+	return v.update(func(b *writeBatch) error {
+		key := retriesKey(subscriber, event)
+		b.batch.Delete(key.toBytes())
+		b.SetCheckpoint(subscriber, event.Stream, event.Id)
+		return nil
+	})
+}
+
+// Park an event that a subscriber failed to handle. Atomically records
+// the parked event, forgets its retry count and moves the subscriber's
+// checkpoint past it. Returns the parked event with ParkId set.
+func (v *EventStore) Park(subscriber string, p ParkedEvent) (ParkedEvent, error) {
+	value, err := json.Marshal(p)
+	if err != nil {
+		return p, err
+	}
+	event := StoredEvent{
+		Id: p.Id,
+		Event: Event{
+			Stream: p.Stream,
+			Data: p.Data,
+		},
+	}
+	err = v.update(func(b *writeBatch) error {
+		// A fixed size big endian timestamp keeps parked events in
+		// the order they were parked. It's followed by a sequence
+		// number telling apart the events parked at the same time.
+		parkId := make([]byte, 16)
+		binary.BigEndian.PutUint64(parkId, uint64(p.Time.UnixNano()))
+		var key eventStoreKey
+		for seq := uint64(0); ; seq++ {
+			binary.BigEndian.PutUint64(parkId[8:], seq)
+			key = parkedKey(subscriber, parkId)
+			exists, err := v.has(key)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				break
+			}
+		}
+		p.ParkId = parkId
+		b.batch.Put(key.toBytes(), value)
+		rKey := retriesKey(subscriber, event)
+		b.batch.Delete(rKey.toBytes())
+		b.SetCheckpoint(subscriber, p.Stream, p.Id)
+		return nil
+	})
+	return p, err
+}
+
+// List the events parked by a subscriber, oldest first.
+func (v *EventStore) ParkedEvents(subscriber string) ([]ParkedEvent, error) {
+	res := make([]ParkedEvent, 0)
+	bSubscriber := []byte(subscriber)
+	err := v.scanGroup(parkedPrefix, bSubscriber, func(key *eventStoreKey, value []byte) error {
+		if bytes.Compare(key.key, bSubscriber) != 0 {
+			return errStopScan
+		}
+		var p ParkedEvent
+		if err := json.Unmarshal(value, &p); err != nil {
+			return err
+		}
+		p.ParkId = append([]byte(nil), key.keyId...)
+		res = append(res, p)
+		return nil
+	})
+	return res, err
+}
+
+// Load a single parked event.
+func (v *EventStore) ParkedEvent(subscriber string, parkId []byte) (ParkedEvent, error) {
+	var p ParkedEvent
+	value, err := v.get(parkedKey(subscriber, parkId))
+	if err != nil {
+		return p, err
+	}
+	if value == nil {
+		return p, ErrNoSuchParkedEvent
+	}
+	err = json.Unmarshal(value, &p)
+	p.ParkId = parkId
+	return p, err
+}
+
+// Stage removing everything stored for a subscriber: its checkpoints,
+// retry counts and parked events.
+func (b *writeBatch) forgetSubscriber(subscriber string) error {
+	bSubscriber := []byte(subscriber)
+	groups := [][]byte{checkpointPrefix, retriesPrefix, parkedPrefix}
+	for _, group := range groups {
+		err := b.store.scanGroup(group, bSubscriber, func(key *eventStoreKey, value []byte) error {
+			if bytes.Compare(key.key, bSubscriber) != 0 {
+				return errStopScan
+			}
+			b.batch.Delete(key.toBytes())
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Forget a parked event.
+func (v *EventStore) Unpark(subscriber string, parkId []byte) error {
+	key := parkedKey(subscriber, parkId)
+	value, err := v.get(key)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		return ErrNoSuchParkedEvent
+	}
+	return v.update(func(b *writeBatch) error {
+		b.batch.Delete(key.toBytes())
+		return nil
+	})
+}
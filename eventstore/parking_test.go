@@ -0,0 +1,156 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+
+import (
+	"testing"
+	"bytes"
+	"time"
+)
+
+
+func TestRetries(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	event := StoredEvent{
+		Id: EventId([]byte{1}),
+		Event: Event{StreamName("mystream"), []byte("data")},
+	}
+	for expected := 1 ; expected <= 3 ; expected++ {
+		count, err := es.IncrementRetries("subscriber", event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != expected {
+			t.Error("Wrong retry count:", count, "Expected:", expected)
+		}
+	}
+
+	if err := es.Acknowledge("subscriber", event); err != nil {
+		t.Fatal(err)
+	}
+	count, err := es.IncrementRetries("subscriber", event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Error("Acknowledging did not clear retries:", count)
+	}
+	id, err := es.Checkpoint("subscriber", event.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(id, event.Id) != 0 {
+		t.Error("Acknowledging did not checkpoint:", id)
+	}
+}
+
+func TestParking(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	now := time.Now()
+	parkIds := make([][]byte, 0)
+	for i, subscriber := range []string{"a", "b", "a"} {
+		p, err := es.Park(subscriber, ParkedEvent{
+			Stream: StreamName("mystream"),
+			Id: EventId([]byte{byte(i)}),
+			Data: []byte("data"),
+			Attempts: 3,
+			Error: "failed",
+			Time: now.Add(time.Duration(i) * time.Second),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		parkIds = append(parkIds, p.ParkId)
+	}
+
+	parked, err := es.ParkedEvents("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parked) != 2 {
+		t.Fatal("Wrong number of parked events:", len(parked))
+	}
+	if parked[0].Id[0] != 0 || parked[1].Id[0] != 2 {
+		t.Error("Parked events were not in order:", parked)
+	}
+	if bytes.Compare(parked[1].ParkId, parkIds[2]) != 0 {
+		t.Error("Wrong park id:", parked[1].ParkId)
+	}
+
+	id, err := es.Checkpoint("a", StreamName("mystream"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(id, []byte{2}) != 0 {
+		t.Error("Parking did not checkpoint:", id)
+	}
+
+	p, err := es.ParkedEvent("a", parkIds[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p.Data) != "data" || p.Attempts != 3 {
+		t.Error("Parked event was not stored correctly:", p)
+	}
+
+	if err := es.Unpark("a", parkIds[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := es.Unpark("a", parkIds[0]); err != ErrNoSuchParkedEvent {
+		t.Error("Expected ErrNoSuchParkedEvent, got:", err)
+	}
+	if _, err := es.ParkedEvent("a", parkIds[0]); err != ErrNoSuchParkedEvent {
+		t.Error("Expected ErrNoSuchParkedEvent, got:", err)
+	}
+}
+
+func TestParkingAtSameTime(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	for _, when := range []time.Time{time.Now(), time.Time{}} {
+		subscriber := when.String()
+		for i := 0; i < 3; i++ {
+			_, err := es.Park(subscriber, ParkedEvent{
+				Stream: StreamName("mystream"),
+				Id: EventId([]byte{byte(i)}),
+				Data: []byte{byte(i)},
+				Time: when,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		parked, err := es.ParkedEvents(subscriber)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(parked) != 3 {
+			t.Fatal("Parked events were overwritten:", parked)
+		}
+		for i, p := range parked {
+			if p.Id[0] != byte(i) {
+				t.Error("Parked events were not in order:", parked)
+			}
+		}
+	}
+}
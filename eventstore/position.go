@@ -0,0 +1,97 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+import (
+	"errors"
+	"time"
+)
+
+// Returned by WaitForPosition if the position was not reached in time.
+var ErrPositionTimeout = errors.New("timed out waiting for position")
+
+// A commit position. Orders all events in the store, across streams and
+// tenants. Positions of events written later are greater.
+type Position []byte
+
+// Compare position a with position b. Returns -1 if a is smaller than
+// b, 0 if they are equal, 1 if b is smaller than a. A nil position is
+// smaller than any other.
+func (a Position) Compare(b Position) int {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0
+		case a == nil:
+			return -1
+		}
+		return 1
+	}
+	counter := byteCounter(a)
+	return counter.Compare(byteCounter(b))
+}
+
+// Like Add, but returns the event as it was stored, including its
+// commit position.
+func (v *EventStore) Append(event Event) (StoredEvent, error) {
+	var stored StoredEvent
+	err := v.updateStreams([]StreamName{event.Stream}, func(b *writeBatch) (err error) {
+		stored, err = b.Add(event)
+		return
+	})
+	return stored, err
+}
+
+// The commit position of the last event written. nil if nothing has been
+// written yet.
+func (v *EventStore) Position() Position {
+	v.positionLock.Lock()
+	defer v.positionLock.Unlock()
+	return v.applied
+}
+
+// Block until events up to, and including, the commit position have
+// been written, so that reads see them. Gives up with
+// ErrPositionTimeout after `timeout`.
+func (v *EventStore) WaitForPosition(position Position, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	for {
+		v.positionLock.Lock()
+		if v.applied.Compare(position) >= 0 {
+			v.positionLock.Unlock()
+			return nil
+		}
+		changed := v.appliedChanged
+		v.positionLock.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return ErrPositionTimeout
+		}
+	}
+}
+
+// Record that events up to, and including, a commit position have been
+// written. Wakes up everyone waiting for a position.
+func (v *EventStore) setApplied(position Position) {
+	v.positionLock.Lock()
+	defer v.positionLock.Unlock()
+	v.applied = position
+	close(v.appliedChanged)
+	v.appliedChanged = make(chan bool)
+}
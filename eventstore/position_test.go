@@ -0,0 +1,97 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPositionCompare(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		a, b Position
+		expected int
+	}{
+		{nil, nil, 0},
+		{nil, Position{0}, -1},
+		{Position{0}, nil, 1},
+		{Position{1}, Position{1}, 0},
+		{Position{1}, Position{2}, -1},
+		{Position{255}, Position{1, 0}, -1},
+	}
+	for _, test := range tests {
+		if res := test.a.Compare(test.b); res != test.expected {
+			t.Error("Wrong comparison of", test.a, "and", test.b, ":", res)
+		}
+	}
+}
+
+func TestAppendPosition(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	if es.Position() != nil {
+		t.Error("Empty store had a position:", es.Position())
+	}
+	acme, err := es.Tenant("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := es.Append(Event{StreamName("a"), []byte("1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := acme.Append(Event{StreamName("b"), []byte("2")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Position.Compare(second.Position) >= 0 {
+		t.Error("Positions were not increasing:", first.Position, second.Position)
+	}
+	if es.Position().Compare(second.Position) != 0 {
+		t.Error("Wrong position:", es.Position())
+	}
+}
+
+func TestWaitForPosition(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	stored, err := es.Append(Event{StreamName("a"), []byte("1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := es.WaitForPosition(stored.Position, time.Second); err != nil {
+		t.Error("Reached position was waited for:", err)
+	}
+
+	next := Position(byteCounter(stored.Position).NewIncrementedCounter())
+	if err := es.WaitForPosition(next, 10 * time.Millisecond); err != ErrPositionTimeout {
+		t.Error("Expected a timeout:", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- es.WaitForPosition(next, 10 * time.Second)
+	}()
+	addEvents(t, es, "b", "2")
+	if err := <-done; err != nil {
+		t.Error("Position was not reached:", err)
+	}
+}
@@ -0,0 +1,388 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+var usagePrefix []byte = []byte("usage")
+var streamUsagePrefix []byte = []byte("streamusage")
+
+// Returned when a write would make a tenant exceed its hard quota.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Returned when a write would make a stream exceed its hard quota.
+var ErrStreamQuotaExceeded = errors.New("stream quota exceeded")
+
+// Limits on what a tenant may store. Zero means unlimited. Writes that
+// would take usage beyond a hard limit fail. Exceeding a soft limit is
+// only logged and counted, see SoftQuotaWarnings. Limits only apply to
+// writes that grow usage, so a tenant may remain above a lowered quota.
+type Quota struct {
+	// Hard limits for the tenant as a whole.
+	MaxEvents int64 `json:"maxEvents"`
+	MaxBytes int64 `json:"maxBytes"`
+	// Soft limits for the tenant as a whole.
+	SoftMaxEvents int64 `json:"softMaxEvents"`
+	SoftMaxBytes int64 `json:"softMaxBytes"`
+
+	// Hard limits for every single stream of the tenant.
+	StreamMaxEvents int64 `json:"streamMaxEvents"`
+	StreamMaxBytes int64 `json:"streamMaxBytes"`
+	// Soft limits for every single stream of the tenant.
+	StreamSoftMaxEvents int64 `json:"streamSoftMaxEvents"`
+	StreamSoftMaxBytes int64 `json:"streamSoftMaxBytes"`
+}
+
+// What a tenant, or a stream, stores. Events in reserved streams are not
+// counted.
+type Usage struct {
+	Events int64 `json:"events"`
+	Bytes int64 `json:"bytes"`
+}
+
+func (u *Usage) add(delta Usage) {
+	u.Events += delta.Events
+	u.Bytes += delta.Bytes
+}
+
+// Whether usage is beyond any of two limits.
+func (u Usage) over(maxEvents, maxBytes int64) bool {
+	return (maxEvents > 0 && u.Events > maxEvents) ||
+	(maxBytes > 0 && u.Bytes > maxBytes)
+}
+
+// Whether a change grows usage beyond any of two limits.
+func (u Usage) grownOver(delta Usage, maxEvents, maxBytes int64) bool {
+	return (maxEvents > 0 && delta.Events > 0 && u.Events > maxEvents) ||
+	(maxBytes > 0 && delta.Bytes > 0 && u.Bytes > maxBytes)
+}
+
+// The usage of a single stream.
+type StreamUsage struct {
+	Stream StreamName
+	Usage
+}
+
+var usageKey = eventStoreKey{
+	usagePrefix,
+	[]byte("usage"),
+	nil,
+}
+
+var quotaKey = eventStoreKey{
+	usagePrefix,
+	[]byte("quota"),
+	nil,
+}
+
+func streamUsageKey(stream StreamName) eventStoreKey {
+	return eventStoreKey{
+		streamUsagePrefix,
+		stream,
+		nil,
+	}
+}
+
+// The quota and usage of a tenant, and the usage of its recently
+// written streams, as stored. Spares writes from reading and decoding
+// them every time. Guarded by writeLock, and only updated once a write
+// has been persisted.
+type usageCache struct {
+	// nil until loaded.
+	quota *Quota
+	usage *Usage
+
+	streams map[string]Usage
+	// The number of streams kept. Arbitrary ones are evicted beyond
+	// that, since a miss only costs a read.
+	capacity int
+}
+
+func newUsageCache(capacity int) *usageCache {
+	return &usageCache{
+		streams: make(map[string]Usage),
+		capacity: capacity,
+	}
+}
+
+func (c *usageCache) setStream(stream StreamName, u Usage) {
+	c.streams[string(stream)] = u
+	for name := range c.streams {
+		if len(c.streams) <= c.capacity {
+			break
+		}
+		delete(c.streams, name)
+	}
+}
+
+// Load the quota of the tenant.
+func (v *EventStore) Quota() (Quota, error) {
+	v.writeLock.Lock()
+	defer v.writeLock.Unlock()
+	return v.loadQuota()
+}
+
+// Must be called with the write lock held.
+func (v *EventStore) loadQuota() (Quota, error) {
+	var q Quota
+	if v.usageCache != nil && v.usageCache.quota != nil {
+		return *v.usageCache.quota, nil
+	}
+	value, err := v.get(quotaKey)
+	if err != nil {
+		return q, err
+	}
+	if value != nil {
+		if err := json.Unmarshal(value, &q); err != nil {
+			return q, err
+		}
+	}
+	if v.usageCache != nil {
+		v.usageCache.quota = &q
+	}
+	return q, nil
+}
+
+// Set the quota of the tenant.
+func (v *EventStore) SetQuota(q Quota) error {
+	value, err := json.Marshal(q)
+	if err != nil {
+		return err
+	}
+	return v.update(func(b *writeBatch) error {
+		b.batch.Put(quotaKey.toBytes(), value)
+		b.onCommit = append(b.onCommit, func() {
+			if v.usageCache != nil {
+				v.usageCache.quota = &q
+			}
+		})
+		return nil
+	})
+}
+
+// Load what the tenant currently stores.
+func (v *EventStore) Usage() (Usage, error) {
+	v.writeLock.Lock()
+	defer v.writeLock.Unlock()
+	return v.loadUsage()
+}
+
+// Load what a single stream currently stores.
+func (v *EventStore) StreamUsage(stream StreamName) (Usage, error) {
+	v.writeLock.Lock()
+	defer v.writeLock.Unlock()
+	return v.loadStreamUsage(stream)
+}
+
+// List what streams store, starting with the stream start. Reserved
+// streams are left out.
+func (v *EventStore) StreamUsages(start StreamName, maxItems int) ([]StreamUsage, error) {
+	var streams []StreamName
+	for stream := range v.ListStreams(start, maxItems) {
+		if !IsReservedStream(stream) {
+			streams = append(streams, stream)
+		}
+	}
+
+	res := make([]StreamUsage, 0, len(streams))
+	for _, stream := range streams {
+		u, err := v.StreamUsage(stream)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, StreamUsage{stream, u})
+	}
+	return res, nil
+}
+
+// The number of times a write took a tenant, or one of its streams,
+// beyond a soft limit. Counted for all tenants since the event store was
+// opened.
+func (v *EventStore) SoftQuotaWarnings() int64 {
+	return atomic.LoadInt64(&v.softQuotaWarnings)
+}
+
+// Must be called with the write lock held. Usage is counted from
+// scratch if it has never been stored, which is the case for data
+// written by earlier versions.
+func (v *EventStore) loadUsage() (Usage, error) {
+	if v.usageCache != nil && v.usageCache.usage != nil {
+		return *v.usageCache.usage, nil
+	}
+	u, err := v.readUsage()
+	if err == nil && v.usageCache != nil {
+		v.usageCache.usage = &u
+	}
+	return u, err
+}
+
+// Like loadUsage, but for a single stream.
+func (v *EventStore) loadStreamUsage(stream StreamName) (Usage, error) {
+	if v.usageCache != nil {
+		if u, cached := v.usageCache.streams[string(stream)]; cached {
+			return u, nil
+		}
+	}
+	u, err := v.readStreamUsage(stream)
+	if err == nil && v.usageCache != nil {
+		v.usageCache.setStream(stream, u)
+	}
+	return u, err
+}
+
+// Read the usage of the tenant from the database, bypassing the cache.
+func (v *EventStore) readUsage() (Usage, error) {
+	var u Usage
+	value, err := v.get(usageKey)
+	if err != nil {
+		return u, err
+	}
+	if value != nil {
+		return u, json.Unmarshal(value, &u)
+	}
+	err = v.scanGroup(eventPrefix, nil, func(key *eventStoreKey, value []byte) error {
+		if !IsReservedStream(key.key) {
+			u.Events++
+			u.Bytes += int64(len(value))
+		}
+		return nil
+	})
+	return u, err
+}
+
+// Like readUsage, but for a single stream.
+func (v *EventStore) readStreamUsage(stream StreamName) (Usage, error) {
+	var u Usage
+	value, err := v.get(streamUsageKey(stream))
+	if err != nil {
+		return u, err
+	}
+	if value != nil {
+		return u, json.Unmarshal(value, &u)
+	}
+	err = v.scanGroup(eventPrefix, stream, func(key *eventStoreKey, value []byte) error {
+		if !bytes.Equal(key.key, stream) {
+			return errStopScan
+		}
+		u.Events++
+		u.Bytes += int64(len(value))
+		return nil
+	})
+	return u, err
+}
+
+// Stage a change in what a stream stores.
+func (b *writeBatch) account(stream StreamName, events, bytes int64) {
+	if IsReservedStream(stream) {
+		return
+	}
+	delta := Usage{events, bytes}
+	b.usage.add(delta)
+	if b.streamUsage == nil {
+		b.streamUsage = make(map[string]*Usage)
+	}
+	if _, exists := b.streamUsage[string(stream)]; !exists {
+		b.streamUsage[string(stream)] = new(Usage)
+	}
+	b.streamUsage[string(stream)].add(delta)
+}
+
+// Stage the new usage of the tenant and the streams written to. Fails
+// if the batch grows usage beyond a hard limit. Must be called with the
+// write lock held.
+func (b *writeBatch) applyUsage() error {
+	if len(b.streamUsage) == 0 {
+		return nil
+	}
+	v := b.store
+	q, err := v.loadQuota()
+	if err != nil {
+		return err
+	}
+	var warnings []string
+	streams := make(map[string]Usage, len(b.streamUsage))
+
+	for name, delta := range b.streamUsage {
+		stream := StreamName(name)
+		u, err := v.loadStreamUsage(stream)
+		if err != nil {
+			return err
+		}
+		before := u
+		u.add(*delta)
+		if u.grownOver(*delta, q.StreamMaxEvents, q.StreamMaxBytes) {
+			return ErrStreamQuotaExceeded
+		}
+		if !before.over(q.StreamSoftMaxEvents, q.StreamSoftMaxBytes) &&
+		u.over(q.StreamSoftMaxEvents, q.StreamSoftMaxBytes) {
+			warnings = append(warnings, fmt.Sprintf("stream %q", stream))
+		}
+		streams[name] = u
+
+		key := streamUsageKey(stream)
+		if u.Events == 0 && u.Bytes == 0 {
+			b.batch.Delete(key.toBytes())
+			continue
+		}
+		value, err := json.Marshal(u)
+		if err != nil {
+			return err
+		}
+		b.batch.Put(key.toBytes(), value)
+	}
+
+	u, err := v.loadUsage()
+	if err != nil {
+		return err
+	}
+	before := u
+	u.add(b.usage)
+	if u.grownOver(b.usage, q.MaxEvents, q.MaxBytes) {
+		return ErrQuotaExceeded
+	}
+	if !before.over(q.SoftMaxEvents, q.SoftMaxBytes) &&
+	u.over(q.SoftMaxEvents, q.SoftMaxBytes) {
+		warnings = append(warnings, "the tenant as a whole")
+	}
+	value, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	b.batch.Put(usageKey.toBytes(), value)
+
+	b.onCommit = append(b.onCommit, func() {
+		if v.usageCache != nil {
+			v.usageCache.usage = &u
+			for name, su := range streams {
+				v.usageCache.setStream(StreamName(name), su)
+			}
+		}
+		for _, warning := range warnings {
+			log.Printf("Tenant %q exceeded its soft quota for %s.\n",
+			v.tenant, warning)
+			atomic.AddInt64(&v.softQuotaWarnings, 1)
+		}
+	})
+	return nil
+}
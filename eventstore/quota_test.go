@@ -0,0 +1,142 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+
+import (
+	"testing"
+)
+
+
+func TestStreamUsage(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	addEvents(t, es, "a", "1", "22")
+	addEvents(t, es, "b", "333")
+	if err := es.Audit(AuditEntry{Action: "TEST"}); err != nil {
+		t.Fatal(err)
+	}
+
+	usages, err := es.StreamUsages(nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usages) != 2 {
+		t.Fatal("Wrong number of streams:", usages)
+	}
+	if string(usages[0].Stream) != "a" || usages[0].Events != 2 || usages[0].Bytes != 3 {
+		t.Error("Wrong usage of a:", usages[0])
+	}
+	if string(usages[1].Stream) != "b" || usages[1].Events != 1 || usages[1].Bytes != 3 {
+		t.Error("Wrong usage of b:", usages[1])
+	}
+
+	if err := es.RenameStream(StreamName("a"), StreamName("c")); err != nil {
+		t.Fatal(err)
+	}
+	u, err := es.StreamUsage(StreamName("c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Events != 2 || u.Bytes != 3 {
+		t.Error("Usage did not follow the rename:", u)
+	}
+	u, err = es.StreamUsage(StreamName("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Events != 0 || u.Bytes != 0 {
+		t.Error("Usage was left behind:", u)
+	}
+	total, err := es.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total.Events != 3 || total.Bytes != 6 {
+		t.Error("Wrong total usage:", total)
+	}
+}
+
+func TestStreamQuota(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	quota := Quota{
+		StreamMaxEvents: 2,
+		StreamSoftMaxBytes: 3,
+		SoftMaxEvents: 3,
+	}
+	if err := es.SetQuota(quota); err != nil {
+		t.Fatal(err)
+	}
+
+	addEvents(t, es, "a", "12")
+	if es.SoftQuotaWarnings() != 0 {
+		t.Error("Unexpected soft quota warning.")
+	}
+	addEvents(t, es, "a", "34")
+	if es.SoftQuotaWarnings() != 1 {
+		t.Error("Expected a soft quota warning for the stream.")
+	}
+	if _, err := es.Add(Event{StreamName("a"), nil}); err != ErrStreamQuotaExceeded {
+		t.Error("Expected ErrStreamQuotaExceeded, was:", err)
+	}
+
+	// Other streams have their own limits.
+	addEvents(t, es, "b", "1", "2")
+	if es.SoftQuotaWarnings() != 2 {
+		t.Error("Expected a soft quota warning for the tenant:",
+		es.SoftQuotaWarnings())
+	}
+}
+
+func TestUsageCache(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	if err := es.SetQuota(Quota{StreamMaxEvents: 1}); err != nil {
+		t.Fatal(err)
+	}
+	addEvents(t, es, "a", "1")
+	if _, err := es.Add(Event{StreamName("a"), []byte("2")}); err != ErrStreamQuotaExceeded {
+		t.Fatal("Expected ErrStreamQuotaExceeded, got:", err)
+	}
+	snapshot, err := es.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Release()
+	addEvents(t, es, "b", "22")
+
+	expected := Usage{2, 3}
+	if u, err := es.Usage(); err != nil || u != expected {
+		t.Error("Wrong cached usage:", u, err)
+	}
+	es.writeLock.Lock()
+	u, err := es.readUsage()
+	es.writeLock.Unlock()
+	if err != nil || u != expected {
+		t.Error("Wrong stored usage:", u, err)
+	}
+	if u, err := es.StreamUsage(StreamName("a")); err != nil || u != (Usage{1, 1}) {
+		t.Error("Refused write was counted:", u, err)
+	}
+	if u, err := snapshot.Usage(); err != nil || u != (Usage{1, 1}) {
+		t.Error("Snapshot saw later usage:", u, err)
+	}
+}
@@ -0,0 +1,50 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+import (
+	"errors"
+)
+
+// Returned by everything that writes while the event store is
+// read-only.
+var ErrReadOnly = errors.New("event store is read-only")
+
+// Returned when trying to leave read-only mode of an event store whose
+// database was opened read-only. See Options.ReadOnly.
+var ErrOpenedReadOnly = errors.New("database was opened read-only")
+
+// Switch read-only mode on or off for all tenants. While read-only,
+// everything that would write to the database fails with ErrReadOnly,
+// while reading keeps working. Switching it on waits for writes in
+// progress to finish.
+func (v *EventStore) SetReadOnly(readOnly bool) error {
+	v.writeLock.Lock()
+	defer v.writeLock.Unlock()
+	if !readOnly && v.openedReadOnly {
+		return ErrOpenedReadOnly
+	}
+	v.readOnly = readOnly
+	return nil
+}
+
+// Whether the event store is read-only. Snapshots always are.
+func (v *EventStore) ReadOnly() bool {
+	v.writeLock.Lock()
+	defer v.writeLock.Unlock()
+	return v.readOnly || v.db.snapshot != nil
+}
@@ -0,0 +1,105 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+import (
+	"testing"
+	"time"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestSetReadOnly(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	addEvents(t, es, "mystream", "data")
+	acme, err := es.Tenant("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := es.SetReadOnly(true); err != nil {
+		t.Fatal(err)
+	}
+	if !es.ReadOnly() || !acme.ReadOnly() {
+		t.Error("Read-only mode does not apply to all tenants.")
+	}
+	event := Event{Stream: StreamName("mystream"), Data: []byte("more")}
+	if _, err := es.Add(event); err != ErrReadOnly {
+		t.Error("Add was not refused:", err)
+	}
+	if _, err := acme.Add(event); err != ErrReadOnly {
+		t.Error("Add to tenant was not refused:", err)
+	}
+	if _, err := es.Schedule(event, time.Now()); err != ErrReadOnly {
+		t.Error("Schedule was not refused:", err)
+	}
+	if _, err := es.AddWebhook(Webhook{}, nil); err != ErrReadOnly {
+		t.Error("AddWebhook was not refused:", err)
+	}
+	if err := es.RemoveWebhook("id", ""); err != ErrReadOnly {
+		t.Error("RemoveWebhook was not refused:", err)
+	}
+	if err := es.Compact(StreamRange{}); err != ErrReadOnly {
+		t.Error("Compact was not refused:", err)
+	}
+	checkStreamData(t, es, "mystream", "data")
+
+	if err := es.SetReadOnly(false); err != nil {
+		t.Fatal(err)
+	}
+	addEvents(t, es, "mystream", "more")
+	checkStreamData(t, es, "mystream", "data", "more")
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	t.Parallel()
+
+	options := &Options{ReadOnly: true}
+	if options.leveldbOptions().Flag&opt.OFCreateIfMissing != 0 {
+		t.Error("A read-only database would be created.")
+	}
+	if es, err := New(&storage.MemStorage{}, options); err == nil {
+		es.Close()
+		t.Error("Opened a database that does not exist.")
+	}
+
+	stor := &storage.MemStorage{}
+	es, err := New(stor, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addEvents(t, es, "mystream", "data")
+	es.Close()
+
+	es, err = New(stor, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer es.Close()
+	if !es.ReadOnly() {
+		t.Error("Store was not read-only.")
+	}
+	checkStreamData(t, es, "mystream", "data")
+	if err := es.SetReadOnly(false); err != ErrOpenedReadOnly {
+		t.Error("Left read-only mode:", err)
+	}
+	if _, err := es.Add(Event{StreamName("a"), []byte("b")}); err != ErrReadOnly {
+		t.Error("Add was not refused:", err)
+	}
+}
@@ -0,0 +1,153 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+)
+
+var redactionPrefix []byte = []byte("redaction")
+
+// Returned when referring to an event that does not exist.
+var ErrNoSuchEvent = errors.New("no such event")
+
+// Records that the data of an event has been replaced.
+type Redaction struct {
+	Time time.Time `json:"time"`
+}
+
+// The key under which the redaction marker of an event is stored.
+func redactionKey(stream StreamName, id EventId) eventStoreKey {
+	return eventStoreKey{
+		redactionPrefix,
+		stream,
+		loadByteCounter(id),
+	}
+}
+
+// Load the redaction marker of an event. Returns nil if the event has
+// not been redacted.
+func (v *EventStore) Redaction(stream StreamName, id EventId) (*Redaction, error) {
+	value, err := v.get(redactionKey(stream, id))
+	if err != nil || value == nil {
+		return nil, err
+	}
+	r := new(Redaction)
+	return r, json.Unmarshal(value, r)
+}
+
+// Replace the data of a stored event, for example to comply with a
+// request to erase personal data. The event keeps its id and position in
+// the stream, but is marked as redacted in query results. Copies of the
+// event parked by subscribers are scrubbed as well. A redaction notice,
+// that is the event with its new data and Redacted set, is published to
+// the registered channels.
+func (v *EventStore) Redact(stream StreamName, id EventId, replacement []byte) error {
+	if err := checkNotReserved(stream); err != nil {
+		return err
+	}
+	marker, err := json.Marshal(Redaction{time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	err = v.update(func(b *writeBatch) error {
+		evKey := eventStoreKey{
+			eventPrefix,
+			stream,
+			loadByteCounter(id),
+		}
+		current, err := v.get(evKey)
+		if err != nil {
+			return err
+		}
+		if current == nil {
+			return ErrNoSuchEvent
+		}
+		b.batch.Put(evKey.toBytes(), replacement)
+		b.account(stream, 0, int64(len(replacement)-len(current)))
+		rKey := redactionKey(stream, id)
+		b.batch.Put(rKey.toBytes(), marker)
+		if err := b.markRedacted(stream); err != nil {
+			return err
+		}
+
+		if err := v.scrubParked(b, stream, id, replacement); err != nil {
+			return err
+		}
+
+		b.added = append(b.added, StoredEvent{
+			Id: id,
+			Event: Event{
+				Stream: stream,
+				Data: replacement,
+			},
+			Redacted: true,
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Redacted event %x in stream %q.\n", id, stream)
+	return nil
+}
+
+// Stage replacing the data of every parked copy of an event.
+func (v *EventStore) scrubParked(b *writeBatch, stream StreamName, id EventId, replacement []byte) error {
+	return v.scanGroup(parkedPrefix, nil, func(key *eventStoreKey, value []byte) error {
+		var p ParkedEvent
+		if err := json.Unmarshal(value, &p); err != nil {
+			return err
+		}
+		if !bytes.Equal(p.Stream, stream) || !bytes.Equal(p.Id, id) {
+			return nil
+		}
+		p.Data = replacement
+		scrubbed, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		b.batch.Put(append([]byte{}, key.toBytes()...), scrubbed)
+		return nil
+	})
+}
+
+// Stage moving the redaction marker of an event. Used when events are
+// rewritten under a new stream name or id.
+func (v *EventStore) copyRedaction(b *writeBatch, from, to StoredEvent) error {
+	marker, err := v.get(redactionKey(from.Stream, from.Id))
+	if err != nil || marker == nil {
+		return err
+	}
+	toKey := redactionKey(to.Stream, to.Id)
+	b.batch.Put(toKey.toBytes(), marker)
+	return b.markRedacted(to.Stream)
+}
+
+// Stage flagging a stream as having redacted events.
+func (b *writeBatch) markRedacted(stream StreamName) error {
+	meta, err := b.store.StreamMetadata(stream)
+	if err != nil || meta.Redacted {
+		return err
+	}
+	meta.Redacted = true
+	return b.setStreamMetadata(stream, meta)
+}
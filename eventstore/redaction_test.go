@@ -0,0 +1,148 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+
+import (
+	"testing"
+	"bytes"
+)
+
+
+func TestRedact(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	stream := StreamName("mystream")
+	addEvents(t, es, "mystream", "a", "secret", "c")
+	events := checkStreamData(t, es, "mystream", "a", "secret", "c")
+	if _, err := es.Park("subscriber", ParkedEvent{Stream: stream, Id: events[1].Id, Data: []byte("secret")}); err != nil {
+		t.Fatal(err)
+	}
+
+	pubchan := make(chan StoredEvent, 1)
+	es.RegisterPublishedEventsChannel(pubchan)
+	err := es.Redact(stream, events[1].Id, []byte("{}"))
+	es.UnregisterPublishedEventsChannel(pubchan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notice := <-pubchan
+	if !notice.Redacted || string(notice.Data) != "{}" {
+		t.Error("Wrong redaction notice:", notice)
+	}
+
+	events = checkStreamData(t, es, "mystream", "a", "{}", "c")
+	for i, e := range events {
+		if e.Redacted != (i == 1) {
+			t.Error("Wrong redaction flag for event", i)
+		}
+	}
+	marker, err := es.Redaction(stream, events[1].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if marker == nil || marker.Time.IsZero() {
+		t.Error("Missing redaction marker:", marker)
+	}
+
+	parked, err := es.ParkedEvents("subscriber")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parked) != 1 || bytes.Compare(parked[0].Data, []byte("{}")) != 0 {
+		t.Error("Parked copy was not scrubbed:", parked)
+	}
+
+	err = es.Redact(stream, EventId([]byte{42}), []byte("{}"))
+	if err != ErrNoSuchEvent {
+		t.Error("Expected ErrNoSuchEvent, was:", err)
+	}
+}
+
+func TestRedactionFollowsRename(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	addEvents(t, es, "old", "secret")
+	events := checkStreamData(t, es, "old", "secret")
+	if err := es.Redact(StreamName("old"), events[0].Id, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := es.RenameStream(StreamName("old"), StreamName("new")); err != nil {
+		t.Fatal(err)
+	}
+	events = checkStreamData(t, es, "new", "")
+	if !events[0].Redacted {
+		t.Error("Redaction marker was not moved.")
+	}
+	marker, err := es.Redaction(StreamName("old"), events[0].Id)
+	if err != nil || marker != nil {
+		t.Error("Redaction marker was left behind:", marker, err)
+	}
+}
+
+func TestRedactedFlag(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	stream := StreamName("mystream")
+	addEvents(t, es, "mystream", "a", "secret")
+	addEvents(t, es, "clean", "b")
+	events := checkStreamData(t, es, "mystream", "a", "secret")
+	if err := es.Redact(stream, events[1].Id, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := es.CopyStream(stream, StreamName("copy")); err != nil {
+		t.Fatal(err)
+	}
+	if err := es.MergeStreams(StreamName("merged"), StreamName("clean"), stream); err != nil {
+		t.Fatal(err)
+	}
+	if err := es.RenameStream(stream, StreamName("renamed")); err != nil {
+		t.Fatal(err)
+	}
+
+	flags := map[string]bool{
+		"mystream": false,
+		"clean": false,
+		"copy": true,
+		"merged": true,
+		"renamed": true,
+	}
+	for name, expected := range flags {
+		meta, err := es.StreamMetadata(StreamName(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.Redacted != expected {
+			t.Error("Wrong redacted flag for", name)
+		}
+	}
+	queried := map[string][]string{
+		"copy": {"a", ""},
+		"merged": {"a", "", "b"},
+		"renamed": {"a", ""},
+	}
+	for name, data := range queried {
+		events := checkStreamData(t, es, name, data...)
+		if !events[1].Redacted {
+			t.Error("Redaction was not queried for", name)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+import (
+	"errors"
+	"sync"
+)
+
+var sagaStatePrefix []byte = []byte("sagastate")
+
+// A saga, also known as a process manager, coordinates a long-running
+// workflow by reacting to events and emitting new ones.
+//
+// Events are handled one at a time. The new saga instance state, the
+// emitted events and the saga's checkpoint are all written in a single
+// atomic batch. This means that every event has its effects inside the
+// event store exactly once, even if the saga is restarted.
+type Saga struct {
+	// Unique name of the saga. Used for storing its state and
+	// checkpoints.
+	Name string
+
+	// The streams that the saga listens to. A nil filter means all
+	// streams.
+	Filter StreamFilter
+
+	// Maps an event to the id of the saga instance it concerns. If
+	// nil, all events are handled by a single instance.
+	Correlate func(StoredEvent) []byte
+
+	// Handles an event given the current state of its saga instance.
+	// The state is nil for a brand new instance. Returns the new
+	// state, or nil to forget the instance, and the events that are
+	// to be appended to the store.
+	Handle func(state []byte, event StoredEvent) ([]byte, []Event, error)
+}
+
+// The key under which the state of a saga instance is stored.
+func sagaStateKey(name string, instance []byte) eventStoreKey {
+	if instance == nil {
+		// A nil keyId would not be serialized.
+		instance = []byte{}
+	}
+	return eventStoreKey{
+		sagaStatePrefix,
+		[]byte(name),
+		loadByteCounter(instance),
+	}
+}
+
+// Load the current state of a saga instance. Returns nil if the instance
+// does not exist.
+func (v *EventStore) SagaState(name string, instance []byte) ([]byte, error) {
+	return v.get(sagaStateKey(name, instance))
+}
+
+// Runs a saga against an event store.
+type SagaRunner struct {
+	store *EventStore
+	saga Saga
+
+	stopChan chan bool
+	waiter sync.WaitGroup
+	err error
+}
+
+// Create a new saga runner. The saga is not started. It's up to the
+// caller to execute Start() on the returned runner.
+func NewSagaRunner(estore *EventStore, saga Saga) (*SagaRunner, error) {
+	if saga.Name == "" {
+		return nil, errors.New("Missing saga name.")
+	}
+	if saga.Handle == nil {
+		return nil, errors.New("Missing saga handler.")
+	}
+	runner := &SagaRunner{
+		store: estore,
+		saga: saga,
+		// Buffered to not block when the runner already has
+		// stopped because of an error.
+		stopChan: make(chan bool, 1),
+	}
+	return runner, nil
+}
+
+// The name under which the runner stores its checkpoints.
+func (r *SagaRunner) checkpointName() string {
+	return "saga/" + r.saga.Name
+}
+
+// Start handling events in the background.
+func (r *SagaRunner) Start() {
+	r.waiter.Add(1)
+	go func() {
+		defer r.waiter.Done()
+		r.err = r.store.Follow(r.checkpointName(), r.saga.Filter,
+		r.handle, r.stopChan)
+	}()
+}
+
+// Stop the saga and block until it has stopped.
+func (r *SagaRunner) Stop() error {
+	select {
+	case r.stopChan <- true:
+	default:
+	}
+	return r.Wait()
+}
+
+// Block until the saga has stopped. A saga whose handler fails is
+// stopped rather than skipping the event, since skipping would break
+// the exactly-once guarantee. The handler error is returned in that
+// case.
+func (r *SagaRunner) Wait() error {
+	r.waiter.Wait()
+	return r.err
+}
+
+func (r *SagaRunner) handle(event StoredEvent) error {
+	var instance []byte
+	if r.saga.Correlate != nil {
+		instance = r.saga.Correlate(event)
+	}
+	stateKey := sagaStateKey(r.saga.Name, instance)
+
+	state, err := r.store.get(stateKey)
+	if err != nil {
+		return err
+	}
+	newState, emitted, err := r.saga.Handle(state, event)
+	if err != nil {
+		return err
+	}
+
+	streams := make([]StreamName, len(emitted))
+	for i, e := range emitted {
+		streams[i] = e.Stream
+	}
+	return r.store.updateStreams(streams, func(b *writeBatch) error {
+		for _, e := range emitted {
+			if _, err := b.Add(e); err != nil {
+				return err
+			}
+		}
+		if newState == nil {
+			b.batch.Delete(stateKey.toBytes())
+		} else {
+			b.batch.Put(stateKey.toBytes(), newState)
+		}
+		b.SetCheckpoint(r.checkpointName(), event.Stream, event.Id)
+		return nil
+	})
+}
@@ -0,0 +1,149 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+
+import (
+	"testing"
+	"bytes"
+	"errors"
+	"strconv"
+)
+
+
+// A saga that, for every order, emits a shipping event and counts the
+// number of orders per customer.
+func newTestSaga() Saga {
+	return Saga{
+		Name: "shipping",
+		Filter: func(s StreamName) bool {
+			return bytes.Compare(s, StreamName("orders")) == 0
+		},
+		Correlate: func(e StoredEvent) []byte {
+			return e.Data
+		},
+		Handle: func(state []byte, e StoredEvent) ([]byte, []Event, error) {
+			count := 0
+			if state != nil {
+				count, _ = strconv.Atoi(string(state))
+			}
+			count++
+			emitted := []Event{
+				Event{StreamName("shipping"), e.Data},
+			}
+			return []byte(strconv.Itoa(count)), emitted, nil
+		},
+	}
+}
+
+func TestSagaRunner(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	orders := StreamName("orders")
+	if _, err := es.Add(Event{orders, []byte("alice")}); err != nil {
+		t.Fatal(err)
+	}
+
+	runner, err := NewSagaRunner(es, newTestSaga())
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner.Start()
+
+	if _, err := es.Add(Event{orders, []byte("alice")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := es.Add(Event{orders, []byte("bob")}); err != nil {
+		t.Fatal(err)
+	}
+
+	shipped := waitForEvents(t, es, StreamName("shipping"), 3)
+	if err := runner.Stop(); err != nil {
+		t.Error(err)
+	}
+	if len(shipped) != 3 {
+		t.Fatal("Wrong number of emitted events:", len(shipped))
+	}
+
+	state, err := es.SagaState("shipping", []byte("alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(state) != "2" {
+		t.Error("Wrong saga state:", string(state))
+	}
+
+	// Restarting must not handle any event a second time.
+	runner, err = NewSagaRunner(es, newTestSaga())
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner.Start()
+	if _, err := es.Add(Event{orders, []byte("bob")}); err != nil {
+		t.Fatal(err)
+	}
+	shipped = waitForEvents(t, es, StreamName("shipping"), 4)
+	if err := runner.Stop(); err != nil {
+		t.Error(err)
+	}
+	if len(shipped) != 4 {
+		t.Error("Wrong number of emitted events:", len(shipped))
+	}
+}
+
+func TestFailingSagaStops(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	if _, err := es.Add(Event{StreamName("orders"), []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := errors.New("saga failed")
+	saga := newTestSaga()
+	saga.Handle = func(state []byte, e StoredEvent) ([]byte, []Event, error) {
+		return nil, nil, expected
+	}
+	runner, err := NewSagaRunner(es, saga)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner.Start()
+	if err := runner.Wait(); err != expected {
+		t.Error("Wrong error:", err)
+	}
+
+	id, err := es.Checkpoint(runner.checkpointName(), StreamName("orders"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != nil {
+		t.Error("The failing event must not be checkpointed.")
+	}
+}
+
+func TestSagaRequiresName(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	saga := newTestSaga()
+	saga.Name = ""
+	if _, err := NewSagaRunner(es, saga); err == nil {
+		t.Error("Expected an error for a nameless saga.")
+	}
+}
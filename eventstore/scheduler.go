@@ -0,0 +1,290 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+var schedulePrefix []byte = []byte("schedule")
+
+// Returned when referring to a scheduled event that does not exist, or
+// that already has been added.
+var ErrNoSuchSchedule = errors.New("no such scheduled event")
+
+// Returned when scheduling for a tenant other than the default one. Only
+// the schedule of the default tenant is run.
+var ErrScheduleTenant = errors.New("scheduling is only supported for the default tenant")
+
+// Returned when scheduling an event due before 1970, which the schedule
+// ids can't be ordered by.
+var ErrInvalidDue = errors.New("due time is before 1970")
+
+// How long the scheduler waits before retrying after failing to add a
+// due event.
+const scheduleRetryDelay = time.Second
+
+// An event that is to be added to the store at a later time.
+type ScheduledEvent struct {
+	// Identifies the scheduled event. Assigned when scheduling.
+	ScheduleId []byte `json:"-"`
+
+	Due time.Time `json:"due"`
+	Event Event `json:"event"`
+}
+
+func scheduleKey(scheduleId []byte) eventStoreKey {
+	return eventStoreKey{
+		schedulePrefix,
+		nil,
+		loadByteCounter(scheduleId),
+	}
+}
+
+// Persist an event that is to be added to the store once due has
+// passed. The event will be added by a running Scheduler. Returns the id
+// that can be used for cancelling it.
+func (v *EventStore) Schedule(event Event, due time.Time) ([]byte, error) {
+	if v.tenant != nil {
+		return nil, ErrScheduleTenant
+	}
+	if due.Before(time.Unix(0, 0)) {
+		return nil, ErrInvalidDue
+	}
+
+	// A fixed size big endian due time as prefix keeps the schedule
+	// ordered by due time. The random suffix makes ids unique.
+	scheduleId := make([]byte, 16)
+	binary.BigEndian.PutUint64(scheduleId, uint64(due.UnixNano()))
+	if _, err := rand.Read(scheduleId[8:]); err != nil {
+		return nil, err
+	}
+
+	err := v.update(func(b *writeBatch) error {
+		// Intercepted when scheduled rather than when due, so that
+		// rejections reach the caller.
+		if err := v.intercept(&event); err != nil {
+			return err
+		}
+		if err := checkNotReserved(event.Stream); err != nil {
+			return err
+		}
+		value, err := json.Marshal(ScheduledEvent{
+			Due: due,
+			Event: event,
+		})
+		if err != nil {
+			return err
+		}
+		key := scheduleKey(scheduleId)
+		b.batch.Put(key.toBytes(), value)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case v.scheduleNotify <- true:
+	default:
+	}
+	return scheduleId, nil
+}
+
+// Cancel a scheduled event that has not yet been added.
+func (v *EventStore) CancelSchedule(scheduleId []byte) error {
+	return v.update(func(b *writeBatch) error {
+		key := scheduleKey(scheduleId)
+		value, err := v.get(key)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			return ErrNoSuchSchedule
+		}
+		b.batch.Delete(key.toBytes())
+		return nil
+	})
+}
+
+// List the scheduled events that have not yet been added, ordered by due
+// time.
+func (v *EventStore) ScheduledEvents(maxItems int) ([]ScheduledEvent, error) {
+	res := make([]ScheduledEvent, 0)
+	err := v.scanGroup(schedulePrefix, nil, func(key *eventStoreKey, value []byte) error {
+		if len(res) >= maxItems {
+			return errStopScan
+		}
+		var scheduled ScheduledEvent
+		if err := json.Unmarshal(value, &scheduled); err != nil {
+			return err
+		}
+		scheduled.ScheduleId = append([]byte(nil), key.keyId...)
+		res = append(res, scheduled)
+		return nil
+	})
+	return res, err
+}
+
+// Atomically add a scheduled event and remove it from the schedule.
+func (v *EventStore) addScheduled(scheduled ScheduledEvent) error {
+	streams := []StreamName{scheduled.Event.Stream}
+	return v.updateStreams(streams, func(b *writeBatch) error {
+		key := scheduleKey(scheduled.ScheduleId)
+		value, err := v.get(key)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			// Cancelled in the meantime.
+			return nil
+		}
+		b.batch.Delete(key.toBytes())
+		// Intercepted and checked when it was scheduled.
+		_, err = b.add(scheduled.Event)
+		return err
+	})
+}
+
+// Whether a due event failed to be added for a reason that retrying
+// won't fix.
+func isPermanentScheduleError(err error) bool {
+	switch err {
+	case ErrStreamSealed, ErrQuotaExceeded, ErrStreamQuotaExceeded,
+	ErrReservedStream:
+		return true
+	}
+	return false
+}
+
+// Atomically remove a scheduled event that could not be added from the
+// schedule, and record why in the audit log.
+func (v *EventStore) dropScheduled(scheduled ScheduledEvent, reason error) error {
+	data, err := json.Marshal(AuditEntry{
+		Time: time.Now().UTC(),
+		Client: "scheduler",
+		Action: "DROP_SCHEDULED",
+		Arguments: []string{string(scheduled.Event.Stream), reason.Error()},
+	})
+	if err != nil {
+		return err
+	}
+	streams := []StreamName{AuditStream}
+	return v.updateStreams(streams, func(b *writeBatch) error {
+		key := scheduleKey(scheduled.ScheduleId)
+		value, err := v.get(key)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			return nil
+		}
+		b.batch.Delete(key.toBytes())
+		_, err = b.add(Event{AuditStream, data})
+		return err
+	})
+}
+
+// Add a due event. Events that can never be added, for example because
+// their stream has been sealed or is over its quota, are dropped so that
+// they don't hold up the events due after them.
+func (v *EventStore) runScheduled(scheduled ScheduledEvent) error {
+	err := v.addScheduled(scheduled)
+	if !isPermanentScheduleError(err) {
+		return err
+	}
+	log.Println("Dropping scheduled event for stream",
+	string(scheduled.Event.Stream)+":", err)
+	return v.dropScheduled(scheduled, err)
+}
+
+// Adds scheduled events to an event store when they are due. Since the
+// schedule is persisted, events that became due while no scheduler was
+// running are added as soon as one is started. Only a single scheduler
+// should be running per event store.
+type Scheduler struct {
+	store *EventStore
+
+	stopChan chan bool
+	waiter sync.WaitGroup
+}
+
+// Create a new scheduler. The scheduler is not started. It's up to the
+// caller to execute Start() on the returned scheduler.
+func NewScheduler(estore *EventStore) *Scheduler {
+	return &Scheduler{
+		store: estore,
+		stopChan: make(chan bool, 1),
+	}
+}
+
+// Start adding due events in the background.
+func (s *Scheduler) Start() {
+	s.waiter.Add(1)
+	go func() {
+		defer s.waiter.Done()
+		s.loop()
+	}()
+}
+
+// Stop the scheduler and block until it has stopped.
+func (s *Scheduler) Stop() {
+	select {
+	case s.stopChan <- true:
+	default:
+	}
+	s.waiter.Wait()
+}
+
+func (s *Scheduler) loop() {
+	for {
+		wait := time.Hour
+		next, err := s.store.ScheduledEvents(1)
+		if err != nil {
+			log.Println("Could not read schedule:", err)
+			wait = scheduleRetryDelay
+		} else if len(next) > 0 {
+			wait = next[0].Due.Sub(time.Now())
+		}
+
+		if wait <= 0 {
+			if err := s.store.runScheduled(next[0]); err != nil {
+				// Due events stay due until writes are allowed
+				// again.
+				if err != ErrReadOnly {
+					log.Println("Could not add scheduled event:", err)
+				}
+				wait = scheduleRetryDelay
+			} else {
+				continue
+			}
+		}
+
+		select {
+		case <-s.stopChan:
+			return
+		case <-s.store.scheduleNotify:
+		case <-time.After(wait):
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+
+func TestScheduleAndCancel(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	event := Event{StreamName("mystream"), []byte("data")}
+	later := time.Now().Add(time.Hour)
+	first, err := es.Schedule(event, later.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := es.Schedule(event, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scheduled, err := es.ScheduledEvents(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scheduled) != 2 {
+		t.Fatal("Wrong number of scheduled events:", len(scheduled))
+	}
+	if string(scheduled[0].ScheduleId) != string(second) {
+		t.Error("Scheduled events were not ordered by due time.")
+	}
+	if string(scheduled[0].Event.Data) != "data" {
+		t.Error("Wrong event data:", scheduled[0].Event.Data)
+	}
+
+	if err := es.CancelSchedule(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := es.CancelSchedule(first); err != ErrNoSuchSchedule {
+		t.Error("Expected ErrNoSuchSchedule, got:", err)
+	}
+	if scheduled, _ = es.ScheduledEvents(10); len(scheduled) != 1 {
+		t.Error("Event was not cancelled.")
+	}
+}
+
+func TestScheduleRefused(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	event := Event{StreamName("mystream"), []byte("data")}
+	before1970 := time.Date(1969, 12, 31, 0, 0, 0, 0, time.UTC)
+	if _, err := es.Schedule(event, before1970); err != ErrInvalidDue {
+		t.Error("Expected ErrInvalidDue, got:", err)
+	}
+
+	acme, err := es.Tenant("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	if _, err := acme.Schedule(event, later); err != ErrScheduleTenant {
+		t.Error("Expected ErrScheduleTenant, got:", err)
+	}
+
+	if scheduled, _ := es.ScheduledEvents(10); len(scheduled) != 0 {
+		t.Error("Refused events were scheduled:", scheduled)
+	}
+}
+
+func TestSchedulerAddsDueEvents(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	stream := StreamName("mystream")
+
+	// Became due while no scheduler was running.
+	past := time.Now().Add(-time.Minute)
+	if _, err := es.Schedule(Event{stream, []byte("past")}, past); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Hour)
+	if _, err := es.Schedule(Event{stream, []byte("future")}, future); err != nil {
+		t.Fatal(err)
+	}
+
+	scheduler := NewScheduler(es)
+	scheduler.Start()
+	defer scheduler.Stop()
+
+	soon := time.Now().Add(50 * time.Millisecond)
+	if _, err := es.Schedule(Event{stream, []byte("soon")}, soon); err != nil {
+		t.Fatal(err)
+	}
+
+	events := waitForEvents(t, es, stream, 2)
+	if len(events) != 2 {
+		t.Fatal("Wrong number of added events:", len(events))
+	}
+	if string(events[0].Data) != "past" || string(events[1].Data) != "soon" {
+		t.Error("Wrong events were added.")
+	}
+	if time.Now().Before(soon) {
+		t.Error("Event was added before it was due.")
+	}
+
+	scheduled, err := es.ScheduledEvents(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scheduled) != 1 {
+		t.Error("Added events are still scheduled.")
+	}
+}
+
+func TestSchedulerDropsEventsThatCantBeAdded(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	if err := es.SetQuota(Quota{StreamMaxBytes: 4}); err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Minute)
+	big := Event{StreamName("big"), []byte("too large")}
+	if _, err := es.Schedule(big, past); err != nil {
+		t.Fatal(err)
+	}
+	small := Event{StreamName("small"), []byte("ok")}
+	if _, err := es.Schedule(small, past.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	scheduler := NewScheduler(es)
+	scheduler.Start()
+	defer scheduler.Stop()
+
+	if events := waitForEvents(t, es, StreamName("small"), 1); len(events) != 1 {
+		t.Fatal("Event was held up by an event that can't be added.")
+	}
+	if scheduled, err := es.ScheduledEvents(10); err != nil || len(scheduled) != 0 {
+		t.Error("Event that can't be added was kept:", scheduled, err)
+	}
+	res, err := es.Query(QueryRequest{Stream: AuditStream})
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit := popAllEvents(res, t)
+	if len(audit) != 1 {
+		t.Fatal("Wrong number of audit entries:", len(audit))
+	}
+	var entry AuditEntry
+	if err := json.Unmarshal(audit[0].Data, &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Action != "DROP_SCHEDULED" || entry.Arguments[0] != "big" {
+		t.Error("Wrong audit entry:", entry)
+	}
+}
@@ -0,0 +1,117 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var streamMetadataPrefix []byte = []byte("streammeta")
+
+// Returned when adding events to a sealed stream.
+var ErrStreamSealed = errors.New("stream is sealed")
+
+// What is recorded about a stream apart from its events. Streams that
+// never had anything recorded have the zero value.
+type StreamMetadata struct {
+	// Whether events can no longer be added. See SealStream.
+	Sealed bool `json:"sealed"`
+	// When the stream was sealed.
+	SealTime time.Time `json:"sealTime,omitempty"`
+	// The fencing token of the latest lease, and when it expires.
+	// See AcquireLease.
+	LeaseToken FencingToken `json:"leaseToken,omitempty"`
+	LeaseExpires time.Time `json:"leaseExpires,omitempty"`
+	// Whether any event of the stream has been redacted. Queries only
+	// look up redaction markers if it is set.
+	Redacted bool `json:"redacted,omitempty"`
+}
+
+// The key under which the metadata of a stream is stored.
+func streamMetadataKey(stream StreamName) eventStoreKey {
+	return eventStoreKey{
+		streamMetadataPrefix,
+		stream,
+		nil,
+	}
+}
+
+// Load the metadata of a stream.
+func (v *EventStore) StreamMetadata(stream StreamName) (StreamMetadata, error) {
+	var meta StreamMetadata
+	value, err := v.get(streamMetadataKey(stream))
+	if err != nil || value == nil {
+		return meta, err
+	}
+	return meta, json.Unmarshal(value, &meta)
+}
+
+// Stage the metadata of a stream.
+func (b *writeBatch) setStreamMetadata(stream StreamName, meta StreamMetadata) error {
+	value, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	key := streamMetadataKey(stream)
+	b.batch.Put(key.toBytes(), value)
+	return nil
+}
+
+// Return ErrStreamSealed if the stream is sealed. Most streams have no
+// metadata, which the bloom filter answers without reading from disk.
+func (v *EventStore) checkNotSealed(stream StreamName) error {
+	meta, err := v.StreamMetadata(stream)
+	if err != nil {
+		return err
+	}
+	if meta.Sealed {
+		return ErrStreamSealed
+	}
+	return nil
+}
+
+// Seal a stream, for example an aggregate that has reached its final
+// state. Adding events to a sealed stream fails with ErrStreamSealed.
+// The stream can still be queried, redacted and renamed. Sealing a
+// stream that already is sealed does nothing. Returns ErrNoSuchStream if
+// the stream has no events.
+func (v *EventStore) SealStream(stream StreamName) error {
+	if err := checkNotReserved(stream); err != nil {
+		return err
+	}
+	return v.update(func(b *writeBatch) error {
+		exists, err := v.streamExists(stream)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrNoSuchStream
+		}
+		meta, err := v.StreamMetadata(stream)
+		if err != nil {
+			return err
+		}
+		if meta.Sealed {
+			return nil
+		}
+		meta.Sealed = true
+		meta.SealTime = time.Now().UTC()
+		return b.setStreamMetadata(stream, meta)
+	})
+}
@@ -0,0 +1,101 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSealStream(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	acme, err := es.Tenant("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addEvents(t, es, "order", "placed")
+	addEvents(t, acme, "order", "placed")
+
+	if err := es.SealStream(StreamName("missing")); err != ErrNoSuchStream {
+		t.Error("Sealed a stream without events:", err)
+	}
+	if err := es.SealStream(AuditStream); err != ErrReservedStream {
+		t.Error("Sealed a reserved stream:", err)
+	}
+	if err := es.SealStream(StreamName("order")); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := es.StreamMetadata(StreamName("order"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !meta.Sealed || time.Since(meta.SealTime) > time.Minute {
+		t.Error("Wrong metadata:", meta)
+	}
+	if err := es.SealStream(StreamName("order")); err != nil {
+		t.Error("Sealing twice failed:", err)
+	}
+
+	event := Event{StreamName("order"), []byte("shipped")}
+	if _, err := es.Add(event); err != ErrStreamSealed {
+		t.Error("Added to a sealed stream:", err)
+	}
+	if _, err := es.Schedule(event, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	scheduled, err := es.ScheduledEvents(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := es.runScheduled(scheduled[0]); err != nil {
+		t.Fatal(err)
+	}
+	if scheduled, err = es.ScheduledEvents(1); err != nil || len(scheduled) != 0 {
+		t.Error("Scheduled event for sealed stream was kept:", scheduled, err)
+	}
+	checkStreamData(t, es, "order", "placed")
+
+	// Other tenants have streams of their own.
+	addEvents(t, acme, "order", "shipped")
+	meta, err = acme.StreamMetadata(StreamName("order"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Sealed {
+		t.Error("Stream of other tenant was sealed.")
+	}
+}
+
+func TestRenameSealedStream(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	addEvents(t, es, "old", "a")
+	if err := es.SealStream(StreamName("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := es.RenameStream(StreamName("old"), StreamName("new")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := es.Add(Event{StreamName("new"), []byte("b")}); err != ErrStreamSealed {
+		t.Error("Renamed stream was not sealed:", err)
+	}
+	addEvents(t, es, "old", "c")
+	checkStreamData(t, es, "old", "c")
+}
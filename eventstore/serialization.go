@@ -28,6 +28,10 @@ import (
 // fields.
 var groupSep []byte = []byte(":")
 
+// Separates the group of a key from the tenant it belongs to. See
+// eventStoreKey.withTenant.
+var tenantSep []byte = []byte("@")
+
 // Represents a leveldb key.
 type eventStoreKey struct {
 	groupKey []byte
@@ -117,3 +121,26 @@ func (o1 *eventStoreKey) Compare(o2 *eventStoreKey) int {
 	}
 	return 0
 }
+
+// Return a copy of the key that belongs to a tenant. The tenant is
+// stored as part of the group, "group@tenant", which gives every tenant
+// its own set of groups. Keys of the default tenant, nil, are left as
+// they are.
+func (v *eventStoreKey) withTenant(tenant []byte) *eventStoreKey {
+	if tenant == nil {
+		return v
+	}
+	qualified := *v
+	qualified.groupKey = bytes.Join([][]byte{v.groupKey, tenant}, tenantSep)
+	return &qualified
+}
+
+// Split the group of a key into the actual group and the tenant the key
+// belongs to. The tenant is nil for keys of the default tenant.
+func (v *eventStoreKey) splitTenant() (group, tenant []byte) {
+	pieces := bytes.SplitN(v.groupKey, tenantSep, 2)
+	if len(pieces) < 2 {
+		return v.groupKey, nil
+	}
+	return pieces[0], pieces[1]
+}
@@ -59,3 +59,37 @@ func TestEventStoreKeySerialization(t *testing.T) {
 		t.Error("QuickTest failed:", err)
 	}
 }
+
+func TestEventStoreKeyTenant(t *testing.T) {
+	t.Parallel()
+
+	key := eventStoreKey{
+		[]byte("event"),
+		[]byte("mystream"),
+		loadByteCounter([]byte{1}),
+	}
+	if qualified := key.withTenant(nil); qualified != &key {
+		t.Error("Default tenant keys must be left as they are.")
+	}
+
+	qualified := key.withTenant([]byte("acme"))
+	if string(qualified.toBytes()) != "event@acme:mystream:AQ==" {
+		t.Error("Wrong serialization:", string(qualified.toBytes()))
+	}
+	group, tenant := qualified.splitTenant()
+	if string(group) != "event" || string(tenant) != "acme" {
+		t.Error("Wrong split:", string(group), string(tenant))
+	}
+	group, tenant = key.splitTenant()
+	if string(group) != "event" || tenant != nil {
+		t.Error("Wrong split:", string(group), tenant)
+	}
+
+	raw := qualifyKey(key.toBytes(), []byte("acme"))
+	if string(unqualifyKey(raw, []byte("acme"))) != string(key.toBytes()) {
+		t.Error("Unqualifying did not restore the key.")
+	}
+	if string(unqualifyKey(raw, []byte("other"))) != string(raw) {
+		t.Error("Keys of other tenants must be left as they are.")
+	}
+}
@@ -0,0 +1,50 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+// A consistent view of the event store of a tenant at the point in time
+// it was taken. Reads through the embedded event store, such as Query,
+// Get and Streams, don't see anything written afterwards. Everything
+// that would write fails with ErrReadOnly. Tenant returns the live
+// instances of tenants, not snapshots of them.
+//
+// A snapshot keeps LevelDB from discarding the data it refers to, so it
+// should be released as soon as it is no longer needed.
+type Snapshot struct {
+	*EventStore
+}
+
+// Take a snapshot of the event store.
+func (v *EventStore) Snapshot() (*Snapshot, error) {
+	snapshot, err := v.rawDB.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	estore := &EventStore{
+		sharedState: v.sharedState,
+		tenant: v.tenant,
+		idGenerator: v.idGenerator,
+		db: &tenantDB{v.rawDB, v.tenant, snapshot},
+	}
+	return &Snapshot{estore}, nil
+}
+
+// Release the snapshot. It must not be used afterwards, and queries
+// through it must have finished.
+func (s *Snapshot) Release() {
+	s.db.snapshot.Release()
+}
@@ -0,0 +1,57 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+import (
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	acme, err := es.Tenant("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addEvents(t, es, "a", "1")
+	addEvents(t, acme, "a", "acme")
+
+	snapshot, err := acme.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Release()
+	addEvents(t, es, "a", "2")
+	addEvents(t, acme, "a", "more")
+	addEvents(t, acme, "b", "new")
+
+	checkStreamData(t, snapshot.EventStore, "a", "acme")
+	checkStreamData(t, snapshot.EventStore, "b")
+	checkStreamData(t, acme, "a", "acme", "more")
+	if snapshot.TenantName() != "acme" {
+		t.Error("Wrong tenant:", snapshot.TenantName())
+	}
+	if !snapshot.ReadOnly() || es.ReadOnly() {
+		t.Error("Wrong read-only modes.")
+	}
+	if _, err := snapshot.Add(Event{StreamName("a"), []byte("x")}); err != ErrReadOnly {
+		t.Error("Add to snapshot was not refused:", err)
+	}
+	addEvents(t, acme, "a", "after")
+	checkStreamData(t, acme, "a", "acme", "more", "after")
+}
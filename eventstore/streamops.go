@@ -0,0 +1,328 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"time"
+)
+
+// Returned when a stream that is to be created by an admin operation
+// already exists.
+var ErrStreamExists = errors.New("stream already exists")
+
+// Returned when an admin operation refers to a stream that does not
+// exist.
+var ErrNoSuchStream = errors.New("no such stream")
+
+// An event along with its commit position.
+type positionedEvent struct {
+	StoredEvent
+	position byteCounter
+}
+
+// Orders events by commit position. Events written before commit
+// positions were introduced have no position and sort first.
+type byPosition []positionedEvent
+
+func (p byPosition) Len() int {
+	return len(p)
+}
+
+func (p byPosition) Less(i, j int) bool {
+	return p[i].position.Compare(p[j].position) < 0
+}
+
+func (p byPosition) Swap(i, j int) {
+	p[i], p[j] = p[j], p[i]
+}
+
+// Whether a stream has any events.
+func (v *EventStore) streamExists(stream StreamName) (bool, error) {
+	streamKey := eventStoreKey{
+		streamPrefix,
+		stream,
+		nil,
+	}
+	head, err := v.get(streamKey)
+	return head != nil, err
+}
+
+// Read all events of a stream in chronological order. Returns
+// ErrNoSuchStream if the stream has no events.
+func (v *EventStore) readStream(stream StreamName) ([]positionedEvent, error) {
+	var events []positionedEvent
+	err := v.scanGroup(eventPrefix, stream, func(key *eventStoreKey, value []byte) error {
+		if !bytes.Equal(key.key, stream) {
+			return errStopScan
+		}
+		id := EventId(append([]byte{}, key.keyId...))
+		position, err := v.get(positionKey(stream, id))
+		if err != nil {
+			return err
+		}
+		event := StoredEvent{
+			Id: id,
+			Event: Event{
+				stream,
+				append([]byte{}, value...),
+			},
+		}
+		events = append(events, positionedEvent{
+			event,
+			loadByteCounter(position),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return nil, ErrNoSuchStream
+	}
+	return events, nil
+}
+
+// Make sure that a stream about to be created does not exist.
+func (v *EventStore) checkNewStream(stream StreamName) error {
+	exists, err := v.streamExists(stream)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrStreamExists
+	}
+	return nil
+}
+
+// Make sure that a stream about to be created by an admin operation
+// does not exist and may be written to, just like Add does. Only the
+// target is checked. The moved events are not intercepted, since they
+// were when they were first added.
+func (b *writeBatch) checkTarget(stream StreamName) error {
+	if err := b.store.checkNewStream(stream); err != nil {
+		return err
+	}
+	if err := b.checkLease(stream); err != nil {
+		return err
+	}
+	return b.store.checkNotSealed(stream)
+}
+
+// Copy all events of a stream to a new stream. The copies keep their
+// ids, but are given new commit positions, and are published like any
+// newly added event. The data is copied as it is. The new stream must
+// not be leased, just like for Add.
+func (v *EventStore) CopyStream(from, to StreamName) error {
+	if err := checkNotReserved(to); err != nil {
+		return err
+	}
+	return v.updateStreams([]StreamName{to}, func(b *writeBatch) error {
+		if err := b.checkTarget(to); err != nil {
+			return err
+		}
+		events, err := v.readStream(from)
+		if err != nil {
+			return err
+		}
+		for _, e := range events {
+			copied := StoredEvent{
+				Id: e.Id,
+				Event: Event{to, e.Data},
+			}
+			b.put(copied, v.commits.Next())
+			b.account(to, 1, int64(len(e.Data)))
+			b.added = append(b.added, copied)
+			if err := v.copyRedaction(b, e.StoredEvent, copied); err != nil {
+				return err
+			}
+		}
+
+		last := loadByteCounter(events[len(events)-1].Id)
+		b.onCommit = append(b.onCommit, func() {
+			b.ids.Set(to, last.NewIncrementedCounter())
+		})
+		return nil
+	})
+}
+
+// Atomically rename a stream. Events keep their ids and commit
+// positions and are not published again. The new name must not be
+// leased, just like for Add. Checkpoints of
+// consumers following the stream are moved along, so that they don't
+// handle the events a second time. So is the stream metadata, including
+// the lease, although the old name keeps its fencing token so that later
+// leases of either name never get a smaller one.
+func (v *EventStore) RenameStream(from, to StreamName) error {
+	if err := checkNotReserved(from, to); err != nil {
+		return err
+	}
+	return v.updateStreams([]StreamName{from, to}, func(b *writeBatch) error {
+		if err := b.checkTarget(to); err != nil {
+			return err
+		}
+		events, err := v.readStream(from)
+		if err != nil {
+			return err
+		}
+		var moved int64
+		for _, e := range events {
+			moved += int64(len(e.Data))
+
+			evKey := eventStoreKey{
+				eventPrefix,
+				from,
+				loadByteCounter(e.Id),
+			}
+			b.batch.Delete(evKey.toBytes())
+			posKey := positionKey(from, e.Id)
+			b.batch.Delete(posKey.toBytes())
+
+			renamed := StoredEvent{
+				Id: e.Id,
+				Event: Event{to, e.Data},
+			}
+			b.put(renamed, nil)
+			if e.position != nil {
+				posKey = positionKey(to, e.Id)
+				b.batch.Put(posKey.toBytes(), e.position)
+			}
+			if err := v.copyRedaction(b, e.StoredEvent, renamed); err != nil {
+				return err
+			}
+			rKey := redactionKey(from, e.Id)
+			b.batch.Delete(rKey.toBytes())
+		}
+		streamKey := eventStoreKey{
+			streamPrefix,
+			from,
+			nil,
+		}
+		b.batch.Delete(streamKey.toBytes())
+
+		if err := b.renameMetadata(from, to); err != nil {
+			return err
+		}
+
+		n := int64(len(events))
+		b.account(from, -n, -moved)
+		b.account(to, n, moved)
+
+		err = v.scanGroup(checkpointPrefix, nil, func(key *eventStoreKey, value []byte) error {
+			if !bytes.Equal(key.keyId, from) {
+				return nil
+			}
+			b.batch.Delete(key.toBytes())
+			b.SetCheckpoint(string(key.key), to, append([]byte{}, value...))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		last := loadByteCounter(events[len(events)-1].Id)
+		b.onCommit = append(b.onCommit, func() {
+			b.ids.Remove(from)
+			b.ids.Set(to, last.NewIncrementedCounter())
+		})
+		return nil
+	})
+}
+
+// Stage moving the metadata of a stream to a new name. The new name
+// may have a fencing token of its own from an earlier lease, in which
+// case the greater token is kept. A lease in effect is only carried
+// over if its token stays the greatest, or it would be mistaken for the
+// earlier lease of the new name. The old name keeps its token.
+func (b *writeBatch) renameMetadata(from, to StreamName) error {
+	v := b.store
+	meta, err := v.StreamMetadata(from)
+	if err != nil {
+		return err
+	}
+	toMeta, err := v.StreamMetadata(to)
+	if err != nil {
+		return err
+	}
+	if meta == (StreamMetadata{}) && toMeta == (StreamMetadata{}) {
+		return nil
+	}
+
+	token := meta.LeaseToken
+	if toMeta.LeaseToken >= meta.LeaseToken {
+		meta.LeaseToken = toMeta.LeaseToken
+		meta.LeaseExpires = time.Time{}
+	}
+	if err := b.setStreamMetadata(to, meta); err != nil {
+		return err
+	}
+	key := streamMetadataKey(from)
+	if token == 0 {
+		b.batch.Delete(key.toBytes())
+		return nil
+	}
+	return b.setStreamMetadata(from, StreamMetadata{LeaseToken: token})
+}
+
+// Merge several streams into a new stream. The events are appended in
+// the order they were originally committed, and are given new ids.
+// Events stored before commit positions were recorded come first, in
+// the order the streams were given. The merged streams are left
+// untouched.
+func (v *EventStore) MergeStreams(to StreamName, from ...StreamName) error {
+	if len(from) == 0 {
+		return errors.New("no streams to merge")
+	}
+	if err := checkNotReserved(to); err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for _, stream := range from {
+		if seen[string(stream)] {
+			return errors.New("stream given more than once: " + string(stream))
+		}
+		seen[string(stream)] = true
+	}
+
+	return v.updateStreams([]StreamName{to}, func(b *writeBatch) error {
+		if err := v.checkNewStream(to); err != nil {
+			return err
+		}
+		var events []positionedEvent
+		for _, stream := range from {
+			streamEvents, err := v.readStream(stream)
+			if err != nil {
+				return err
+			}
+			events = append(events, streamEvents...)
+		}
+		sort.Stable(byPosition(events))
+
+		for _, e := range events {
+			merged, err := b.Add(Event{to, e.Data})
+			if err != nil {
+				return err
+			}
+			if err := v.copyRedaction(b, e.StoredEvent, merged); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
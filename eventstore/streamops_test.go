@@ -0,0 +1,171 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+
+import (
+	"testing"
+	"bytes"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+
+// Add one event per data string to a stream.
+func addEvents(t *testing.T, es *EventStore, stream string, data ...string) {
+	for _, d := range data {
+		if _, err := es.Add(Event{StreamName(stream), []byte(d)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Check that a stream holds exactly the given data, in order.
+func checkStreamData(t *testing.T, es *EventStore, stream string, data ...string) []StoredEvent {
+	res, err := es.Query(QueryRequest{Stream: StreamName(stream)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := popAllEvents(res, t)
+	if len(events) != len(data) {
+		t.Fatal("Wrong number of events in", stream, ":", len(events))
+	}
+	for i, e := range events {
+		if string(e.Data) != data[i] {
+			t.Error("Wrong data in", stream, ":", string(e.Data))
+		}
+	}
+	return events
+}
+
+func TestCopyStream(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	addEvents(t, es, "source", "a", "b")
+
+	if err := es.CopyStream(StreamName("source"), StreamName("target")); err != nil {
+		t.Fatal(err)
+	}
+	sourceEvents := checkStreamData(t, es, "source", "a", "b")
+	targetEvents := checkStreamData(t, es, "target", "a", "b")
+	for i := range targetEvents {
+		if bytes.Compare(sourceEvents[i].Id, targetEvents[i].Id) != 0 {
+			t.Error("Copied event got a new id:", targetEvents[i].Id)
+		}
+	}
+
+	// Adding after copying must not reuse ids.
+	addEvents(t, es, "target", "c")
+	checkStreamData(t, es, "target", "a", "b", "c")
+
+	err := es.CopyStream(StreamName("source"), StreamName("target"))
+	if err != ErrStreamExists {
+		t.Error("Expected ErrStreamExists, was:", err)
+	}
+	err = es.CopyStream(StreamName("missing"), StreamName("other"))
+	if err != ErrNoSuchStream {
+		t.Error("Expected ErrNoSuchStream, was:", err)
+	}
+}
+
+func TestRenameStream(t *testing.T) {
+	t.Parallel()
+
+	stor := &storage.MemStorage{}
+	es, err := New(stor, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addEvents(t, es, "old", "a", "b")
+	addEvents(t, es, "other", "x")
+	events := checkStreamData(t, es, "old", "a", "b")
+	if err := es.SetCheckpoint("consumer", StreamName("old"), events[0].Id); err != nil {
+		t.Fatal(err)
+	}
+
+	err = es.RenameStream(StreamName("old"), StreamName("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStreamData(t, es, "old")
+	checkStreamData(t, es, "new", "a", "b")
+
+	var streams []string
+	for stream := range es.ListStreams(nil, 10) {
+		streams = append(streams, string(stream))
+	}
+	if len(streams) != 2 || streams[0] != "new" || streams[1] != "other" {
+		t.Error("Wrong streams after rename:", streams)
+	}
+
+	id, err := es.Checkpoint("consumer", StreamName("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(id, events[0].Id) != 0 {
+		t.Error("Checkpoint was not moved:", id)
+	}
+
+	// The old name can be reused from scratch.
+	addEvents(t, es, "old", "c")
+	checkStreamData(t, es, "old", "c")
+
+	// Reopening must give the same result.
+	if err := es.Close(); err != nil {
+		t.Fatal(err)
+	}
+	es, err = New(stor, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addEvents(t, es, "new", "d")
+	checkStreamData(t, es, "new", "a", "b", "d")
+
+	err = es.RenameStream(StreamName("new"), StreamName("other"))
+	if err != ErrStreamExists {
+		t.Error("Expected ErrStreamExists, was:", err)
+	}
+}
+
+func TestMergeStreams(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	addEvents(t, es, "first", "1")
+	addEvents(t, es, "second", "2")
+	addEvents(t, es, "first", "3")
+	addEvents(t, es, "unrelated", "-")
+	addEvents(t, es, "second", "4", "5")
+
+	err := es.MergeStreams(StreamName("merged"), StreamName("second"),
+	StreamName("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStreamData(t, es, "merged", "1", "2", "3", "4", "5")
+	checkStreamData(t, es, "first", "1", "3")
+
+	err = es.MergeStreams(StreamName("other"), StreamName("first"),
+	StreamName("first"))
+	if err == nil {
+		t.Error("Expected merging a stream twice to fail.")
+	}
+	err = es.MergeStreams(StreamName("merged"), StreamName("first"))
+	if err != ErrStreamExists {
+		t.Error("Expected ErrStreamExists, was:", err)
+	}
+}
@@ -0,0 +1,198 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+import (
+	"bytes"
+	"math"
+	"sync"
+)
+
+var checkpointPrefix []byte = []byte("checkpoint")
+
+// Decides whether a stream is of interest to a consumer. A nil
+// StreamFilter matches every stream.
+type StreamFilter func(StreamName) bool
+
+func (f StreamFilter) matches(stream StreamName) bool {
+	return f == nil || f(stream)
+}
+
+// The key under which a named consumer stores how far it has come in a
+// stream.
+func checkpointKey(name string, stream StreamName) eventStoreKey {
+	return eventStoreKey{
+		checkpointPrefix,
+		[]byte(name),
+		loadByteCounter(stream),
+	}
+}
+
+// Load the id of the last event a named consumer has handled in a
+// stream. Returns nil if no checkpoint has been stored.
+func (v *EventStore) Checkpoint(name string, stream StreamName) (EventId, error) {
+	value, err := v.get(checkpointKey(name, stream))
+	if err != nil || value == nil {
+		return nil, err
+	}
+	return EventId(value), nil
+}
+
+// Store the id of the last event a named consumer has handled in a
+// stream.
+func (v *EventStore) SetCheckpoint(name string, stream StreamName, id EventId) error {
+	return v.update(func(b *writeBatch) error {
+		b.SetCheckpoint(name, stream, id)
+		return nil
+	})
+}
+
+// Stage a checkpoint update. See EventStore.SetCheckpoint.
+func (b *writeBatch) SetCheckpoint(name string, stream StreamName, id EventId) {
+	key := checkpointKey(name, stream)
+	b.batch.Put(key.toBytes(), id)
+}
+
+// A set of streams that have received events since they were last
+// looked at.
+type dirtyStreams struct {
+	lock sync.Mutex
+	streams map[string]bool
+
+	// Signalled whenever a stream has been marked. Buffered with a
+	// capacity of one (1) so that marking never blocks.
+	notify chan bool
+}
+
+func newDirtyStreams() *dirtyStreams {
+	return &dirtyStreams{
+		streams: make(map[string]bool),
+		notify: make(chan bool, 1),
+	}
+}
+
+func (d *dirtyStreams) mark(stream StreamName) {
+	d.lock.Lock()
+	d.streams[string(stream)] = true
+	d.lock.Unlock()
+
+	select {
+	case d.notify <- true:
+	default:
+	}
+}
+
+// Return all marked streams and unmark them.
+func (d *dirtyStreams) pop() []StreamName {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	res := make([]StreamName, 0, len(d.streams))
+	for stream := range d.streams {
+		res = append(res, StreamName(stream))
+	}
+	d.streams = make(map[string]bool)
+	return res
+}
+
+// Follow a set of streams. Every event in a stream matching filter,
+// both historical and newly published ones, is handed to handler in
+// per-stream chronological order. Following starts after the checkpoint
+// stored for name in every stream. It is up to handler to store new
+// checkpoints (see SetCheckpoint) whenever it sees fit.
+//
+// Blocks until something is sent on stop, or until handler returns an
+// error. In the latter case, that error is returned.
+func (v *EventStore) Follow(name string, filter StreamFilter, handler func(StoredEvent) error, stop chan bool) error {
+	dirty := newDirtyStreams()
+
+	// Registering before listing streams to not miss any event
+	// published in between.
+	pubchan := make(chan StoredEvent)
+	v.RegisterPublishedEventsChannel(pubchan)
+	feedDone := make(chan bool)
+	go func() {
+		defer close(feedDone)
+		for event := range pubchan {
+			if filter.matches(event.Stream) {
+				dirty.mark(event.Stream)
+			}
+		}
+	}()
+	defer func() {
+		v.UnregisterPublishedEventsChannel(pubchan)
+		close(pubchan)
+		<-feedDone
+	}()
+
+	for stream := range v.ListStreams(nil, math.MaxInt32) {
+		if filter.matches(stream) {
+			dirty.mark(stream)
+		}
+	}
+
+	positions := make(map[string]EventId)
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-dirty.notify:
+		}
+
+		for _, stream := range dirty.pop() {
+			err := v.catchUp(name, stream, positions, handler)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Hand all events in a stream that come after the last known position
+// to handler.
+func (v *EventStore) catchUp(name string, stream StreamName, positions map[string]EventId, handler func(StoredEvent) error) error {
+	last, known := positions[string(stream)]
+	if !known {
+		var err error
+		last, err = v.Checkpoint(name, stream)
+		if err != nil {
+			return err
+		}
+	}
+
+	events, err := v.Query(QueryRequest{
+		Stream: stream,
+		FromId: last,
+	})
+	if err != nil {
+		return err
+	}
+	for event := range events {
+		if last != nil && bytes.Compare(event.Id, last) == 0 {
+			// Already handled.
+			continue
+		}
+		if err := handler(event); err != nil {
+			// Not leaking the querying goroutine.
+			for _ = range events {
+			}
+			return err
+		}
+		last = event.Id
+		positions[string(stream)] = last
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+
+import (
+	"testing"
+	"bytes"
+	"errors"
+	"time"
+)
+
+
+// Poll a stream until it contains n events or a timeout occurs.
+func waitForEvents(t *testing.T, es *EventStore, stream StreamName, n int) []StoredEvent {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		res, err := es.Query(QueryRequest{Stream: stream})
+		if err != nil {
+			t.Fatal(err)
+		}
+		events := popAllEvents(res, t)
+		if len(events) >= n || time.Now().After(deadline) {
+			return events
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	stream := StreamName("mystream")
+
+	id, err := es.Checkpoint("consumer", stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != nil {
+		t.Error("Did not expect a checkpoint:", id)
+	}
+
+	expected := EventId([]byte{1, 2})
+	if err := es.SetCheckpoint("consumer", stream, expected); err != nil {
+		t.Fatal(err)
+	}
+	id, err = es.Checkpoint("consumer", stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(id, expected) != 0 {
+		t.Error("Wrong checkpoint:")
+		t.Error("Expected:", expected)
+		t.Error("Was:     ", id)
+	}
+
+	id, err = es.Checkpoint("other", stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != nil {
+		t.Error("Checkpoints leaked between consumers:", id)
+	}
+}
+
+func TestFollow(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	stream := StreamName("mystream")
+	if _, err := es.Add(Event{stream, []byte("historical")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := es.Add(Event{StreamName("ignored"), []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+
+	handled := make(chan StoredEvent, 10)
+	handler := func(e StoredEvent) error {
+		handled <- e
+		return nil
+	}
+	filter := func(s StreamName) bool {
+		return bytes.Compare(s, stream) == 0
+	}
+	stop := make(chan bool, 1)
+	done := make(chan error)
+	go func() {
+		done <- es.Follow("consumer", filter, handler, stop)
+	}()
+
+	expectData := func(expected string) {
+		select {
+		case e := <-handled:
+			if string(e.Data) != expected {
+				t.Error("Wrong event data:", string(e.Data))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for:", expected)
+		}
+	}
+	expectData("historical")
+	if _, err := es.Add(Event{stream, []byte("new")}); err != nil {
+		t.Fatal(err)
+	}
+	expectData("new")
+
+	stop <- true
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	if len(handled) != 0 {
+		t.Error("Unexpected events were handled.")
+	}
+}
+
+func TestFollowHandlerError(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	if _, err := es.Add(Event{StreamName("mystream"), []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := errors.New("handler failed")
+	handler := func(e StoredEvent) error {
+		return expected
+	}
+	err := es.Follow("consumer", nil, handler, make(chan bool))
+	if err != expected {
+		t.Error("Wrong error returned:", err)
+	}
+}
+
+func TestFollowResumesFromCheckpoint(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	stream := StreamName("mystream")
+	first, err := es.Add(Event{stream, []byte("first")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := es.Add(Event{stream, []byte("second")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := es.SetCheckpoint("consumer", stream, first); err != nil {
+		t.Fatal(err)
+	}
+
+	handled := make(chan StoredEvent, 10)
+	handler := func(e StoredEvent) error {
+		handled <- e
+		return nil
+	}
+	stop := make(chan bool, 1)
+	done := make(chan error)
+	go func() {
+		done <- es.Follow("consumer", nil, handler, stop)
+	}()
+
+	select {
+	case e := <-handled:
+		if string(e.Data) != "second" {
+			t.Error("Did not resume after checkpoint:", string(e.Data))
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Timed out waiting for event.")
+	}
+	stop <- true
+	<-done
+}
@@ -0,0 +1,66 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+import (
+	"bytes"
+	"errors"
+)
+
+// Returned by Tenant for names that can't be used.
+var ErrInvalidTenant = errors.New("invalid tenant name")
+
+// Return the event store of a tenant. Tenants share the database and
+// commit positions, but are otherwise isolated from each other: streams,
+// checkpoints and everything else stored through the returned instance
+// are only visible to that tenant, and only the tenant's events are
+// pushed to its published events channels.
+//
+// The empty name refers to the default tenant, which is what New
+// returns. Other names must not contain ':' or '@'.
+func (v *EventStore) Tenant(name string) (*EventStore, error) {
+	if bytes.ContainsAny([]byte(name), ":@") {
+		return nil, ErrInvalidTenant
+	}
+
+	v.tenantsLock.Lock()
+	defer v.tenantsLock.Unlock()
+	if estore, exists := v.tenants[name]; exists {
+		return estore, nil
+	}
+
+	var tenant []byte
+	if name != "" {
+		tenant = []byte(name)
+	}
+	estore := &EventStore{
+		sharedState: v.sharedState,
+		tenant: tenant,
+		db: &tenantDB{v.rawDB, tenant, nil},
+	}
+	estore.idGenerator = newStreamIdGenerator(estore.loadNextId,
+	v.maxCachedStreams)
+	estore.usageCache = newUsageCache(v.maxCachedStreams)
+	v.tenants[name] = estore
+	return estore, nil
+}
+
+// The name of the tenant this event store is scoped to. Empty for the
+// default tenant.
+func (v *EventStore) TenantName() string {
+	return string(v.tenant)
+}
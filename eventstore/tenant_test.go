@@ -0,0 +1,179 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+
+import (
+	"testing"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+
+func TestTenantIsolation(t *testing.T) {
+	t.Parallel()
+
+	stor := &storage.MemStorage{}
+	es, err := New(stor, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acme, err := es.Tenant("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addEvents(t, es, "mystream", "default")
+	addEvents(t, acme, "mystream", "acme1", "acme2")
+	addEvents(t, acme, "acmeonly", "x")
+
+	checkStreamData(t, es, "mystream", "default")
+	checkStreamData(t, es, "acmeonly")
+	checkStreamData(t, acme, "mystream", "acme1", "acme2")
+
+	var streams []string
+	for stream := range acme.ListStreams(nil, 10) {
+		streams = append(streams, string(stream))
+	}
+	if len(streams) != 2 || streams[0] != "acmeonly" || streams[1] != "mystream" {
+		t.Error("Wrong tenant streams:", streams)
+	}
+	streams = nil
+	for stream := range es.ListStreams(nil, 10) {
+		streams = append(streams, string(stream))
+	}
+	if len(streams) != 1 || streams[0] != "mystream" {
+		t.Error("Wrong default streams:", streams)
+	}
+
+	// Ids must continue where they were after reopening.
+	if err := es.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if es, err = New(stor, nil); err != nil {
+		t.Fatal(err)
+	}
+	if acme, err = es.Tenant("acme"); err != nil {
+		t.Fatal(err)
+	}
+	addEvents(t, acme, "mystream", "acme3")
+	checkStreamData(t, acme, "mystream", "acme1", "acme2", "acme3")
+
+	same, err := acme.Tenant("acme")
+	if err != nil || same != acme {
+		t.Error("Expected the same tenant instance:", err)
+	}
+	if def, err := acme.Tenant(""); err != nil || def != es {
+		t.Error("Expected the default tenant instance:", err)
+	}
+	if _, err := es.Tenant("a:b"); err != ErrInvalidTenant {
+		t.Error("Expected ErrInvalidTenant, was:", err)
+	}
+}
+
+func TestTenantPublishing(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	acme, err := es.Tenant("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultChan := make(chan StoredEvent, 10)
+	es.RegisterPublishedEventsChannel(defaultChan)
+	acmeChan := make(chan StoredEvent, 10)
+	acme.RegisterPublishedEventsChannel(acmeChan)
+	allChan := make(chan StoredEvent, 10)
+	es.RegisterAllPublishedEventsChannel(allChan)
+
+	addEvents(t, es, "mystream", "default")
+	addEvents(t, acme, "mystream", "acme")
+
+	if len(defaultChan) != 1 || len(acmeChan) != 1 || len(allChan) != 2 {
+		t.Fatal("Wrong number of published events:", len(defaultChan),
+		len(acmeChan), len(allChan))
+	}
+	if e := <-acmeChan; e.Tenant != "acme" || string(e.Data) != "acme" {
+		t.Error("Wrong event published to tenant:", e)
+	}
+	if e := <-defaultChan; e.Tenant != "" || string(e.Data) != "default" {
+		t.Error("Wrong event published to default tenant:", e)
+	}
+}
+
+func TestTenantQuota(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	acme, err := es.Tenant("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addEvents(t, acme, "mystream", "12345")
+	if err := acme.Audit(AuditEntry{Action: "TEST"}); err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err := acme.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Events != 1 || usage.Bytes != 5 {
+		t.Error("Wrong usage:", usage)
+	}
+
+	if err := acme.SetQuota(Quota{MaxEvents: 2, MaxBytes: 8}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := acme.Add(Event{StreamName("mystream"), []byte("1234")}); err != ErrQuotaExceeded {
+		t.Error("Expected the byte quota to be exceeded, was:", err)
+	}
+	addEvents(t, acme, "mystream", "123")
+	if _, err := acme.Add(Event{StreamName("mystream"), nil}); err != ErrQuotaExceeded {
+		t.Error("Expected the event quota to be exceeded, was:", err)
+	}
+	// Quotas are per tenant.
+	addEvents(t, es, "mystream", "123456789")
+
+	// Shrinking is always allowed.
+	events := checkStreamData(t, acme, "mystream", "12345", "123")
+	if err := acme.Redact(StreamName("mystream"), events[0].Id, nil); err != nil {
+		t.Fatal(err)
+	}
+	usage, err = acme.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Events != 2 || usage.Bytes != 3 {
+		t.Error("Wrong usage:", usage)
+	}
+}
+
+func TestTenantTopicStreamRejected(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	acme, err := es.Tenant("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []*EventStore{es, acme} {
+		_, err := v.Add(Event{StreamName("@acme/x"), []byte("data")})
+		if err != ErrReservedStream {
+			t.Error("Wrote a stream looking like a tenant topic:", err)
+		}
+	}
+	addEvents(t, es, "x@acme", "data")
+}
@@ -0,0 +1,139 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+)
+
+var webhookPrefix []byte = []byte("webhook")
+
+// Returned when referring to a webhook that does not exist.
+var ErrNoSuchWebhook = errors.New("no such webhook")
+
+// A webhook subscription. Events are POSTed to URL as they are added to
+// the store.
+type Webhook struct {
+	// Unique identifier assigned when the webhook is added.
+	Id string `json:"id"`
+
+	URL string `json:"url"`
+
+	// Only streams starting with this prefix are delivered. An empty
+	// prefix matches all streams, just like ZeroMQ SUB filtering.
+	StreamPrefix []byte `json:"streamPrefix"`
+
+	// Used for signing every request. Never exposed through the
+	// server.
+	Secret []byte `json:"secret"`
+}
+
+// Returns a filter that matches the streams this webhook delivers.
+func (w *Webhook) Filter() StreamFilter {
+	prefix := w.StreamPrefix
+	return func(stream StreamName) bool {
+		return bytes.HasPrefix(stream, prefix)
+	}
+}
+
+func webhookKey(id string) eventStoreKey {
+	return eventStoreKey{
+		webhookPrefix,
+		nil,
+		loadByteCounter([]byte(id)),
+	}
+}
+
+// Persist a new webhook subscription. A unique id is assigned to it and
+// the stored webhook is returned. Unless checkpoint is nil, it is called
+// with the assigned id, and the checkpoints stored under the name it
+// returns are atomically moved to the head of every stream the webhook
+// delivers. Following them then starts with the events added after the
+// webhook.
+func (v *EventStore) AddWebhook(w Webhook, checkpoint func(id string) string) (Webhook, error) {
+	bId := make([]byte, 8)
+	if _, err := rand.Read(bId); err != nil {
+		return w, err
+	}
+	w.Id = hex.EncodeToString(bId)
+
+	value, err := json.Marshal(w)
+	if err != nil {
+		return w, err
+	}
+	err = v.update(func(b *writeBatch) error {
+		key := webhookKey(w.Id)
+		b.batch.Put(key.toBytes(), value)
+		if checkpoint == nil {
+			return nil
+		}
+		return b.checkpointHeads(checkpoint(w.Id), w.Filter())
+	})
+	return w, err
+}
+
+// Stage checkpoints for name at the head of every stream matching
+// filter.
+func (b *writeBatch) checkpointHeads(name string, filter StreamFilter) error {
+	return b.store.scanGroup(streamPrefix, nil, func(key *eventStoreKey, value []byte) error {
+		stream := StreamName(key.key)
+		if filter.matches(stream) {
+			b.SetCheckpoint(name, stream, EventId(value))
+		}
+		return nil
+	})
+}
+
+// Remove a webhook subscription. Unless subscriber is empty, the
+// checkpoints, retry counts and parked events stored under that name are
+// atomically removed too, so that a webhook added later under the same
+// name starts afresh.
+func (v *EventStore) RemoveWebhook(id, subscriber string) error {
+	return v.update(func(b *writeBatch) error {
+		key := webhookKey(id)
+		value, err := v.get(key)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			return ErrNoSuchWebhook
+		}
+		b.batch.Delete(key.toBytes())
+		if subscriber == "" {
+			return nil
+		}
+		return b.forgetSubscriber(subscriber)
+	})
+}
+
+// List all webhook subscriptions.
+func (v *EventStore) Webhooks() ([]Webhook, error) {
+	res := make([]Webhook, 0)
+	err := v.scanGroup(webhookPrefix, nil, func(key *eventStoreKey, value []byte) error {
+		var w Webhook
+		if err := json.Unmarshal(value, &w); err != nil {
+			return err
+		}
+		res = append(res, w)
+		return nil
+	})
+	return res, err
+}
@@ -0,0 +1,149 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package eventstore
+
+
+import (
+	"testing"
+	"bytes"
+)
+
+
+func TestWebhookStorage(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	w, err := es.AddWebhook(Webhook{
+		URL: "http://localhost/hook",
+		StreamPrefix: []byte("orders"),
+		Secret: []byte("secret"),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Id == "" {
+		t.Error("No id was assigned.")
+	}
+
+	webhooks, err := es.Webhooks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(webhooks) != 1 {
+		t.Fatal("Wrong number of webhooks:", len(webhooks))
+	}
+	if webhooks[0].Id != w.Id || bytes.Compare(webhooks[0].Secret, w.Secret) != 0 {
+		t.Error("Webhook was not stored correctly:", webhooks[0])
+	}
+
+	filter := webhooks[0].Filter()
+	if !filter(StreamName("orders-1")) || filter(StreamName("other")) {
+		t.Error("Webhook filtered the wrong streams.")
+	}
+
+	if err := es.RemoveWebhook(w.Id, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := es.RemoveWebhook(w.Id, ""); err != ErrNoSuchWebhook {
+		t.Error("Expected ErrNoSuchWebhook, got:", err)
+	}
+}
+
+func TestWebhookStartsAtHead(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	addEvents(t, es, "orders-1", "a", "b")
+	addEvents(t, es, "other", "c")
+	checkpoint := func(id string) string {
+		return "webhook-" + id
+	}
+	w, err := es.AddWebhook(Webhook{StreamPrefix: []byte("orders")}, checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	head := checkStreamData(t, es, "orders-1", "a", "b")[1]
+	id, err := es.Checkpoint(checkpoint(w.Id), StreamName("orders-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(id, head.Id) {
+		t.Error("Checkpoint was not at the head:", id)
+	}
+	id, err = es.Checkpoint(checkpoint(w.Id), StreamName("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != nil {
+		t.Error("Checkpoint was stored for a stream that is not delivered.")
+	}
+}
+
+func TestRemoveWebhookForgetsSubscriber(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	addEvents(t, es, "orders-1", "a", "b")
+	events := checkStreamData(t, es, "orders-1", "a", "b")
+	w, err := es.AddWebhook(Webhook{StreamPrefix: []byte("orders")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The second name shares a prefix with the first, and must be kept.
+	names := []string{"webhook-" + w.Id, "webhook-" + w.Id + "x"}
+	for _, name := range names {
+		if err := es.Acknowledge(name, events[0]); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := es.IncrementRetries(name, events[0]); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := es.Park(name, ParkedEvent{Stream: events[1].Stream, Id: events[1].Id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := es.RemoveWebhook(w.Id, names[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, name := range names {
+		kept := i == 1
+		id, err := es.Checkpoint(name, events[0].Stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (id != nil) != kept {
+			t.Error("Wrong checkpoint for", name+":", id)
+		}
+		parked, err := es.ParkedEvents(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (len(parked) != 0) != kept {
+			t.Error("Wrong parked events for", name+":", parked)
+		}
+		attempts, err := es.IncrementRetries(name, events[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (attempts != 1) != kept {
+			t.Error("Wrong retry count for", name+":", attempts)
+		}
+	}
+}
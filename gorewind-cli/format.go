@@ -0,0 +1,86 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Renders and parses event ids. Event ids are opaque byte strings, so
+// they need to be encoded to be printable.
+type idCodec struct {
+	encode func([]byte) string
+	decode func(string) ([]byte, error)
+}
+
+// Create an idCodec for one of the formats "hex", "base64" or "utf8".
+func newIdCodec(format string) (*idCodec, error) {
+	switch format {
+	case "hex":
+		return &idCodec{hex.EncodeToString, hex.DecodeString}, nil
+	case "base64":
+		enc := base64.StdEncoding
+		return &idCodec{enc.EncodeToString, enc.DecodeString}, nil
+	case "utf8":
+		encode := func(b []byte) string {
+			return string(b)
+		}
+		decode := func(s string) ([]byte, error) {
+			return []byte(s), nil
+		}
+		return &idCodec{encode, decode}, nil
+	}
+	return nil, errors.New("Unknown id format: " + format)
+}
+
+// Render event data for printing. If pretty is set and the data is valid
+// JSON, it is indented.
+func renderData(data []byte, pretty bool) string {
+	if pretty {
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, data, "", "  "); err == nil {
+			return buf.String()
+		}
+	}
+	return string(data)
+}
+
+// Print a single event as tab separated fields. The stream is left out
+// if nil. Redacted events are marked as such.
+func printEvent(w io.Writer, codec *idCodec, stream, id, data []byte, redacted, pretty bool) {
+	if stream != nil {
+		fmt.Fprintf(w, "%s\t", stream)
+	}
+	marker := ""
+	if redacted {
+		marker = "[redacted] "
+	}
+	fmt.Fprintf(w, "%s\t%s%s\n", codec.encode(id), marker,
+	renderData(data, pretty))
+}
+
+// Whether the frames following the data of an event mark it as
+// redacted.
+func isRedacted(trailing [][]byte) bool {
+	return len(trailing) > 0 && string(trailing[0]) == "REDACTED"
+}
@@ -0,0 +1,100 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+
+import (
+	"testing"
+	"bytes"
+)
+
+
+func TestIdCodecs(t *testing.T) {
+	t.Parallel()
+
+	id := []byte{0, 1, 255}
+	expected := map[string]string{
+		"hex": "0001ff",
+		"base64": "AAH/",
+	}
+	for format, encoded := range expected {
+		codec, err := newIdCodec(format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res := codec.encode(id); res != encoded {
+			t.Error(format, "encoded to:", res)
+		}
+		decoded, err := codec.decode(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Compare(decoded, id) != 0 {
+			t.Error(format, "decoded to:", decoded)
+		}
+	}
+
+	codec, err := newIdCodec("utf8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := codec.encode([]byte("abc")); res != "abc" {
+		t.Error("utf8 encoded to:", res)
+	}
+
+	if _, err := newIdCodec("morse"); err == nil {
+		t.Error("Expected an error for unknown format.")
+	}
+}
+
+func TestRenderData(t *testing.T) {
+	t.Parallel()
+
+	data := []byte(`{"a":1}`)
+	if res := renderData(data, false); res != `{"a":1}` {
+		t.Error("Data was modified:", res)
+	}
+	if res := renderData(data, true); res != "{\n  \"a\": 1\n}" {
+		t.Error("Data was not pretty-printed:", res)
+	}
+	if res := renderData([]byte("not json"), true); res != "not json" {
+		t.Error("Non-JSON data was modified:", res)
+	}
+}
+
+func TestPrintEvent(t *testing.T) {
+	t.Parallel()
+
+	codec, _ := newIdCodec("hex")
+	var buf bytes.Buffer
+	printEvent(&buf, codec, []byte("mystream"), []byte{1}, []byte("data"), false, false)
+	if buf.String() != "mystream\t01\tdata\n" {
+		t.Error("Wrong output:", buf.String())
+	}
+
+	buf.Reset()
+	printEvent(&buf, codec, nil, []byte{1}, []byte("data"), false, false)
+	if buf.String() != "01\tdata\n" {
+		t.Error("Wrong output:", buf.String())
+	}
+
+	buf.Reset()
+	printEvent(&buf, codec, nil, []byte{1}, []byte("{}"), true, false)
+	if buf.String() != "01\t[redacted] {}\n" {
+		t.Error("Wrong output:", buf.String())
+	}
+}
@@ -0,0 +1,397 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// gorewind-cli is a command-line client for GoRewind. It speaks the
+// same ZeroMQ wire protocol as any other client, which makes it useful
+// for debugging a running server.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+	zmq "github.com/alecthomas/gozmq"
+)
+
+var (
+	commandSocketZPath = flag.String("commandsocket",
+	"tcp://127.0.0.1:9002", "Command socket of the server.")
+	eventPublishZPath = flag.String("evpubsocket",
+	"tcp://127.0.0.1:9003", "Event publishing socket of the server.")
+	idFormat = flag.String("ids", "hex", "How event ids are printed"+
+	" and parsed. One of hex, base64 or utf8.")
+	prettyJSON = flag.Bool("json", false, "Pretty-print event data"+
+	" that is valid JSON.")
+	timeout = flag.Duration("timeout", 5*time.Second, "How long to"+
+	" wait for the server to respond.")
+	tenant = flag.String("tenant", "", "Tenant to talk to. Empty means"+
+	" the default tenant.")
+)
+
+// Returned when the server does not respond in time.
+var errTimeout = errors.New("Timed out waiting for response.")
+
+// How long `admin` waits for further responses after the first one.
+const adminLinger = 250 * time.Millisecond
+
+const usage = `Usage: gorewind-cli [flags] <command> [arguments]
+
+Commands:
+  publish STREAM [DATA]      Publish an event. Reads DATA from stdin if
+                             omitted.
+  query STREAM [FROM [TO]]   Query the events of a stream.
+  tail [PREFIX]              Print newly published events of all streams
+                             starting with PREFIX.
+  streams [START]            List streams.
+  stats                      Print server statistics.
+  admin COMMAND [FRAME...]   Send an arbitrary command and print all
+                             response frames.
+
+Flags:
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	codec, err := newIdCodec(*idFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	context, err := zmq.NewContext()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer context.Close()
+
+	args := flag.Args()[1:]
+	switch flag.Arg(0) {
+	case "publish":
+		err = publish(context, codec, args)
+	case "query":
+		err = query(context, codec, args)
+	case "tail":
+		err = tail(context, codec, args)
+	case "streams":
+		err = streams(context, args)
+	case "stats":
+		err = stats(context)
+	case "admin":
+		err = admin(context, args)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// A connection to the command socket of a server.
+type client struct {
+	sock *zmq.Socket
+	timeout time.Duration
+}
+
+func dial(context *zmq.Context) (*client, error) {
+	sock, err := context.NewSocket(zmq.DEALER)
+	if err != nil {
+		return nil, err
+	}
+	if err := sock.Connect(*commandSocketZPath); err != nil {
+		sock.Close()
+		return nil, err
+	}
+	return &client{sock, *timeout}, nil
+}
+
+func (c *client) Close() error {
+	return c.sock.Close()
+}
+
+// Send a request. The empty delimiter frame is prepended, so that the
+// server sees the same envelope as from a REQ socket. So is the tenant,
+// if any.
+func (c *client) request(frames ...[]byte) error {
+	msg := [][]byte{[]byte("")}
+	if *tenant != "" {
+		msg = append(msg, []byte("TENANT"), []byte(*tenant))
+	}
+	msg = append(msg, frames...)
+	return c.sock.SendMultipart(msg, 0)
+}
+
+// Receive a single response, with the empty delimiter frame stripped.
+// Error responses are returned as errors.
+func (c *client) receive(timeout time.Duration) ([][]byte, error) {
+	items := zmq.PollItems{
+		zmq.PollItem{Socket: c.sock, Events: zmq.POLLIN},
+	}
+	count, err := zmq.Poll(items, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, errTimeout
+	}
+	msg, err := c.sock.RecvMultipart(0)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) > 0 && len(msg[0]) == 0 {
+		msg = msg[1:]
+	}
+	if len(msg) == 0 {
+		return nil, errors.New("Received an empty response.")
+	}
+	if strings.HasPrefix(string(msg[0]), "ERROR ") {
+		return nil, errors.New(string(msg[0]))
+	}
+	return msg, nil
+}
+
+// Send a request and call fn for every response until END is received.
+func (c *client) list(fn func([][]byte), frames ...[]byte) error {
+	if err := c.request(frames...); err != nil {
+		return err
+	}
+	for {
+		resp, err := c.receive(c.timeout)
+		if err != nil {
+			return err
+		}
+		if string(resp[0]) == "END" {
+			return nil
+		}
+		fn(resp)
+	}
+}
+
+func publish(context *zmq.Context, codec *idCodec, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("Usage: publish STREAM [DATA]")
+	}
+	var data []byte
+	if len(args) == 2 {
+		data = []byte(args[1])
+	} else {
+		var err error
+		if data, err = ioutil.ReadAll(os.Stdin); err != nil {
+			return err
+		}
+	}
+
+	c, err := dial(context)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := c.request([]byte("PUBLISH"), []byte(args[0]), data); err != nil {
+		return err
+	}
+	resp, err := c.receive(c.timeout)
+	if err != nil {
+		return err
+	}
+	if string(resp[0]) != "PUBLISHED" || len(resp) < 2 {
+		return errors.New("Unexpected response: " + string(resp[0]))
+	}
+	fmt.Println(codec.encode(resp[1]))
+	return nil
+}
+
+func query(context *zmq.Context, codec *idCodec, args []string) error {
+	if len(args) < 1 || len(args) > 3 {
+		return errors.New("Usage: query STREAM [FROM [TO]]")
+	}
+	frames := [][]byte{[]byte("QUERY"), []byte(args[0]), nil, nil}
+	for i, sId := range args[1:] {
+		if sId == "" {
+			continue
+		}
+		id, err := codec.decode(sId)
+		if err != nil {
+			return err
+		}
+		frames[2+i] = id
+	}
+
+	c, err := dial(context)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	var malformed error
+	err = c.list(func(resp [][]byte) {
+		if string(resp[0]) != "EVENT" || len(resp) < 3 {
+			malformed = errors.New("Unexpected response: " + string(resp[0]))
+			return
+		}
+		printEvent(os.Stdout, codec, nil, resp[1], resp[2],
+		isRedacted(resp[3:]), *prettyJSON)
+	}, frames...)
+	if err != nil {
+		return err
+	}
+	return malformed
+}
+
+func tail(context *zmq.Context, codec *idCodec, args []string) error {
+	if len(args) > 1 {
+		return errors.New("Usage: tail [PREFIX]")
+	}
+	prefix := ""
+	if len(args) == 1 {
+		prefix = args[0]
+	}
+
+	sock, err := context.NewSocket(zmq.SUB)
+	if err != nil {
+		return err
+	}
+	defer sock.Close()
+	if err := sock.Connect(*eventPublishZPath); err != nil {
+		return err
+	}
+	// The events of other tenants than the default one are published
+	// with the tenant as part of the topic.
+	topicPrefix := ""
+	if *tenant != "" {
+		topicPrefix = "@" + *tenant + "/"
+	}
+	if err := sock.SetSubscribe(topicPrefix + prefix); err != nil {
+		return err
+	}
+	for {
+		msg, err := sock.RecvMultipart(0)
+		if err != nil {
+			return err
+		}
+		if len(msg) < 3 {
+			continue
+		}
+		stream, ok := tailedStream(msg[0], topicPrefix)
+		if !ok {
+			continue
+		}
+		printEvent(os.Stdout, codec, stream, msg[1], msg[2],
+		isRedacted(msg[3:]), *prettyJSON)
+	}
+}
+
+// The stream of a published event, given the topic prefix of the tailed
+// tenant. Returns false for events of other tenants, which the default
+// tenant, with its empty topic prefix, is subscribed to as well.
+func tailedStream(topic []byte, topicPrefix string) ([]byte, bool) {
+	if topicPrefix == "" && bytes.HasPrefix(topic, []byte("@")) {
+		return nil, false
+	}
+	return topic[len(topicPrefix):], true
+}
+
+func streams(context *zmq.Context, args []string) error {
+	if len(args) > 1 {
+		return errors.New("Usage: streams [START]")
+	}
+	start := []byte{}
+	if len(args) == 1 {
+		start = []byte(args[0])
+	}
+
+	c, err := dial(context)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return c.list(func(resp [][]byte) {
+		if len(resp) > 2 && string(resp[2]) == "SEALED" {
+			fmt.Printf("%s (sealed)\n", resp[1])
+		} else if len(resp) > 1 {
+			fmt.Printf("%s\n", resp[1])
+		}
+	}, []byte("STREAMS"), start, []byte{})
+}
+
+func stats(context *zmq.Context) error {
+	c, err := dial(context)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return c.list(func(resp [][]byte) {
+		if len(resp) > 2 {
+			fmt.Printf("%s\t%s\n", resp[1], resp[2])
+		}
+	}, []byte("STATS"))
+}
+
+// Send an arbitrary command. Since the client does not know how many
+// responses a command results in, responses are printed until END is
+// received or the server goes quiet.
+func admin(context *zmq.Context, args []string) error {
+	if len(args) < 1 {
+		return errors.New("Usage: admin COMMAND [FRAME...]")
+	}
+	frames := make([][]byte, len(args))
+	for i, arg := range args {
+		frames[i] = []byte(arg)
+	}
+
+	c, err := dial(context)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := c.request(frames...); err != nil {
+		return err
+	}
+	wait := c.timeout
+	for {
+		resp, err := c.receive(wait)
+		if err != nil {
+			if err == errTimeout && wait == adminLinger {
+				// No more responses.
+				return nil
+			}
+			return err
+		}
+		strFrames := make([]string, len(resp))
+		for i, frame := range resp {
+			strFrames[i] = string(frame)
+		}
+		fmt.Println(strings.Join(strFrames, "\t"))
+		if string(resp[0]) == "END" {
+			return nil
+		}
+		wait = adminLinger
+	}
+}
@@ -0,0 +1,42 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+
+import (
+	"testing"
+)
+
+
+func TestTailedStream(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		topic, topicPrefix, stream string
+		ok bool
+	}{
+		{"mystream", "", "mystream", true},
+		{"@acme/mystream", "", "", false},
+		{"@acme/mystream", "@acme/", "mystream", true},
+	}
+	for _, test := range tests {
+		stream, ok := tailedStream([]byte(test.topic), test.topicPrefix)
+		if ok != test.ok || string(stream) != test.stream {
+			t.Error("Wrong stream of", test.topic, ":", string(stream), ok)
+		}
+	}
+}
@@ -20,10 +20,14 @@ package main
 import (
 	"flag"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"github.com/JensRantil/gorewind/connector"
 	"github.com/JensRantil/gorewind/server"
 	"github.com/JensRantil/gorewind/eventstore"
+	"github.com/JensRantil/gorewind/webui"
 	"github.com/syndtr/goleveldb/leveldb/storage"
 	zmq "github.com/alecthomas/gozmq"
 )
@@ -40,11 +44,70 @@ var (
 	"tcp://127.0.0.1:9003", "ZeroMQ event publishing socket.")
 	inMemoryStore = flag.Bool("in-memory", false,
 	"Use in-memory store. Useful for automated client testing.")
+	webUIAddr = flag.String("http", "", "Address to serve the read-only"+
+	" web interface on, for example 127.0.0.1:9004. Disabled if empty.")
+	connectorSpecs = connectorSpecList{}
+	connectorMaxAttempts = flag.Int("connector-max-attempts", 0,
+	"Number of failed deliveries before a connector parks an event"+
+	" and moves on. 0 means retrying forever.")
+	auditPublish = flag.Bool("audit-publish", false, "Record every"+
+	" published event in the $audit stream, not only administrative"+
+	" commands.")
+	logRequests = flag.Bool("log-requests", false, "Log every request"+
+	" to the command socket.")
+	snapshotTimeout = flag.Duration("snapshot-timeout",
+	server.DefaultSnapshotTimeout, "How long a snapshot opened by"+
+	" SNAPSHOT_OPEN is kept after it was last used.")
+	positionTimeout = flag.Duration("position-timeout",
+	server.DefaultPositionTimeout, "How long a request prefixed with"+
+	" MIN_POSITION waits for the position to be reached.")
+	maxCachedStreams = flag.Int("stream-cache",
+	eventstore.DefaultMaxCachedStreams, "Number of streams per tenant"+
+	" whose next event id is kept in memory.")
+	blockCacheSize = flag.Int("leveldb-block-cache", 0, "Size in bytes"+
+	" of the LevelDB block cache. 0 means the LevelDB default.")
+	bloomFilterBits = flag.Int("leveldb-bloom-bits",
+	eventstore.DefaultBloomFilterBits, "Bits per key of the LevelDB"+
+	" bloom filter. 0 disables it.")
+	writeBufferSize = flag.Int("leveldb-write-buffer", 0, "Size in"+
+	" bytes of the LevelDB write buffer. 0 means the LevelDB default.")
+	maxOpenFiles = flag.Int("leveldb-max-open-files", 0, "Number of"+
+	" files LevelDB may keep open. 0 means the LevelDB default.")
+	disableCompression = flag.Bool("leveldb-no-compression", false,
+	"Store LevelDB blocks uncompressed.")
+	readOnly = flag.Bool("read-only", false, "Open an existing database"+
+	" read-only and refuse all writes. Meant for serving queries"+
+	" from a copy of the data directory. Scheduled events, webhooks"+
+	" and connectors are not run. LevelDB itself may still"+
+	" write to the directory when opening it, for example to replay"+
+	" its log.")
 )
 
+func init() {
+	flag.Var(&connectorSpecs, "connector", "Deliver all events to an"+
+	" external system. Specified as name:kind:target, where kind is"+
+	" one of stdout, file, http or exec. Can be given multiple times.")
+}
+
+// A flag value that can be given multiple times.
+type connectorSpecList []string
+
+func (v *connectorSpecList) String() string {
+	return strings.Join(*v, ",")
+}
+
+func (v *connectorSpecList) Set(spec string) error {
+	*v = append(*v, spec)
+	return nil
+}
+
 // Main method. Will panic if things are so bad that the application
-// will not start.
+// will not start. `gorewind inspect` is handled by inspectMain.
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "inspect" {
+		inspectMain(os.Args[2:])
+		return
+	}
 	flag.Parse()
 
 	log.Println("Event store to use:", *eventStorePath)
@@ -59,18 +122,70 @@ func main() {
 		log.Println()
 		stor = &storage.MemStorage{}
 	} else {
-		stor, err := storage.OpenFile(*eventStorePath)
+		var err error
+		stor, err = storage.OpenFile(*eventStorePath)
 		if err != nil {
 			log.Panicln("could not create DB storage")
 		}
 		defer stor.Close()
 	}
 
-	estore, err := eventstore.New(stor)
+	options := &eventstore.Options{
+		MaxCachedStreams: *maxCachedStreams,
+		BlockCacheSize: *blockCacheSize,
+		BloomFilterBits: *bloomFilterBits,
+		WriteBufferSize: *writeBufferSize,
+		MaxOpenFiles: *maxOpenFiles,
+		DisableCompression: *disableCompression,
+		ReadOnly: *readOnly,
+	}
+	estore, err := eventstore.New(stor, options)
 	if err != nil {
 		log.Panicln(os.Stderr, "could not create event store")
 	}
 
+	connectors := make([]*connector.Connector, 0, len(connectorSpecs))
+	for _, spec := range connectorSpecs {
+		conn, err := connector.NewFromSpec(estore, spec)
+		if err != nil {
+			log.Panicln(err)
+		}
+		conn.MaxAttempts = *connectorMaxAttempts
+		connectors = append(connectors, conn)
+	}
+
+	// Everything below that runs in the background writes to the event
+	// store, if only its checkpoints. Their parked events and webhooks
+	// can still be listed while read-only.
+	webhooks := connector.NewWebhookManager(estore)
+	if *readOnly {
+		log.Println("Read-only: not running scheduled events, webhooks" +
+		" or connectors.")
+	} else {
+		for i, conn := range connectors {
+			log.Println("Starting connector:", connectorSpecs[i])
+			conn.Start()
+			defer conn.Stop()
+		}
+
+		scheduler := eventstore.NewScheduler(estore)
+		scheduler.Start()
+		defer scheduler.Stop()
+
+		if err := webhooks.Start(); err != nil {
+			log.Panicln(err)
+		}
+		defer webhooks.Stop()
+	}
+
+	if *webUIAddr != "" {
+		log.Println("Serving web interface on:", *webUIAddr)
+		go func() {
+			err := http.ListenAndServe(*webUIAddr, webui.New(estore))
+			log.Panicln(err)
+		}()
+	}
+
 	context, err := zmq.NewContext()
 	if err != nil {
 		log.Panicln(err)
@@ -81,6 +196,15 @@ func main() {
 		CommandSocketZPath: commandSocketZPath,
 		EvPubSocketZPath: eventPublishZPath,
 		ZMQContext: context,
+		Webhooks: webhooks,
+		Connectors: connectors,
+		AuditPublish: *auditPublish,
+		SnapshotTimeout: *snapshotTimeout,
+		PositionTimeout: *positionTimeout,
+	}
+	if *logRequests {
+		initParams.Middlewares = append(initParams.Middlewares,
+		server.LogRequests)
 	}
 	serv, err := server.New(&initParams)
 	if err != nil {
@@ -0,0 +1,154 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"github.com/JensRantil/gorewind/eventstore"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// Entry point of `gorewind inspect`. Prints what is stored in a data
+// directory without starting a server. Exits with a non-zero status if
+// malformed keys or inconsistent streams were found. A copy of the data
+// directory is inspected, since opening it could write to it.
+func inspectMain(args []string) {
+	flags := flag.NewFlagSet("inspect", flag.ExitOnError)
+	datadir := flags.String("datadir", "data", "directory path of the"+
+	" event store to inspect.")
+	flags.Parse(args)
+	os.Exit(inspect(*datadir))
+}
+
+// Inspect a copy of a data directory. Returns the exit status.
+func inspect(datadir string) int {
+	if _, err := os.Stat(datadir); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	tmpdir, err := ioutil.TempDir("", "gorewind-inspect")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer os.RemoveAll(tmpdir)
+	if err := copyDir(datadir, tmpdir); err != nil {
+		fmt.Fprintln(os.Stderr, "could not copy data directory:", err)
+		return 2
+	}
+
+	stor, err := storage.OpenFile(tmpdir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "could not open DB storage:", err)
+		return 2
+	}
+	defer stor.Close()
+
+	report, err := eventstore.Inspect(stor)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "could not inspect:", err)
+		return 2
+	}
+	if !printInspectReport(os.Stdout, report) {
+		return 1
+	}
+	return 0
+}
+
+// Copy the files of a LevelDB data directory, which has no
+// subdirectories, to another directory.
+func copyDir(src, dst string) error {
+	infos, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		if err := copyFile(filepath.Join(src, info.Name()), filepath.Join(dst, info.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Print an inspection report. Returns false if problems were found.
+func printInspectReport(w io.Writer, report *eventstore.InspectReport) bool {
+	healthy := true
+
+	fmt.Fprintln(w, "Key groups:")
+	groups := make([]string, 0, len(report.Groups))
+	for group := range report.Groups {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	for _, group := range groups {
+		g := report.Groups[group]
+		fmt.Fprintf(w, "  %-20q %10d keys %14d bytes\n", group, g.Keys,
+		g.Bytes)
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Streams:")
+	for _, sr := range report.Streams {
+		status := ""
+		if !sr.Consistent() {
+			status = "  INCONSISTENT: head does not match last event"
+			healthy = false
+		}
+		name := fmt.Sprintf("%q", sr.Name)
+		if sr.Tenant != "" {
+			name = fmt.Sprintf("%q@%s", sr.Name, sr.Tenant)
+		}
+		fmt.Fprintf(w, "  %-40s head=%x events=%d bytes=%d%s\n",
+		name, sr.Head, sr.Events, sr.Bytes, status)
+	}
+
+	if len(report.Malformed) > 0 {
+		healthy = false
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "MALFORMED KEYS:")
+		for _, m := range report.Malformed {
+			fmt.Fprintf(w, "  %q: %s\n", m.Key, m.Error)
+		}
+	}
+	return healthy
+}
@@ -0,0 +1,232 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+	zmq "github.com/alecthomas/gozmq"
+)
+
+// The number of clients remembered. The ones seen least recently are
+// forgotten first.
+const maxTrackedClients = 10000
+
+// The names of the monitored sockets, as used by clientTracker.
+const (
+	commandSocketName = "command"
+	pubSocketName = "pub"
+)
+
+// Used for making monitor endpoints unique within a process.
+var monitorCount uint32
+
+// What is known about a client of the command socket.
+type clientInfo struct {
+	id string
+	requests uint64
+	firstSeen time.Time
+	lastSeen time.Time
+}
+
+// Keeps track of the clients of the command socket, identified by the
+// identity from the ROUTER envelope, and of the number of connections to
+// the sockets of the server. The zero value is ready to use.
+type clientTracker struct {
+	lock sync.Mutex
+	// Indexed by hex encoded identity.
+	clients map[string]*clientInfo
+	// Clients whose requests are refused. See block.
+	blocked map[string]bool
+	// Open connections, indexed by socket name.
+	connections map[string]int
+}
+
+// A middleware recording every request, and refusing the ones from
+// blocked clients.
+func (t *clientTracker) track(next Handler) Handler {
+	return func(req *Request, resp Responder) {
+		if req.ClientId != "" && !t.seen(req.ClientId) {
+			RespondError(resp, "Client has been blocked.")
+			return
+		}
+		next(req, resp)
+	}
+}
+
+// Record a request of a client. Returns false if the client has been
+// blocked.
+func (t *clientTracker) seen(id string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.blocked[id] {
+		return false
+	}
+	if t.clients == nil {
+		t.clients = make(map[string]*clientInfo)
+	}
+	now := time.Now()
+	client, exists := t.clients[id]
+	if !exists {
+		if len(t.clients) >= maxTrackedClients {
+			t.forgetOldest()
+		}
+		client = &clientInfo{id: id, firstSeen: now}
+		t.clients[id] = client
+	}
+	client.requests++
+	client.lastSeen = now
+	return true
+}
+
+// Forget the client seen least recently. t.lock must be held.
+func (t *clientTracker) forgetOldest() {
+	var oldest *clientInfo
+	for _, client := range t.clients {
+		if oldest == nil || client.lastSeen.Before(oldest.lastSeen) {
+			oldest = client
+		}
+	}
+	if oldest != nil {
+		delete(t.clients, oldest.id)
+	}
+}
+
+// Refuse all further requests from a client identity. This is a soft
+// block: ZeroMQ can't close the connection of a single peer of a ROUTER
+// socket, so the connection is kept, and a client that reconnects under
+// a new identity is served again.
+func (t *clientTracker) block(id string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.blocked == nil {
+		t.blocked = make(map[string]bool)
+	}
+	t.blocked[id] = true
+	delete(t.clients, id)
+}
+
+// Accept requests from a blocked client again. Returns false if the
+// client had not been blocked.
+func (t *clientTracker) unblock(id string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.blocked[id] {
+		return false
+	}
+	delete(t.blocked, id)
+	return true
+}
+
+// All known clients, sorted by identity.
+func (t *clientTracker) list() []clientInfo {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	res := make([]clientInfo, 0, len(t.clients))
+	for _, client := range t.clients {
+		res = append(res, *client)
+	}
+	sort.Sort(clientsById(res))
+	return res
+}
+
+// Update the number of connections of a socket from a monitor event.
+func (t *clientTracker) connectionEvent(socket string, event zmq.Event) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.connections == nil {
+		t.connections = make(map[string]int)
+	}
+	switch event {
+	case zmq.EVENT_ACCEPTED:
+		t.connections[socket]++
+	case zmq.EVENT_DISCONNECTED:
+		if t.connections[socket] > 0 {
+			t.connections[socket]--
+		}
+	}
+}
+
+// The statistics reported by STATS.
+func (t *clientTracker) stats() []stat {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return []stat{
+		{"clients", strconv.Itoa(len(t.clients))},
+		{"connections", strconv.Itoa(t.connections[commandSocketName])},
+		{"blocked_clients", strconv.Itoa(len(t.blocked))},
+		{"subscribers", strconv.Itoa(t.connections[pubSocketName])},
+	}
+}
+
+type clientsById []clientInfo
+
+func (c clientsById) Len() int {
+	return len(c)
+}
+func (c clientsById) Less(i, j int) bool {
+	return c[i].id < c[j].id
+}
+func (c clientsById) Swap(i, j int) {
+	c[i], c[j] = c[j], c[i]
+}
+
+// Attach a monitor to a socket. Returns a PAIR socket receiving the
+// connection events of the socket.
+func monitorSocket(context *zmq.Context, sock *zmq.Socket) (*zmq.Socket, error) {
+	n := atomic.AddUint32(&monitorCount, 1)
+	endpoint := fmt.Sprintf("inproc://gorewind-monitor-%d", n)
+	events := zmq.EVENT_ACCEPTED | zmq.EVENT_DISCONNECTED
+	if err := sock.Monitor(endpoint, events); err != nil {
+		return nil, err
+	}
+	monitor, err := context.NewSocket(zmq.PAIR)
+	if err != nil {
+		return nil, err
+	}
+	if err := monitor.Connect(endpoint); err != nil {
+		monitor.Close()
+		return nil, err
+	}
+	return monitor, nil
+}
+
+// The byte order of the host, which socket monitor events are sent in.
+var hostByteOrder binary.ByteOrder = func() binary.ByteOrder {
+	probe := uint16(1)
+	if *(*byte)(unsafe.Pointer(&probe)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// Parse the event type of a message from a socket monitor. Depends on
+// libzmq 3.2, which sends a zmq_event_t struct in host byte order,
+// starting with the event type as a 32 bit int. libzmq 4 sends a
+// different format.
+func parseMonitorEvent(msg [][]byte) (zmq.Event, bool) {
+	if len(msg) < 1 || len(msg[0]) < 4 {
+		return 0, false
+	}
+	return zmq.Event(hostByteOrder.Uint32(msg[0])), true
+}
@@ -0,0 +1,171 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+	zmq "github.com/alecthomas/gozmq"
+)
+
+func TestClientCommands(t *testing.T) {
+	t.Parallel()
+
+	serv := &Server{
+		params: InitParams{
+			Store: setupInMemoryeventstore(),
+		},
+	}
+	admin := hex.EncodeToString([]byte("admin"))
+	bad := hex.EncodeToString([]byte("bad"))
+	handleClientRequest(serv, "bad", "STREAMS", "", "")
+	handleClientRequest(serv, "bad", "STREAMS", "", "")
+
+	resps := handleClientRequest(serv, "admin", "CLIENTS")
+	if len(resps) != 3 || string(resps[2][0]) != "END" {
+		t.Fatal("Unexpected response:", resps)
+	}
+	if string(resps[0][1]) != admin || string(resps[0][2]) != "1" {
+		t.Error("Wrong admin client:", resps[0])
+	}
+	if string(resps[1][1]) != bad || string(resps[1][2]) != "2" {
+		t.Error("Wrong bad client:", resps[1])
+	}
+
+	resps = handleClientRequest(serv, "admin", "BLOCK_CLIENT", bad)
+	if len(resps) != 1 || string(resps[0][0]) != "CLIENT_BLOCKED" {
+		t.Error("Unexpected response:", resps)
+	}
+	resps = handleClientRequest(serv, "bad", "STREAMS", "", "")
+	if len(resps) != 1 || string(resps[0][0]) != "ERROR Client has been blocked." {
+		t.Error("Blocked client was served:", resps)
+	}
+	resps = handleClientRequest(serv, "admin", "STATS")
+	stats := make(map[string]string)
+	for _, resp := range resps {
+		if string(resp[0]) == "STAT" {
+			stats[string(resp[1])] = string(resp[2])
+		}
+	}
+	if stats["clients"] != "1" || stats["blocked_clients"] != "1" {
+		t.Error("Wrong client stats:", stats)
+	}
+
+	resps = handleClientRequest(serv, "admin", "UNBLOCK_CLIENT", bad)
+	if len(resps) != 1 || string(resps[0][0]) != "CLIENT_UNBLOCKED" {
+		t.Error("Unexpected response:", resps)
+	}
+	resps = handleClientRequest(serv, "bad", "STATS")
+	if len(resps) == 0 || string(resps[len(resps)-1][0]) != "END" {
+		t.Error("Unblocked client was not served:", resps)
+	}
+
+	malformed := [][]string{
+		{"BLOCK_CLIENT"},
+		{"BLOCK_CLIENT", admin},
+		{"UNBLOCK_CLIENT", admin},
+		{"TENANT", "acme", "CLIENTS"},
+	}
+	for _, frames := range malformed {
+		resps := handleClientRequest(serv, "admin", frames...)
+		if len(resps) != 1 || !strings.HasPrefix(string(resps[0][0]), "ERROR ") {
+			t.Error("Expected an error for:", frames, resps)
+		}
+	}
+}
+
+// Blocking applies to identities, not connections. A client that
+// reconnects with the identity it set itself stays blocked, while one
+// that is given a new identity by ZeroMQ is served.
+func TestBlockedClientReconnecting(t *testing.T) {
+	t.Parallel()
+
+	serv := &Server{
+		params: InitParams{
+			Store: setupInMemoryeventstore(),
+		},
+	}
+	bad := hex.EncodeToString([]byte("bad"))
+	resps := handleClientRequest(serv, "admin", "BLOCK_CLIENT", bad)
+	if len(resps) != 1 || string(resps[0][0]) != "CLIENT_BLOCKED" {
+		t.Fatal("Unexpected response:", resps)
+	}
+
+	// What a reconnect looks like to the server.
+	serv.clients.connectionEvent(commandSocketName, zmq.EVENT_DISCONNECTED)
+	serv.clients.connectionEvent(commandSocketName, zmq.EVENT_ACCEPTED)
+	resps = handleClientRequest(serv, "bad", "STATS")
+	if len(resps) != 1 || string(resps[0][0]) != "ERROR Client has been blocked." {
+		t.Error("Client reconnecting with its identity was served:", resps)
+	}
+	resps = handleClientRequest(serv, "\x00new", "STATS")
+	if len(resps) == 0 || string(resps[len(resps)-1][0]) != "END" {
+		t.Error("Client with a new identity was not served:", resps)
+	}
+}
+
+func TestClientTrackerBound(t *testing.T) {
+	t.Parallel()
+
+	var tracker clientTracker
+	for i := 0; i <= maxTrackedClients; i++ {
+		tracker.seen(string(rune(i)))
+	}
+	if clients := tracker.list(); len(clients) != maxTrackedClients {
+		t.Error("Wrong number of clients:", len(clients))
+	}
+}
+
+func TestConnectionEvents(t *testing.T) {
+	t.Parallel()
+
+	var tracker clientTracker
+	event := func(e zmq.Event) [][]byte {
+		frame := make([]byte, 24)
+		hostByteOrder.PutUint32(frame, uint32(e))
+		return [][]byte{frame}
+	}
+	events := []struct {
+		socket string
+		msg [][]byte
+	}{
+		{commandSocketName, event(zmq.EVENT_ACCEPTED)},
+		{commandSocketName, event(zmq.EVENT_ACCEPTED)},
+		{commandSocketName, event(zmq.EVENT_DISCONNECTED)},
+		{pubSocketName, event(zmq.EVENT_DISCONNECTED)},
+		{pubSocketName, event(zmq.EVENT_ACCEPTED)},
+	}
+	for _, e := range events {
+		parsed, ok := parseMonitorEvent(e.msg)
+		if !ok {
+			t.Fatal("Could not parse:", e.msg)
+		}
+		tracker.connectionEvent(e.socket, parsed)
+	}
+	if _, ok := parseMonitorEvent([][]byte{{1}}); ok {
+		t.Error("Parsed a truncated event.")
+	}
+
+	stats := make(map[string]string)
+	for _, s := range tracker.stats() {
+		stats[s.name] = s.value
+	}
+	if stats["connections"] != "1" || stats["subscribers"] != "1" {
+		t.Error("Wrong connection counts:", stats)
+	}
+}
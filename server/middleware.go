@@ -0,0 +1,112 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"container/list"
+	"log"
+	"time"
+)
+
+// A request to the command socket, as seen by middlewares.
+type Request struct {
+	// The command, such as "PUBLISH".
+	Command string
+	// The frames following the command.
+	Frames [][]byte
+	// The tenant the request is made on behalf of. Empty for the
+	// default tenant. Taken from the TENANT frame, which clients choose
+	// freely. Middlewares that authenticate clients should set it to
+	// keep tenants apart.
+	Tenant string
+	// The token of the snapshot the request reads from. Empty for
+	// reading the latest data.
+	Snapshot string
+	// The commit position that must have been reached before the
+	// request is handled. nil for not waiting.
+	MinPosition []byte
+	// The fencing token of the lease a PUBLISH is made under. Empty
+	// if none.
+	Fence string
+	// The identity of the client from the ROUTER envelope, hex
+	// encoded.
+	ClientId string
+}
+
+// Sends the responses of a request to the client.
+type Responder interface {
+	// Send a single response message. The envelope is added by the
+	// server.
+	Send(frames ...[]byte)
+}
+
+// Send an error response. Use it to reject requests.
+func RespondError(resp Responder, errstr string) {
+	resp.Send([]byte("ERROR " + errstr))
+}
+
+// Handles a request. May be called concurrently.
+type Handler func(req *Request, resp Responder)
+
+// Wraps a handler. A middleware can inspect or modify a request before
+// calling `next`, reject it by responding without calling `next`, and
+// observe the responses by wrapping the Responder.
+type Middleware func(next Handler) Handler
+
+// Responds to a client of the command socket.
+type responder struct {
+	respchan chan zMsg
+	resptemplate *list.List
+}
+
+func (r *responder) Send(frames ...[]byte) {
+	response := copyList(r.resptemplate)
+	for _, frame := range frames {
+		response.PushBack(zFrame(frame))
+	}
+	r.respchan <- listToFrames(response)
+}
+
+// A responder counting the responses passed on.
+type countingResponder struct {
+	Responder
+	responses int
+	errors int
+}
+
+func (r *countingResponder) Send(frames ...[]byte) {
+	r.responses++
+	if len(frames) > 0 && bytes.HasPrefix(frames[0], []byte("ERROR ")) {
+		r.errors++
+	}
+	r.Responder.Send(frames...)
+}
+
+// A middleware logging every request once it has been handled: its
+// command, client, the number of responses and errors, and how long it
+// took. Frames are not logged since they may contain event data.
+func LogRequests(next Handler) Handler {
+	return func(req *Request, resp Responder) {
+		start := time.Now()
+		counter := &countingResponder{Responder: resp}
+		next(req, counter)
+		log.Printf("%s client=%s tenant=%s responses=%d errors=%d took=%s",
+		req.Command, req.ClientId, req.Tenant, counter.responses,
+		counter.errors, time.Since(start))
+	}
+}
@@ -0,0 +1,158 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"container/list"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+	"github.com/JensRantil/gorewind/eventstore"
+)
+
+func TestMiddlewareOrder(t *testing.T) {
+	t.Parallel()
+
+	var calls []string
+	named := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(req *Request, resp Responder) {
+				calls = append(calls, name)
+				next(req, resp)
+			}
+		}
+	}
+	serv := &Server{
+		params: InitParams{
+			Store: setupInMemoryeventstore(),
+			Middlewares: []Middleware{named("first"), named("second")},
+		},
+	}
+	resps := handleTestRequest(serv, "PUBLISH", "mystream", "data")
+	if len(resps) != 1 || string(resps[0][0]) != "PUBLISHED" {
+		t.Error("Unexpected response:", resps)
+	}
+	if len(calls) != 2 || calls[0] != "first" || calls[1] != "second" {
+		t.Error("Wrong middleware order:", calls)
+	}
+}
+
+func TestMiddlewareRequest(t *testing.T) {
+	t.Parallel()
+
+	var seen *Request
+	// Rejects writes, and moves everything else to another tenant.
+	middleware := func(next Handler) Handler {
+		return func(req *Request, resp Responder) {
+			seen = req
+			if req.Command == "PUBLISH" {
+				RespondError(resp, "read only")
+				return
+			}
+			req.Tenant = "acme"
+			next(req, resp)
+		}
+	}
+	es := setupInMemoryeventstore()
+	acme, err := es.Tenant("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := eventstore.Event{
+		Stream: eventstore.StreamName("mystream"),
+		Data: []byte("acme"),
+	}
+	if _, err := acme.Add(event); err != nil {
+		t.Fatal(err)
+	}
+	serv := &Server{
+		params: InitParams{
+			Store: es,
+			Middlewares: []Middleware{middleware},
+		},
+	}
+
+	resps := handleTestRequest(serv, "TENANT", "other", "PUBLISH", "mystream", "data")
+	if len(resps) != 1 || string(resps[0][0]) != "ERROR read only" {
+		t.Error("Expected the request to be rejected:", resps)
+	}
+	if seen.Tenant != "other" || len(seen.Frames) != 2 || string(seen.Frames[1]) != "data" {
+		t.Error("Wrong request:", seen)
+	}
+	if seen.ClientId != hex.EncodeToString([]byte("clientid")) {
+		t.Error("Wrong client id:", seen.ClientId)
+	}
+
+	resps = handleTestRequest(serv, "QUERY", "mystream", "", "")
+	if len(resps) != 2 || string(resps[0][2]) != "acme" {
+		t.Error("Modified request was not handled:", resps)
+	}
+}
+
+func TestMiddlewareAuditClient(t *testing.T) {
+	t.Parallel()
+
+	// Stands in for a middleware that authenticates clients.
+	middleware := func(next Handler) Handler {
+		return func(req *Request, resp Responder) {
+			req.ClientId = "alice"
+			next(req, resp)
+		}
+	}
+	serv := &Server{
+		params: InitParams{
+			Store: setupInMemoryeventstore(),
+			Middlewares: []Middleware{middleware},
+		},
+	}
+	handleTestRequest(serv, "PUBLISH", "mystream", "data")
+	handleTestRequest(serv, "SEAL_STREAM", "mystream")
+
+	resps := handleTestRequest(serv, "QUERY", "$audit", "", "")
+	if len(resps) != 2 {
+		t.Fatal("Wrong number of audit entries:", resps)
+	}
+	var entry eventstore.AuditEntry
+	if err := json.Unmarshal(resps[0][2], &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Client != "alice" {
+		t.Error("Wrong client:", entry.Client)
+	}
+}
+
+func TestLogRequests(t *testing.T) {
+	t.Parallel()
+
+	serv := &Server{
+		params: InitParams{
+			Store: setupInMemoryeventstore(),
+			Middlewares: []Middleware{LogRequests},
+		},
+	}
+	resps := handleTestRequest(serv, "STREAMS", "", "")
+	if len(resps) != 1 || string(resps[0][0]) != "END" {
+		t.Error("Unexpected response:", resps)
+	}
+
+	counter := &countingResponder{Responder: &responder{make(chan zMsg, 2), list.New()}}
+	counter.Send([]byte("EVENT"))
+	counter.Send([]byte("ERROR failed"))
+	if counter.responses != 2 || counter.errors != 1 {
+		t.Error("Wrong counts:", counter.responses, counter.errors)
+	}
+}
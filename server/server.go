@@ -24,12 +24,19 @@ package server
 
 import (
 	"bytes"
+	"encoding/hex"
 	"errors"
 	"log"
+	"sort"
+	"strconv"
+	"strings"
 	"container/list"
 	"time"
 	"sync"
+	"unicode"
+	"unicode/utf8"
 	zmq "github.com/alecthomas/gozmq"
+	"github.com/JensRantil/gorewind/connector"
 	"github.com/JensRantil/gorewind/eventstore"
 )
 
@@ -47,6 +54,24 @@ type InitParams struct {
 	// instantiated by Server, it is not. Otherwise, it wuold be
 	// impossible to use inproc:// endpoints.
 	ZMQContext *zmq.Context
+	// Optional. Manages webhook subscriptions. The webhook commands
+	// return an error if not set.
+	Webhooks *connector.WebhookManager
+	// Optional. Connectors whose parked events can be managed through
+	// the PARKED_* commands, in addition to the webhook ones.
+	Connectors []*connector.Connector
+	// Optional. Whether to record every PUBLISH in the audit log.
+	// Administrative commands are always recorded.
+	AuditPublish bool
+	// Optional. Every request passes through these, the first one
+	// first, before reaching the command handler.
+	Middlewares []Middleware
+	// Optional. How long a snapshot opened by SNAPSHOT_OPEN is kept
+	// after it was last used. 0 means DefaultSnapshotTimeout.
+	SnapshotTimeout time.Duration
+	// Optional. How long a request prefixed with MIN_POSITION waits
+	// for the position. 0 means DefaultPositionTimeout.
+	PositionTimeout time.Duration
 }
 
 // Check all required initialization parameters are set.
@@ -66,6 +91,42 @@ func checkAllInitParamsSet(p *InitParams) error {
 	return nil
 }
 
+// Number of streams listed by STREAMS unless specified by the client.
+const defaultMaxStreams = 1000
+
+// Commands that deal with things that only exist for the default
+// tenant, such as the scheduler and server-managed subscriptions.
+var defaultTenantCommands = map[string]bool{
+	"SCHEDULE": true,
+	"CANCEL_SCHEDULE": true,
+	"WEBHOOK_ADD": true,
+	"WEBHOOK_REMOVE": true,
+	"WEBHOOK_LIST": true,
+	"WEBHOOK_DEADLETTERS": true,
+	"PARKED_LIST": true,
+	"PARKED_REPLAY": true,
+	"PARKED_DISCARD": true,
+	"CLIENTS": true,
+	"BLOCK_CLIENT": true,
+	"UNBLOCK_CLIENT": true,
+	"SET_READ_ONLY": true,
+	// Takes the tenant as an argument instead.
+	"SET_QUOTA": true,
+}
+
+// The commands that only read. Only these can be made against a
+// snapshot, or wait for a commit position.
+var readCommands = map[string]bool{
+	"QUERY": true,
+	"STREAMS": true,
+	"STREAM_STATS": true,
+	"USAGE": true,
+}
+
+// How long a request waits for a commit position to be reached, unless
+// InitParams.PositionTimeout says otherwise.
+const DefaultPositionTimeout = 5 * time.Second
+
 // A server instance. Can be run.
 type Server struct {
 	params InitParams
@@ -74,10 +135,18 @@ type Server struct {
 	commandsock *zmq.Socket
 	context *zmq.Context
 
+	// Receive the connection events of the sockets above.
+	evpubmonitor *zmq.Socket
+	commandmonitor *zmq.Socket
+
 	runningMutex sync.Mutex
 	running bool
 	stopChan chan bool
 	waiter sync.WaitGroup
+
+	stats serverStats
+	clients clientTracker
+	snapshots snapshotSessions
 }
 
 // IsRunning returns true if the server is running, false otherwise.
@@ -136,6 +205,7 @@ func New(params *InitParams) (*Server, error) {
 		// `Server.Stop()` for an example explanation.
 		stopChan: make(chan bool, 1),
 	}
+	server.stats.started = time.Now()
 
 	var allOkay *bool = new(bool)
 	*allOkay = false
@@ -152,6 +222,10 @@ func New(params *InitParams) (*Server, error) {
 		return nil, err
 	}
 	server.commandsock = commandsock
+	server.commandmonitor, err = monitorSocket(server.context, commandsock)
+	if err != nil {
+		return nil, err
+	}
 	err = commandsock.Bind(*params.CommandSocketZPath)
 	if err != nil {
 		return nil, err
@@ -162,6 +236,10 @@ func New(params *InitParams) (*Server, error) {
 		return nil, err
 	}
 	server.evpubsock = evpubsock
+	server.evpubmonitor, err = monitorSocket(server.context, evpubsock)
+	if err != nil {
+		return nil, err
+	}
 	if binderr := evpubsock.Bind(*params.EvPubSocketZPath); binderr != nil {
 		return nil, binderr
 	}
@@ -173,6 +251,19 @@ func New(params *InitParams) (*Server, error) {
 
 // Clean up and server and deallocate resources.
 func (v *Server) Close() error {
+	v.snapshots.closeAll()
+	if v.evpubmonitor != nil {
+		if err := v.evpubmonitor.Close(); err != nil {
+			return err
+		}
+		v.evpubmonitor = nil
+	}
+	if v.commandmonitor != nil {
+		if err := v.commandmonitor.Close(); err != nil {
+			return err
+		}
+		v.commandmonitor = nil
+	}
 	if v.evpubsock != nil {
 		if err := (*v.evpubsock).Close(); err != nil {
 			return err
@@ -214,7 +305,7 @@ func (v *Server) Start() error {
 	go func() {
 		defer v.waiter.Done()
 		defer v.setRunningState(false)
-		loopServer((*v).params.Store, *(*v).evpubsock, *(*v).commandsock, v.stopChan)
+		v.loopServer(*(*v).evpubsock, *(*v).commandsock, v.stopChan)
 	}()
 	return nil
 }
@@ -258,19 +349,30 @@ func stopPoller(cancelChan chan bool) {
 // copied in-memory. If this becomes a bottleneck in the future,
 // multiple router sockets can be hooked to this final router to scale
 // message copying.
-//
-// TODO: Make this a type function of `Server` to remove a lot of
-// parameters.
-func loopServer(estore *eventstore.EventStore, evpubsock, frontend zmq.Socket,
-stop chan bool) {
+func (v *Server) loopServer(evpubsock, frontend zmq.Socket, stop chan bool) {
+	estore := v.params.Store
 	toPoll := zmq.PollItems{
 		zmq.PollItem{Socket: &frontend, zmq.Events: zmq.POLLIN},
+		zmq.PollItem{Socket: v.commandmonitor, Events: zmq.POLLIN},
+		zmq.PollItem{Socket: v.evpubmonitor, Events: zmq.POLLIN},
 	}
+	monitored := []string{"", commandSocketName, pubSocketName}
 
 	pubchan := make(chan eventstore.StoredEvent)
-	estore.RegisterPublishedEventsChannel(pubchan)
-	go publishAllSavedEvents(pubchan, evpubsock)
-	defer close(pubchan)
+	estore.RegisterAllPublishedEventsChannel(pubchan)
+	pubDone := make(chan bool)
+	go func() {
+		defer close(pubDone)
+		publishAllSavedEvents(pubchan, evpubsock)
+	}()
+	defer func() {
+		// Unregistering while the channel still is being drained,
+		// and before closing it, so that no event is pushed to a
+		// closed channel.
+		estore.UnregisterPublishedEventsChannel(pubchan)
+		close(pubchan)
+		<-pubDone
+	}()
 
 	pollchan := make(chan zmqPollResult)
 	respchan := make(chan zMsg)
@@ -288,7 +390,20 @@ stop chan bool) {
 			if res.err == nil && toPoll[0].REvents&zmq.POLLIN != 0 {
 				msg, _ := toPoll[0].Socket.RecvMultipart(0)
 				zmsg := zMsg(msg)
-				go handleRequest(respchan, estore, zmsg)
+				go v.handleRequest(respchan, zmsg)
+			}
+			for i := 1; res.err == nil && i < len(toPoll); i++ {
+				if toPoll[i].REvents&zmq.POLLIN == 0 {
+					continue
+				}
+				msg, err := toPoll[i].Socket.RecvMultipart(0)
+				if err != nil {
+					log.Println("Could not receive monitor event:", err)
+					continue
+				}
+				if event, ok := parseMonitorEvent(msg); ok {
+					v.clients.connectionEvent(monitored[i], event)
+				}
 			}
 			go asyncPoll(pollchan, toPoll, pollCancel)
 		case frames := <-respchan:
@@ -307,11 +422,15 @@ stop chan bool) {
 // Pops previously stored messages off a channel and published them to a
 // ZeroMQ socket.
 func publishAllSavedEvents(toPublish chan eventstore.StoredEvent, evpub zmq.Socket) {
-	msg := make(zMsg, 3)
 	for stored := range(toPublish) {
-		msg[0] = stored.Event.Stream
-		msg[1] = stored.Id
-		msg[2] = stored.Event.Data
+		msg := zMsg{
+			pubTopic(stored),
+			stored.Id,
+			stored.Event.Data,
+		}
+		if stored.Redacted {
+			msg = append(msg, zFrame("REDACTED"))
+		}
 
 		if err := evpub.SendMultipart(msg, 0); err != nil {
 			log.Println(err)
@@ -319,6 +438,17 @@ func publishAllSavedEvents(toPublish chan eventstore.StoredEvent, evpub zmq.Sock
 	}
 }
 
+// The first frame of a published event. This is the stream name for
+// the default tenant, and "@tenant/stream" for other tenants. This
+// makes it possible to subscribe to the events of a single tenant.
+func pubTopic(stored eventstore.StoredEvent) []byte {
+	if stored.Tenant == "" {
+		return stored.Event.Stream
+	}
+	topic := []byte("@" + stored.Tenant + "/")
+	return append(topic, stored.Event.Stream...)
+}
+
 // A single frame in a ZeroMQ message.
 type zFrame []byte
 
@@ -335,64 +465,188 @@ type zMsg [][]byte
 // The full request message stored in `msg` and the full ZeroMQ response
 // is pushed to `respchan`. The function does not return any error
 // because it is expected to be called asynchronously as a goroutine.
-func handleRequest(respchan chan zMsg, estore *eventstore.EventStore, msg zMsg) {
-
-	// TODO: Rename to 'framelist'
+func (v *Server) handleRequest(respchan chan zMsg, msg zMsg) {
 	parts := list.New()
 	for _, msgpart := range msg {
-		parts.PushBack(msgpart)
+		parts.PushBack(zFrame(msgpart))
 	}
 
+	// The envelope is everything up to, and including, the first empty
+	// frame.
 	resptemplate := list.New()
 	emptyFrame := zFrame("")
-	for true {
-		resptemplate.PushBack(parts.Remove(parts.Front()))
+	for parts.Len() > 0 {
+		frame := parts.Remove(parts.Front()).(zFrame)
+		resptemplate.PushBack(frame)
 
-		if bytes.Equal(parts.Front().Value.(zFrame), emptyFrame) {
+		if bytes.Equal(frame, emptyFrame) {
 			break
 		}
 	}
 
 	if parts.Len() == 0 {
 		errstr := "Incoming command was empty. Ignoring it."
-		log.Println(errstr)
-		response := copyList(resptemplate)
-		response.PushBack(zFrame("ERROR " + errstr))
-		respchan <- listToFrames(response)
+		sendError(respchan, resptemplate, errstr)
 		return
 	}
 
-	command := string(parts.Front().Value.(zFrame))
+	v.stats.increment("requests")
+
+	req := &Request{
+		ClientId: clientId(resptemplate),
+	}
+	// Prefixes of two frames each, in any order, may precede the
+	// command.
+	for {
+		prefix := string(parts.Front().Value.(zFrame))
+		if prefix != "TENANT" && prefix != "SNAPSHOT" &&
+		prefix != "MIN_POSITION" && prefix != "FENCE" {
+			break
+		}
+		parts.Remove(parts.Front())
+		if parts.Len() < 2 {
+			errstr := "Wrong number of frames for " + prefix + "."
+			sendError(respchan, resptemplate, errstr)
+			return
+		}
+		value := parts.Remove(parts.Front()).(zFrame)
+		switch prefix {
+		case "TENANT":
+			req.Tenant = string(value)
+		case "SNAPSHOT":
+			req.Snapshot = string(value)
+		case "MIN_POSITION":
+			req.MinPosition = nilIfEmpty(value)
+		case "FENCE":
+			req.Fence = string(value)
+		}
+	}
+	req.Command = string(parts.Remove(parts.Front()).(zFrame))
+	req.Frames = listToFrames(parts)
+
+	handler := func(req *Request, resp Responder) {
+		v.handleCommand(req, resp, resptemplate)
+	}
+	middlewares := v.params.Middlewares
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	handler = v.clients.track(handler)
+	handler(req, &responder{respchan, resptemplate})
+}
+
+// Handles a request that has passed all middlewares. Responses are
+// passed on to `resp`. `resptemplate` is the envelope of the request.
+func (v *Server) handleCommand(req *Request, resp Responder, resptemplate *list.List) {
+	// The handlers below send complete messages, envelope included.
+	respchan := make(chan zMsg)
+	forwarded := make(chan bool)
+	go func() {
+		for msg := range respchan {
+			resp.Send(msg[resptemplate.Len():]...)
+		}
+		forwarded <- true
+	}()
+	defer func() {
+		close(respchan)
+		<-forwarded
+	}()
+
+	estore, err := v.params.Store.Tenant(req.Tenant)
+	if err != nil {
+		sendError(respchan, resptemplate, err.Error())
+		return
+	}
+
+	// TODO: Rename to 'framelist'
+	parts := list.New()
+	parts.PushBack(zFrame(req.Command))
+	for _, frame := range req.Frames {
+		parts.PushBack(zFrame(frame))
+	}
+
+	command := req.Command
+	if estore.TenantName() != "" && defaultTenantCommands[command] {
+		errstr := command + " is not supported for tenants."
+		sendError(respchan, resptemplate, errstr)
+		return
+	}
+	var fence eventstore.FencingToken
+	if req.Fence != "" {
+		if command != "PUBLISH" {
+			errstr := command + " can't be fenced."
+			sendError(respchan, resptemplate, errstr)
+			return
+		}
+		var err error
+		if fence, err = parseFencingToken(req.Fence); err != nil {
+			sendError(respchan, resptemplate, err.Error())
+			return
+		}
+	}
+	if req.MinPosition != nil {
+		if !readCommands[command] {
+			errstr := command + " can't wait for a position."
+			sendError(respchan, resptemplate, errstr)
+			return
+		}
+		position := eventstore.Position(req.MinPosition)
+		if err := estore.WaitForPosition(position, v.positionTimeout()); err != nil {
+			sendError(respchan, resptemplate, err.Error())
+			return
+		}
+	}
+	if req.Snapshot != "" {
+		if !readCommands[command] {
+			errstr := command + " can't be used with a snapshot."
+			sendError(respchan, resptemplate, errstr)
+			return
+		}
+		snapshot, err := v.snapshots.acquire(req.Snapshot, estore.TenantName())
+		if err != nil {
+			sendError(respchan, resptemplate, err.Error())
+			return
+		}
+		defer v.snapshots.release(req.Snapshot, v.snapshotTimeout())
+		estore = snapshot.EventStore
+	}
 	switch command {
 	case "PUBLISH":
 		parts.Remove(parts.Front())
 		if parts.Len() != 2 {
 			// TODO: Constantify this error message
 			errstr := "Wrong number of frames for PUBLISH."
-			log.Println(errstr)
-			response := copyList(resptemplate)
-			response.PushBack(zFrame("ERROR " + errstr))
-			respchan <- listToFrames(response)
+			sendError(respchan, resptemplate, errstr)
 		} else {
 			estream := parts.Remove(parts.Front())
 			data := parts.Remove(parts.Front())
 			newevent := eventstore.Event{
-				estream.(eventstore.StreamName),
-				data.(zFrame),
+				Stream: eventstore.StreamName(estream.(zFrame)),
+				Data: data.(zFrame),
+			}
+			var stored eventstore.StoredEvent
+			var err error
+			if fence != 0 {
+				stored, err = estore.AppendFenced(newevent, fence)
+			} else {
+				stored, err = estore.Append(newevent)
+			}
+			if err == eventstore.ErrQuotaExceeded || err == eventstore.ErrStreamQuotaExceeded {
+				v.stats.increment("quota_rejections")
 			}
-			newId, err := estore.Add(newevent)
 			if err != nil {
-				sErr := err.Error()
-				log.Println(sErr)
-
-				response := copyList(resptemplate)
-				response.PushBack(zFrame("ERROR " + sErr))
-				respchan <- listToFrames(response)
+				sendError(respchan, resptemplate, err.Error())
 			} else {
 				// the event was added
+				v.stats.increment("published")
+				if v.params.AuditPublish {
+					v.audit(estore, req,
+					estream.(zFrame), stored.Id)
+				}
 				response := copyList(resptemplate)
 				response.PushBack(zFrame("PUBLISHED"))
-				response.PushBack(zFrame(newId))
+				response.PushBack(zFrame(stored.Id))
+				response.PushBack(zFrame(stored.Position))
 				respchan <- listToFrames(response)
 			}
 		}
@@ -401,10 +655,7 @@ func handleRequest(respchan chan zMsg, estore *eventstore.EventStore, msg zMsg)
 		if parts.Len() != 3 {
 			// TODO: Constantify this error message
 			errstr := "Wrong number of frames for QUERY."
-			log.Println(errstr)
-			response := copyList(resptemplate)
-			response.PushBack(zFrame("ERROR " + errstr))
-			respchan <- listToFrames(response)
+			sendError(respchan, resptemplate, errstr)
 		} else {
 			estream := parts.Remove(parts.Front())
 			fromid := parts.Remove(parts.Front())
@@ -412,24 +663,23 @@ func handleRequest(respchan chan zMsg, estore *eventstore.EventStore, msg zMsg)
 
 			req := eventstore.QueryRequest{
 				Stream: estream.(zFrame),
-				FromId: fromid.(zFrame),
-				ToId: toid.(zFrame),
+				FromId: nilIfEmpty(fromid.(zFrame)),
+				ToId: nilIfEmpty(toid.(zFrame)),
 			}
 			events, err := estore.Query(req)
+			v.stats.increment("queries")
 
 			if err != nil {
-				sErr := err.Error()
-				log.Println(sErr)
-
-				response := copyList(resptemplate)
-				response.PushBack(zFrame("ERROR " + sErr))
-				respchan <- listToFrames(response)
+				sendError(respchan, resptemplate, err.Error())
 			} else {
 				for eventdata := range(events) {
 					response := copyList(resptemplate)
-					response.PushBack([]byte("EVENT"))
-					response.PushBack(eventdata.Id)
-					response.PushBack(eventdata.Data)
+					response.PushBack(zFrame("EVENT"))
+					response.PushBack(zFrame(eventdata.Id))
+					response.PushBack(zFrame(eventdata.Data))
+					if eventdata.Redacted {
+						response.PushBack(zFrame("REDACTED"))
+					}
 
 					respchan <- listToFrames(response)
 				}
@@ -438,19 +688,712 @@ func handleRequest(respchan chan zMsg, estore *eventstore.EventStore, msg zMsg)
 				respchan <- listToFrames(response)
 			}
 		}
+	case "STREAMS":
+		parts.Remove(parts.Front())
+		if parts.Len() != 2 {
+			errstr := "Wrong number of frames for STREAMS."
+			sendError(respchan, resptemplate, errstr)
+			return
+		}
+		args := listToFrames(parts)
+		maxItems := defaultMaxStreams
+		if len(args[1]) > 0 {
+			var err error
+			maxItems, err = strconv.Atoi(string(args[1]))
+			if err != nil {
+				sendError(respchan, resptemplate, err.Error())
+				return
+			}
+		}
+		for stream := range estore.ListStreams(nilIfEmpty(args[0]), maxItems) {
+			frames := []zFrame{zFrame("STREAM"), zFrame(stream)}
+			meta, err := estore.StreamMetadata(stream)
+			if err != nil {
+				log.Println("Could not load stream metadata:", err)
+			}
+			if meta.Sealed {
+				frames = append(frames, zFrame("SEALED"))
+			}
+			sendResponse(respchan, resptemplate, frames...)
+		}
+		sendResponse(respchan, resptemplate, zFrame("END"))
+	case "STATS":
+		parts.Remove(parts.Front())
+		stats := append(v.stats.list(), stat{
+			"soft_quota_warnings",
+			strconv.FormatInt(estore.SoftQuotaWarnings(), 10),
+		})
+		readOnly := "0"
+		if estore.ReadOnly() {
+			readOnly = "1"
+		}
+		stats = append(stats, stat{"read_only", readOnly})
+		stats = append(stats, stat{
+			"open_snapshots",
+			strconv.Itoa(v.snapshots.count()),
+		})
+		stats = append(stats, v.clients.stats()...)
+		props, err := estore.Properties()
+		if err != nil {
+			sendError(respchan, resptemplate, err.Error())
+			return
+		}
+		for name, value := range props {
+			stats = append(stats, stat{name, value})
+		}
+		sort.Sort(statsByName(stats))
+		for _, s := range stats {
+			sendResponse(respchan, resptemplate, zFrame("STAT"),
+			zFrame(s.name), zFrame(s.value))
+		}
+		sendResponse(respchan, resptemplate, zFrame("END"))
+	case "STREAM_STATS":
+		parts.Remove(parts.Front())
+		if parts.Len() != 2 {
+			errstr := "Wrong number of frames for STREAM_STATS."
+			sendError(respchan, resptemplate, errstr)
+			return
+		}
+		args := listToFrames(parts)
+		maxItems := defaultMaxStreams
+		if len(args[1]) > 0 {
+			var err error
+			maxItems, err = strconv.Atoi(string(args[1]))
+			if err != nil {
+				sendError(respchan, resptemplate, err.Error())
+				return
+			}
+		}
+		usages, err := estore.StreamUsages(nilIfEmpty(args[0]), maxItems)
+		if err != nil {
+			sendError(respchan, resptemplate, err.Error())
+			return
+		}
+		for _, u := range usages {
+			meta, err := estore.StreamMetadata(u.Stream)
+			if err != nil {
+				sendError(respchan, resptemplate, err.Error())
+				return
+			}
+			frames := []zFrame{zFrame("STREAM_STAT"), zFrame(u.Stream),
+			formatInt(u.Events), formatInt(u.Bytes)}
+			if meta.Sealed {
+				frames = append(frames, zFrame("SEALED"))
+			}
+			sendResponse(respchan, resptemplate, frames...)
+		}
+		sendResponse(respchan, resptemplate, zFrame("END"))
+	case "SCHEDULE":
+		parts.Remove(parts.Front())
+		if parts.Len() != 3 {
+			errstr := "Wrong number of frames for SCHEDULE."
+			sendError(respchan, resptemplate, errstr)
+			return
+		}
+		args := listToFrames(parts)
+		due, err := time.Parse(time.RFC3339, string(args[2]))
+		if err != nil {
+			sendError(respchan, resptemplate, err.Error())
+			return
+		}
+		newevent := eventstore.Event{
+			Stream: eventstore.StreamName(args[0]),
+			Data: args[1],
+		}
+		scheduleId, err := estore.Schedule(newevent, due)
+		if err != nil {
+			sendError(respchan, resptemplate, err.Error())
+			return
+		}
+		v.audit(estore, req, args[0], args[2],
+		scheduleId)
+		sendResponse(respchan, resptemplate, zFrame("SCHEDULED"),
+		zFrame(scheduleId))
+	case "CANCEL_SCHEDULE":
+		parts.Remove(parts.Front())
+		if parts.Len() != 1 {
+			errstr := "Wrong number of frames for CANCEL_SCHEDULE."
+			sendError(respchan, resptemplate, errstr)
+			return
+		}
+		scheduleId := parts.Remove(parts.Front()).(zFrame)
+		if err := estore.CancelSchedule(scheduleId); err != nil {
+			sendError(respchan, resptemplate, err.Error())
+			return
+		}
+		v.audit(estore, req, scheduleId)
+		sendResponse(respchan, resptemplate, zFrame("CANCELLED"))
+	case "WEBHOOK_ADD", "WEBHOOK_REMOVE", "WEBHOOK_LIST", "WEBHOOK_DEADLETTERS":
+		parts.Remove(parts.Front())
+		v.handleWebhookRequest(respchan, resptemplate, req, parts)
+	case "PARKED_LIST", "PARKED_REPLAY", "PARKED_DISCARD":
+		parts.Remove(parts.Front())
+		v.handleParkedRequest(respchan, resptemplate, req, parts)
+	case "REDACT":
+		parts.Remove(parts.Front())
+		if parts.Len() != 3 {
+			errstr := "Wrong number of frames for REDACT."
+			sendError(respchan, resptemplate, errstr)
+			return
+		}
+		args := listToFrames(parts)
+		err := estore.Redact(eventstore.StreamName(args[0]),
+		eventstore.EventId(args[1]), args[2])
+		if err != nil {
+			sendError(respchan, resptemplate, err.Error())
+			return
+		}
+		// Leaving out the replacement data, which could be
+		// anything.
+		v.audit(estore, req, args[0], args[1])
+		sendResponse(respchan, resptemplate, zFrame("REDACTED"))
+	case "ACQUIRE":
+		parts.Remove(parts.Front())
+		if parts.Len() != 2 {
+			errstr := "Wrong number of frames for ACQUIRE."
+			sendError(respchan, resptemplate, errstr)
+			return
+		}
+		args := listToFrames(parts)
+		ttl, err := time.ParseDuration(string(args[1]))
+		if err != nil {
+			sendError(respchan, resptemplate, err.Error())
+			return
+		}
+		lease, err := estore.AcquireLease(eventstore.StreamName(args[0]), ttl)
+		if err != nil {
+			sendError(respchan, resptemplate, err.Error())
+			return
+		}
+		token := formatFencingToken(lease.Token)
+		v.audit(estore, req, args[0], args[1], token)
+		sendResponse(respchan, resptemplate, zFrame("ACQUIRED"), token)
+	case "RENEW", "RELEASE":
+		parts.Remove(parts.Front())
+		nframes := 2
+		if command == "RENEW" {
+			nframes = 3
+		}
+		if parts.Len() != nframes {
+			errstr := "Wrong number of frames for " + command + "."
+			sendError(respchan, resptemplate, errstr)
+			return
+		}
+		args := listToFrames(parts)
+		stream := eventstore.StreamName(args[0])
+		token, err := parseFencingToken(string(args[1]))
+		if err != nil {
+			sendError(respchan, resptemplate, err.Error())
+			return
+		}
+		reply := "RELEASED"
+		if command == "RENEW" {
+			var ttl time.Duration
+			if ttl, err = time.ParseDuration(string(args[2])); err == nil {
+				_, err = estore.RenewLease(stream, token, ttl)
+			}
+			reply = "RENEWED"
+		} else {
+			err = estore.ReleaseLease(stream, token)
+		}
+		if err != nil {
+			sendError(respchan, resptemplate, err.Error())
+			return
+		}
+		v.audit(estore, req, args...)
+		sendResponse(respchan, resptemplate, zFrame(reply))
+	case "SEAL_STREAM":
+		parts.Remove(parts.Front())
+		if parts.Len() != 1 {
+			errstr := "Wrong number of frames for SEAL_STREAM."
+			sendError(respchan, resptemplate, errstr)
+			return
+		}
+		stream := parts.Remove(parts.Front()).(zFrame)
+		if err := estore.SealStream(eventstore.StreamName(stream)); err != nil {
+			sendError(respchan, resptemplate, err.Error())
+			return
+		}
+		v.audit(estore, req, stream)
+		sendResponse(respchan, resptemplate, zFrame("STREAM_SEALED"))
+	case "CLIENTS":
+		parts.Remove(parts.Front())
+		for _, client := range v.clients.list() {
+			sendResponse(respchan, resptemplate, zFrame("CLIENT"),
+			zFrame(client.id),
+			zFrame(strconv.FormatUint(client.requests, 10)),
+			zFrame(client.firstSeen.Format(time.RFC3339)),
+			zFrame(client.lastSeen.Format(time.RFC3339)))
+		}
+		sendResponse(respchan, resptemplate, zFrame("END"))
+	case "BLOCK_CLIENT", "UNBLOCK_CLIENT":
+		parts.Remove(parts.Front())
+		if parts.Len() != 1 {
+			errstr := "Wrong number of frames for " + command + "."
+			sendError(respchan, resptemplate, errstr)
+			return
+		}
+		id := parts.Remove(parts.Front()).(zFrame)
+		if command == "BLOCK_CLIENT" {
+			if string(id) == req.ClientId {
+				sendError(respchan, resptemplate, "Can't block yourself.")
+				return
+			}
+			v.clients.block(string(id))
+			v.audit(estore, req, id)
+			sendResponse(respchan, resptemplate, zFrame("CLIENT_BLOCKED"))
+		} else {
+			if !v.clients.unblock(string(id)) {
+				sendError(respchan, resptemplate, "Client has not been blocked.")
+				return
+			}
+			v.audit(estore, req, id)
+			sendResponse(respchan, resptemplate, zFrame("CLIENT_UNBLOCKED"))
+		}
+	case "SNAPSHOT_OPEN":
+		parts.Remove(parts.Front())
+		if parts.Len() != 0 {
+			errstr := "Wrong number of frames for SNAPSHOT_OPEN."
+			sendError(respchan, resptemplate, errstr)
+			return
+		}
+		token, err := v.snapshots.open(estore, v.snapshotTimeout())
+		if err != nil {
+			sendError(respchan, resptemplate, err.Error())
+			return
+		}
+		sendResponse(respchan, resptemplate, zFrame("SNAPSHOT"),
+		zFrame(token))
+	case "SNAPSHOT_CLOSE":
+		parts.Remove(parts.Front())
+		if parts.Len() != 1 {
+			errstr := "Wrong number of frames for SNAPSHOT_CLOSE."
+			sendError(respchan, resptemplate, errstr)
+			return
+		}
+		token := parts.Remove(parts.Front()).(zFrame)
+		if err := v.snapshots.close(string(token), estore.TenantName()); err != nil {
+			sendError(respchan, resptemplate, err.Error())
+			return
+		}
+		sendResponse(respchan, resptemplate, zFrame("SNAPSHOT_CLOSED"))
+	case "SET_READ_ONLY":
+		parts.Remove(parts.Front())
+		if parts.Len() != 1 {
+			errstr := "Wrong number of frames for SET_READ_ONLY."
+			sendError(respchan, resptemplate, errstr)
+			return
+		}
+		arg := parts.Remove(parts.Front()).(zFrame)
+		readOnly, err := strconv.ParseBool(string(arg))
+		if err != nil {
+			sendError(respchan, resptemplate, err.Error())
+			return
+		}
+		// The audit log can't be written to while read-only.
+		if readOnly {
+			v.audit(estore, req, arg)
+		}
+		if err := estore.SetReadOnly(readOnly); err != nil {
+			sendError(respchan, resptemplate, err.Error())
+			return
+		}
+		if !readOnly {
+			v.audit(estore, req, arg)
+		}
+		sendResponse(respchan, resptemplate, zFrame("READ_ONLY_SET"))
+	case "COMPACT":
+		parts.Remove(parts.Front())
+		if parts.Len() != 2 {
+			errstr := "Wrong number of frames for COMPACT."
+			sendError(respchan, resptemplate, errstr)
+			return
+		}
+		args := listToFrames(parts)
+		r := eventstore.StreamRange{
+			Start: nilIfEmpty(args[0]),
+			Limit: nilIfEmpty(args[1]),
+		}
+		if err := estore.Compact(r); err != nil {
+			sendError(respchan, resptemplate, err.Error())
+			return
+		}
+		v.audit(estore, req, args...)
+		sendResponse(respchan, resptemplate, zFrame("COMPACTED"))
+	case "COPY_STREAM", "RENAME_STREAM", "MERGE_STREAMS":
+		parts.Remove(parts.Front())
+		v.handleStreamAdminRequest(estore, respchan, resptemplate,
+		req, parts)
+	case "USAGE":
+		parts.Remove(parts.Front())
+		usage, err := estore.Usage()
+		if err != nil {
+			sendError(respchan, resptemplate, err.Error())
+			return
+		}
+		quota, err := estore.Quota()
+		if err != nil {
+			sendError(respchan, resptemplate, err.Error())
+			return
+		}
+		sendResponse(respchan, resptemplate, zFrame("USAGE"),
+		formatInt(usage.Events), formatInt(usage.Bytes),
+		formatInt(quota.MaxEvents), formatInt(quota.MaxBytes))
+	case "SET_QUOTA":
+		parts.Remove(parts.Front())
+		if parts.Len() < 3 {
+			errstr := "Wrong number of frames for SET_QUOTA."
+			sendError(respchan, resptemplate, errstr)
+			return
+		}
+		args := listToFrames(parts)
+		tenant, err := estore.Tenant(string(args[0]))
+		if err != nil {
+			sendError(respchan, resptemplate, err.Error())
+			return
+		}
+		quota, err := parseQuota(args[1:])
+		if err != nil {
+			sendError(respchan, resptemplate, err.Error())
+			return
+		}
+		if err := tenant.SetQuota(quota); err != nil {
+			sendError(respchan, resptemplate, err.Error())
+			return
+		}
+		v.audit(estore, req, args...)
+		sendResponse(respchan, resptemplate, zFrame("QUOTA_SET"))
 	default:
 		// TODO: Move these error strings out as constants of
 		//       this package.
 
-		// TODO: Move the chunk of code below into a separate
-		// function and reuse for similar piece of code above.
 		// TODO: Constantify this error message
 		errstr := "Unknown request type."
-		log.Println(errstr)
-		response := copyList(resptemplate)
-		response.PushBack(zFrame("ERROR " + errstr))
-		respchan <- listToFrames(response)
+		sendError(respchan, resptemplate, errstr)
+	}
+}
+
+// Handles the webhook commands. `parts` holds the frames following the
+// command frame.
+func (v *Server) handleWebhookRequest(respchan chan zMsg, resptemplate *list.List, req *Request, parts *list.List) {
+	command := req.Command
+	webhooks := v.params.Webhooks
+	if webhooks == nil {
+		errstr := "Webhooks are not enabled."
+		sendError(respchan, resptemplate, errstr)
+		return
+	}
+
+	expectedFrames := map[string]int{
+		"WEBHOOK_ADD": 3,
+		"WEBHOOK_REMOVE": 1,
+		"WEBHOOK_LIST": 0,
+		"WEBHOOK_DEADLETTERS": 1,
+	}
+	// WEBHOOK_ADD takes an optional replay frame.
+	if parts.Len() != expectedFrames[command] &&
+	!(command == "WEBHOOK_ADD" && parts.Len() == 4) {
+		errstr := "Wrong number of frames for " + command + "."
+		sendError(respchan, resptemplate, errstr)
+		return
+	}
+	args := listToFrames(parts)
+
+	switch command {
+	case "WEBHOOK_ADD":
+		replay := false
+		if len(args) == 4 {
+			var err error
+			if replay, err = strconv.ParseBool(string(args[3])); err != nil {
+				sendError(respchan, resptemplate, err.Error())
+				return
+			}
+		}
+		w, err := webhooks.Register(string(args[0]), args[1], args[2],
+		replay)
+		if err != nil {
+			sendError(respchan, resptemplate, err.Error())
+			return
+		}
+		// Never recording the secret.
+		v.audit(v.params.Store, req, []byte(w.Id),
+		args[0], args[1], []byte(strconv.FormatBool(replay)))
+		sendResponse(respchan, resptemplate, zFrame("WEBHOOK_ADDED"),
+		zFrame(w.Id))
+	case "WEBHOOK_REMOVE":
+		if err := webhooks.Unregister(string(args[0])); err != nil {
+			sendError(respchan, resptemplate, err.Error())
+			return
+		}
+		v.audit(v.params.Store, req, args[0])
+		sendResponse(respchan, resptemplate, zFrame("WEBHOOK_REMOVED"))
+	case "WEBHOOK_LIST":
+		subscriptions, err := webhooks.List()
+		if err != nil {
+			sendError(respchan, resptemplate, err.Error())
+			return
+		}
+		for _, w := range subscriptions {
+			sendResponse(respchan, resptemplate, zFrame("WEBHOOK"),
+			zFrame(w.Id), zFrame(w.URL), zFrame(w.StreamPrefix))
+		}
+		sendResponse(respchan, resptemplate, zFrame("END"))
+	case "WEBHOOK_DEADLETTERS":
+		deadLetters, err := webhooks.DeadLetters(string(args[0]))
+		if err != nil {
+			sendError(respchan, resptemplate, err.Error())
+			return
+		}
+		for _, dl := range deadLetters {
+			sendResponse(respchan, resptemplate, zFrame("DEADLETTER"),
+			zFrame(dl.Stream), zFrame(dl.Id), zFrame(dl.Error))
+		}
+		sendResponse(respchan, resptemplate, zFrame("END"))
+	}
+}
+
+// Find a server-managed connector by name. Returns nil if there is
+// none.
+func (v *Server) lookupConnector(name string) *connector.Connector {
+	for _, conn := range v.params.Connectors {
+		if conn.Name == name {
+			return conn
+		}
+	}
+	if v.params.Webhooks != nil {
+		return v.params.Webhooks.Lookup(name)
+	}
+	return nil
+}
+
+// Handles the commands dealing with parked events. `parts` holds the
+// frames following the command frame.
+func (v *Server) handleParkedRequest(respchan chan zMsg, resptemplate *list.List, req *Request, parts *list.List) {
+	command := req.Command
+	expectedFrames := map[string]int{
+		"PARKED_LIST": 1,
+		"PARKED_REPLAY": 2,
+		"PARKED_DISCARD": 2,
+	}
+	if parts.Len() != expectedFrames[command] {
+		errstr := "Wrong number of frames for " + command + "."
+		sendError(respchan, resptemplate, errstr)
+		return
+	}
+	args := listToFrames(parts)
+
+	conn := v.lookupConnector(string(args[0]))
+	if conn == nil {
+		errstr := "No such subscription: " + string(args[0])
+		sendError(respchan, resptemplate, errstr)
+		return
+	}
+
+	switch command {
+	case "PARKED_LIST":
+		parked, err := conn.Parked()
+		if err != nil {
+			sendError(respchan, resptemplate, err.Error())
+			return
+		}
+		for _, p := range parked {
+			sendResponse(respchan, resptemplate, zFrame("PARKED"),
+			zFrame(p.ParkId), zFrame(p.Stream), zFrame(p.Id),
+			zFrame(strconv.Itoa(p.Attempts)), zFrame(p.Error))
+		}
+		sendResponse(respchan, resptemplate, zFrame("END"))
+	case "PARKED_REPLAY":
+		if err := conn.Replay(args[1]); err != nil {
+			sendError(respchan, resptemplate, err.Error())
+			return
+		}
+		v.audit(v.params.Store, req, args...)
+		sendResponse(respchan, resptemplate, zFrame("REPLAYED"))
+	case "PARKED_DISCARD":
+		if err := conn.Discard(args[1]); err != nil {
+			sendError(respchan, resptemplate, err.Error())
+			return
+		}
+		v.audit(v.params.Store, req, args...)
+		sendResponse(respchan, resptemplate, zFrame("DISCARDED"))
+	}
+}
+
+// Handles the commands that copy, rename and merge streams. `parts`
+// holds the frames following the command frame.
+func (v *Server) handleStreamAdminRequest(estore *eventstore.EventStore, respchan chan zMsg, resptemplate *list.List, req *Request, parts *list.List) {
+	command := req.Command
+	args := listToFrames(parts)
+	if (command == "MERGE_STREAMS" && len(args) < 2) ||
+	(command != "MERGE_STREAMS" && len(args) != 2) {
+		errstr := "Wrong number of frames for " + command + "."
+		sendError(respchan, resptemplate, errstr)
+		return
+	}
+
+	var err error
+	var reply string
+	switch command {
+	case "COPY_STREAM":
+		err = estore.CopyStream(eventstore.StreamName(args[0]),
+		eventstore.StreamName(args[1]))
+		reply = "COPIED"
+	case "RENAME_STREAM":
+		err = estore.RenameStream(eventstore.StreamName(args[0]),
+		eventstore.StreamName(args[1]))
+		reply = "RENAMED"
+	case "MERGE_STREAMS":
+		sources := make([]eventstore.StreamName, 0, len(args)-1)
+		for _, arg := range args[1:] {
+			sources = append(sources, eventstore.StreamName(arg))
+		}
+		err = estore.MergeStreams(eventstore.StreamName(args[0]),
+		sources...)
+		reply = "MERGED"
+	}
+	if err != nil {
+		sendError(respchan, resptemplate, err.Error())
+		return
+	}
+	v.audit(estore, req, args...)
+	sendResponse(respchan, resptemplate, zFrame(reply))
+}
+
+// Parse a fencing token given as an ASCII decimal.
+func parseFencingToken(s string) (eventstore.FencingToken, error) {
+	token, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, errors.New("Malformed fencing token.")
+	}
+	return eventstore.FencingToken(token), nil
+}
+
+// Format a fencing token as an ASCII decimal.
+func formatFencingToken(token eventstore.FencingToken) zFrame {
+	return zFrame(strconv.FormatUint(uint64(token), 10))
+}
+
+// How long requests wait for a commit position.
+func (v *Server) positionTimeout() time.Duration {
+	if v.params.PositionTimeout == 0 {
+		return DefaultPositionTimeout
+	}
+	return v.params.PositionTimeout
+}
+
+// How long snapshots are kept after they were last used.
+func (v *Server) snapshotTimeout() time.Duration {
+	if v.params.SnapshotTimeout == 0 {
+		return DefaultSnapshotTimeout
+	}
+	return v.params.SnapshotTimeout
+}
+
+// Record a successful command in the audit log of a tenant, on behalf of
+// the client of the request as middlewares left it. `args` are the
+// arguments that are safe to keep forever.
+func (v *Server) audit(estore *eventstore.EventStore, req *Request, args ...[]byte) {
+	entry := eventstore.AuditEntry{
+		Client: req.ClientId,
+		Action: req.Command,
+	}
+	for _, arg := range args {
+		entry.Arguments = append(entry.Arguments, auditArgument(arg))
+	}
+	if err := estore.Audit(entry); err != nil {
+		log.Println("Could not write to the audit log:", err)
+	}
+}
+
+// The identity of the client that sent a request, hex encoded. This is
+// the first frame of the ROUTER envelope. Empty if there is no
+// envelope.
+func clientId(resptemplate *list.List) string {
+	if resptemplate.Len() < 2 {
+		return ""
+	}
+	return hex.EncodeToString(resptemplate.Front().Value.(zFrame))
+}
+
+// Render a command argument for the audit log. Arguments that aren't
+// printable text, such as most event ids, are hex encoded and prefixed
+// with "0x".
+func auditArgument(arg []byte) string {
+	if utf8.Valid(arg) {
+		printable := true
+		for _, r := range string(arg) {
+			if !unicode.IsPrint(r) {
+				printable = false
+				break
+			}
+		}
+		if printable && !bytes.HasPrefix(arg, []byte("0x")) {
+			return string(arg)
+		}
+	}
+	return "0x" + hex.EncodeToString(arg)
+}
+
+// Push a single response message made up of the envelope in
+// `resptemplate` followed by `frames`.
+func sendResponse(respchan chan zMsg, resptemplate *list.List, frames ...zFrame) {
+	response := copyList(resptemplate)
+	for _, frame := range frames {
+		response.PushBack(frame)
+	}
+	respchan <- listToFrames(response)
+}
+
+// Log an error and push it as an error response.
+func sendError(respchan chan zMsg, resptemplate *list.List, errstr string) {
+	log.Println(errstr)
+	sendResponse(respchan, resptemplate, zFrame("ERROR " + errstr))
+}
+
+// Parse the frames of SET_QUOTA. The hard limits of the tenant come
+// first, followed by optional "name=value" frames for the other limits.
+func parseQuota(args zMsg) (eventstore.Quota, error) {
+	var quota eventstore.Quota
+	limits := map[string]*int64{
+		"soft-max-events": &quota.SoftMaxEvents,
+		"soft-max-bytes": &quota.SoftMaxBytes,
+		"stream-max-events": &quota.StreamMaxEvents,
+		"stream-max-bytes": &quota.StreamMaxBytes,
+		"stream-soft-max-events": &quota.StreamSoftMaxEvents,
+		"stream-soft-max-bytes": &quota.StreamSoftMaxBytes,
+	}
+
+	var err error
+	if quota.MaxEvents, err = strconv.ParseInt(string(args[0]), 10, 64); err != nil {
+		return quota, err
+	}
+	if quota.MaxBytes, err = strconv.ParseInt(string(args[1]), 10, 64); err != nil {
+		return quota, err
+	}
+	for _, arg := range args[2:] {
+		pieces := strings.SplitN(string(arg), "=", 2)
+		limit, known := limits[pieces[0]]
+		if len(pieces) != 2 || !known {
+			return quota, errors.New("Unknown quota limit: " + string(arg))
+		}
+		if *limit, err = strconv.ParseInt(pieces[1], 10, 64); err != nil {
+			return quota, err
+		}
+	}
+	return quota, nil
+}
+
+// Format an integer as a frame.
+func formatInt(i int64) zFrame {
+	return zFrame(strconv.FormatInt(i, 10))
+}
+
+// Empty optional frames are treated as missing.
+func nilIfEmpty(frame zFrame) []byte {
+	if len(frame) == 0 {
+		return nil
 	}
+	return frame
 }
 
 // Convert a doubly linked list of message frames to a slice of message
@@ -460,6 +1403,7 @@ func listToFrames(l *list.List) zMsg {
 	i := 0
 	for e := l.Front(); e != nil; e = e.Next() {
 		frames[i] = e.Value.(zFrame)
+		i++
 	}
 	return frames
 }
@@ -21,16 +21,23 @@ import (
 	"testing"
 	"strings"
 	"math/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+	"github.com/JensRantil/gorewind/connector"
 	zmq "github.com/alecthomas/gozmq"
 	"github.com/JensRantil/gorewind/eventstore"
 	"github.com/syndtr/goleveldb/leveldb/storage"
-	//"time"
 )
 
 
 func setupInMemoryeventstore() *eventstore.EventStore {
 	stor := &storage.MemStorage{}
-	es, err := eventstore.New(stor)
+	es, err := eventstore.New(stor, nil)
 	if err != nil {
 		panic(err)
 	}
@@ -138,6 +145,34 @@ func TestStartStart(t *testing.T) {
 	}
 }
 
+// Events added after the server has stopped must neither be pushed to
+// the closed publishing channel nor block.
+func TestAddAfterStop(t *testing.T) {
+	t.Parallel()
+
+	estore := setupInMemoryeventstore()
+	_, serv := getTestServer(estore)
+	defer serv.Close()
+	startStopServer(t, serv)
+
+	added := make(chan error, 1)
+	go func() {
+		_, err := estore.Add(eventstore.Event{
+			Stream: eventstore.StreamName("mystream"),
+			Data: []byte("data"),
+		})
+		added <- err
+	}()
+	select {
+	case err := <-added:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Adding blocked on the stopped server.")
+	}
+}
+
 func TestUnknownCommand(t *testing.T) {
 }
 
@@ -159,3 +194,804 @@ func TestMalformedQuery(t *testing.T) {
 
 func TestQueryingNonExistingEvent(t *testing.T) {
 }
+
+// Run a request through Server.handleRequest and return all responses
+// with the envelope stripped.
+func handleTestRequest(serv *Server, frames ...string) []zMsg {
+	return handleClientRequest(serv, "clientid", frames...)
+}
+
+// Like handleTestRequest, but for a specific client identity.
+func handleClientRequest(serv *Server, client string, frames ...string) []zMsg {
+	msg := zMsg{[]byte(client), []byte("")}
+	for _, frame := range frames {
+		msg = append(msg, []byte(frame))
+	}
+
+	respchan := make(chan zMsg)
+	go func() {
+		serv.handleRequest(respchan, msg)
+		close(respchan)
+	}()
+
+	responses := make([]zMsg, 0)
+	for resp := range respchan {
+		responses = append(responses, resp[2:])
+	}
+	return responses
+}
+
+func TestWebhookCommands(t *testing.T) {
+	t.Parallel()
+
+	received := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}
+	ts := httptest.NewServer(http.HandlerFunc(handler))
+	defer ts.Close()
+
+	estore := setupInMemoryeventstore()
+	webhooks := connector.NewWebhookManager(estore)
+	if err := webhooks.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer webhooks.Stop()
+	serv := &Server{
+		params: InitParams{
+			Store: estore,
+			Webhooks: webhooks,
+		},
+	}
+
+	resps := handleTestRequest(serv, "WEBHOOK_ADD", ts.URL, "orders", "secret")
+	if len(resps) != 1 || string(resps[0][0]) != "WEBHOOK_ADDED" {
+		t.Fatal("Unexpected response:", resps)
+	}
+	id := string(resps[0][1])
+
+	resps = handleTestRequest(serv, "WEBHOOK_LIST")
+	if len(resps) != 2 || string(resps[0][1]) != id {
+		t.Error("Webhook was not listed:", resps)
+	}
+	if string(resps[len(resps)-1][0]) != "END" {
+		t.Error("Listing was not terminated.")
+	}
+
+	handleTestRequest(serv, "PUBLISH", "other", "ignored")
+	handleTestRequest(serv, "PUBLISH", "orders-1", "data")
+	select {
+	case req := <-received:
+		body := <-bodies
+		if string(body) != "data" {
+			t.Error("Wrong event was delivered:", string(body))
+		}
+		expected := connector.Signature([]byte("secret"),
+		req.Header.Get("X-Gorewind-Stream"),
+		req.Header.Get("X-Gorewind-Id"), body)
+		if req.Header.Get("X-Gorewind-Signature") != expected {
+			t.Error("Wrong signature.")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Event was never delivered.")
+	}
+
+	resps = handleTestRequest(serv, "WEBHOOK_DEADLETTERS", id)
+	if len(resps) != 1 || string(resps[0][0]) != "END" {
+		t.Error("Did not expect any dead letters:", resps)
+	}
+
+	resps = handleTestRequest(serv, "WEBHOOK_REMOVE", id)
+	if len(resps) != 1 || string(resps[0][0]) != "WEBHOOK_REMOVED" {
+		t.Error("Unexpected response:", resps)
+	}
+	resps = handleTestRequest(serv, "WEBHOOK_REMOVE", id)
+	if len(resps) != 1 || !strings.HasPrefix(string(resps[0][0]), "ERROR ") {
+		t.Error("Expected removing twice to fail:", resps)
+	}
+}
+
+func TestMalformedWebhookCommands(t *testing.T) {
+	t.Parallel()
+
+	serv := &Server{
+		params: InitParams{
+			Store: setupInMemoryeventstore(),
+		},
+	}
+	resps := handleTestRequest(serv, "WEBHOOK_LIST")
+	if len(resps) != 1 || !strings.HasPrefix(string(resps[0][0]), "ERROR ") {
+		t.Error("Expected an error when webhooks are disabled:", resps)
+	}
+
+	serv.params.Webhooks = connector.NewWebhookManager(serv.params.Store)
+	malformed := [][]string{
+		{"WEBHOOK_ADD", "http://localhost"},
+		{"WEBHOOK_ADD", "ftp://localhost", "", ""},
+		{"WEBHOOK_ADD", "http://localhost", "", "", "maybe"},
+		{"WEBHOOK_REMOVE"},
+		{"WEBHOOK_DEADLETTERS", "a", "b"},
+	}
+	for _, frames := range malformed {
+		resps := handleTestRequest(serv, frames...)
+		if len(resps) != 1 || !strings.HasPrefix(string(resps[0][0]), "ERROR ") {
+			t.Error("Expected an error for:", frames)
+		}
+	}
+}
+
+func TestParkedCommands(t *testing.T) {
+	t.Parallel()
+
+	estore := setupInMemoryeventstore()
+	conn := connector.New(estore, "failing", connector.NewExecSink("false"))
+	conn.MaxAttempts = 1
+	serv := &Server{
+		params: InitParams{
+			Store: estore,
+			Connectors: []*connector.Connector{conn},
+		},
+	}
+	handleTestRequest(serv, "PUBLISH", "mystream", "data")
+	conn.Start()
+
+	var resps []zMsg
+	deadline := time.Now().Add(5 * time.Second)
+	for len(resps) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		resps = handleTestRequest(serv, "PARKED_LIST", "failing")
+	}
+	if err := conn.Stop(); err != nil {
+		t.Error(err)
+	}
+	if len(resps) != 2 || string(resps[0][0]) != "PARKED" {
+		t.Fatal("Event was not parked:", resps)
+	}
+	parkId := string(resps[0][1])
+	if string(resps[0][2]) != "mystream" || string(resps[0][4]) != "1" {
+		t.Error("Wrong parked event:", resps[0])
+	}
+
+	resps = handleTestRequest(serv, "PARKED_REPLAY", "failing", parkId)
+	if len(resps) != 1 || !strings.HasPrefix(string(resps[0][0]), "ERROR ") {
+		t.Error("Expected replay to fail:", resps)
+	}
+	resps = handleTestRequest(serv, "PARKED_DISCARD", "failing", parkId)
+	if len(resps) != 1 || string(resps[0][0]) != "DISCARDED" {
+		t.Error("Unexpected response:", resps)
+	}
+	resps = handleTestRequest(serv, "PARKED_LIST", "failing")
+	if len(resps) != 1 || string(resps[0][0]) != "END" {
+		t.Error("Discarded event still parked:", resps)
+	}
+
+	resps = handleTestRequest(serv, "PARKED_LIST", "nonexisting")
+	if len(resps) != 1 || !strings.HasPrefix(string(resps[0][0]), "ERROR ") {
+		t.Error("Expected an error for unknown subscription:", resps)
+	}
+}
+
+func TestScheduleCommands(t *testing.T) {
+	t.Parallel()
+
+	serv := &Server{
+		params: InitParams{
+			Store: setupInMemoryeventstore(),
+		},
+	}
+	due := time.Now().Add(time.Hour).Format(time.RFC3339)
+	resps := handleTestRequest(serv, "SCHEDULE", "mystream", "data", due)
+	if len(resps) != 1 || string(resps[0][0]) != "SCHEDULED" {
+		t.Fatal("Unexpected response:", resps)
+	}
+	scheduleId := string(resps[0][1])
+
+	resps = handleTestRequest(serv, "CANCEL_SCHEDULE", scheduleId)
+	if len(resps) != 1 || string(resps[0][0]) != "CANCELLED" {
+		t.Error("Unexpected response:", resps)
+	}
+	resps = handleTestRequest(serv, "CANCEL_SCHEDULE", scheduleId)
+	if len(resps) != 1 || !strings.HasPrefix(string(resps[0][0]), "ERROR ") {
+		t.Error("Expected cancelling twice to fail:", resps)
+	}
+
+	malformed := [][]string{
+		{"SCHEDULE", "mystream", "data"},
+		{"SCHEDULE", "mystream", "data", "tomorrow"},
+		{"CANCEL_SCHEDULE"},
+	}
+	for _, frames := range malformed {
+		resps := handleTestRequest(serv, frames...)
+		if len(resps) != 1 || !strings.HasPrefix(string(resps[0][0]), "ERROR ") {
+			t.Error("Expected an error for:", frames)
+		}
+	}
+}
+
+func TestStreamsAndStatsCommands(t *testing.T) {
+	t.Parallel()
+
+	serv := &Server{
+		params: InitParams{
+			Store: setupInMemoryeventstore(),
+		},
+	}
+	for _, stream := range []string{"a", "b", "c"} {
+		handleTestRequest(serv, "PUBLISH", stream, "data")
+	}
+
+	resps := handleTestRequest(serv, "STREAMS", "b", "")
+	if len(resps) != 3 {
+		t.Fatal("Wrong number of responses:", resps)
+	}
+	if string(resps[0][1]) != "b" || string(resps[1][1]) != "c" {
+		t.Error("Wrong streams listed:", resps)
+	}
+	resps = handleTestRequest(serv, "STREAMS", "", "1")
+	if len(resps) != 2 || string(resps[0][1]) != "a" {
+		t.Error("Listing was not limited:", resps)
+	}
+
+	resps = handleTestRequest(serv, "STATS")
+	stats := make(map[string]string)
+	for _, resp := range resps {
+		if string(resp[0]) == "STAT" {
+			stats[string(resp[1])] = string(resp[2])
+		}
+	}
+	if stats["published"] != "3" {
+		t.Error("Wrong number of published events:", stats["published"])
+	}
+	if stats["requests"] != "6" {
+		t.Error("Wrong number of requests:", stats["requests"])
+	}
+	if _, exists := stats["leveldb.stats"]; !exists {
+		t.Error("LevelDB properties were not reported:", stats)
+	}
+	if string(resps[len(resps)-1][0]) != "END" {
+		t.Error("Stats were not terminated.")
+	}
+}
+
+func TestStreamAdminCommands(t *testing.T) {
+	t.Parallel()
+
+	serv := &Server{
+		params: InitParams{
+			Store: setupInMemoryeventstore(),
+		},
+	}
+	handleTestRequest(serv, "PUBLISH", "a", "1")
+	handleTestRequest(serv, "PUBLISH", "b", "2")
+
+	expectations := [][]string{
+		{"COPY_STREAM", "a", "c", "COPIED"},
+		{"RENAME_STREAM", "c", "d", "RENAMED"},
+		{"MERGE_STREAMS", "e", "b", "d", "MERGED"},
+	}
+	for _, exp := range expectations {
+		frames, expected := exp[:len(exp)-1], exp[len(exp)-1]
+		resps := handleTestRequest(serv, frames...)
+		if len(resps) != 1 || string(resps[0][0]) != expected {
+			t.Error("Unexpected response to", frames, ":", resps)
+		}
+	}
+
+	// The copy in d was committed after the event in b.
+	resps := handleTestRequest(serv, "QUERY", "e", "", "")
+	if len(resps) != 3 || string(resps[0][2]) != "2" || string(resps[1][2]) != "1" {
+		t.Error("Wrong merged stream:", resps)
+	}
+
+	malformed := [][]string{
+		{"COPY_STREAM", "a"},
+		{"RENAME_STREAM", "a", "b", "c"},
+		{"MERGE_STREAMS", "f"},
+		{"RENAME_STREAM", "a", "b"},
+		{"COPY_STREAM", "nonexisting", "f"},
+	}
+	for _, frames := range malformed {
+		resps := handleTestRequest(serv, frames...)
+		if len(resps) != 1 || !strings.HasPrefix(string(resps[0][0]), "ERROR ") {
+			t.Error("Expected an error for:", frames)
+		}
+	}
+}
+
+func TestRedactCommand(t *testing.T) {
+	t.Parallel()
+
+	serv := &Server{
+		params: InitParams{
+			Store: setupInMemoryeventstore(),
+		},
+	}
+	resps := handleTestRequest(serv, "PUBLISH", "mystream", "secret")
+	id := string(resps[0][1])
+
+	resps = handleTestRequest(serv, "REDACT", "mystream", id, "{}")
+	if len(resps) != 1 || string(resps[0][0]) != "REDACTED" {
+		t.Fatal("Unexpected response:", resps)
+	}
+	resps = handleTestRequest(serv, "QUERY", "mystream", "", "")
+	if len(resps) != 2 || len(resps[0]) != 4 {
+		t.Fatal("Unexpected query response:", resps)
+	}
+	if string(resps[0][2]) != "{}" || string(resps[0][3]) != "REDACTED" {
+		t.Error("Event was not redacted:", resps[0])
+	}
+
+	malformed := [][]string{
+		{"REDACT", "mystream", id},
+		{"REDACT", "mystream", "nonexisting", "{}"},
+	}
+	for _, frames := range malformed {
+		resps := handleTestRequest(serv, frames...)
+		if len(resps) != 1 || !strings.HasPrefix(string(resps[0][0]), "ERROR ") {
+			t.Error("Expected an error for:", frames)
+		}
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	t.Parallel()
+
+	serv := &Server{
+		params: InitParams{
+			Store: setupInMemoryeventstore(),
+			AuditPublish: true,
+		},
+	}
+	handleTestRequest(serv, "PUBLISH", "mystream", "data")
+	handleTestRequest(serv, "RENAME_STREAM", "mystream", "newstream")
+	handleTestRequest(serv, "RENAME_STREAM", "nonexisting", "other")
+
+	resps := handleTestRequest(serv, "PUBLISH", "$audit", "forged")
+	if len(resps) != 1 || !strings.HasPrefix(string(resps[0][0]), "ERROR ") {
+		t.Error("Expected publishing to the audit stream to fail:", resps)
+	}
+
+	resps = handleTestRequest(serv, "QUERY", "$audit", "", "")
+	if len(resps) != 3 {
+		t.Fatal("Wrong number of audit entries:", resps)
+	}
+	expected := []struct {
+		action string
+		arguments []string
+	}{
+		{"PUBLISH", []string{"mystream", "0x00"}},
+		{"RENAME_STREAM", []string{"mystream", "newstream"}},
+	}
+	for i, exp := range expected {
+		var entry eventstore.AuditEntry
+		if err := json.Unmarshal(resps[i][2], &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.Client != hex.EncodeToString([]byte("clientid")) {
+			t.Error("Wrong client:", entry.Client)
+		}
+		if entry.Action != exp.action || strings.Join(entry.Arguments, " ") != strings.Join(exp.arguments, " ") {
+			t.Error("Wrong audit entry:", entry)
+		}
+	}
+}
+
+func TestTenantCommands(t *testing.T) {
+	t.Parallel()
+
+	serv := &Server{
+		params: InitParams{
+			Store: setupInMemoryeventstore(),
+		},
+	}
+	handleTestRequest(serv, "PUBLISH", "mystream", "default")
+	resps := handleTestRequest(serv, "TENANT", "acme", "PUBLISH", "mystream", "acme")
+	if len(resps) != 1 || string(resps[0][0]) != "PUBLISHED" {
+		t.Fatal("Unexpected response:", resps)
+	}
+
+	resps = handleTestRequest(serv, "TENANT", "acme", "QUERY", "mystream", "", "")
+	if len(resps) != 2 || string(resps[0][2]) != "acme" {
+		t.Error("Wrong tenant events:", resps)
+	}
+	resps = handleTestRequest(serv, "QUERY", "mystream", "", "")
+	if len(resps) != 2 || string(resps[0][2]) != "default" {
+		t.Error("Wrong default events:", resps)
+	}
+
+	resps = handleTestRequest(serv, "SET_QUOTA", "acme", "1", "0")
+	if len(resps) != 1 || string(resps[0][0]) != "QUOTA_SET" {
+		t.Error("Unexpected response:", resps)
+	}
+	resps = handleTestRequest(serv, "TENANT", "acme", "PUBLISH", "mystream", "more")
+	if len(resps) != 1 || !strings.HasPrefix(string(resps[0][0]), "ERROR ") {
+		t.Error("Expected the quota to be exceeded:", resps)
+	}
+	resps = handleTestRequest(serv, "TENANT", "acme", "USAGE")
+	expected := []string{"USAGE", "1", "4", "1", "0"}
+	if len(resps) != 1 || len(resps[0]) != len(expected) {
+		t.Fatal("Unexpected response:", resps)
+	}
+	for i, frame := range expected {
+		if string(resps[0][i]) != frame {
+			t.Error("Wrong usage frame", i, ":", string(resps[0][i]))
+		}
+	}
+	// Recorded by the default tenant, which set the quota.
+	resps = handleTestRequest(serv, "QUERY", "$audit", "", "")
+	if len(resps) != 2 || !strings.Contains(string(resps[0][2]), "SET_QUOTA") {
+		t.Error("SET_QUOTA was not audited:", resps)
+	}
+	resps = handleTestRequest(serv, "TENANT", "acme", "QUERY", "$audit", "", "")
+	if len(resps) != 1 {
+		t.Error("SET_QUOTA was audited by the tenant:", resps)
+	}
+
+	malformed := [][]string{
+		{"TENANT", "acme"},
+		{"TENANT", "a@b", "USAGE"},
+		{"TENANT", "acme", "WEBHOOK_LIST"},
+		{"TENANT", "acme", "SET_QUOTA", "acme", "0", "0"},
+		{"SET_QUOTA", "acme", "1"},
+		{"SET_QUOTA", "acme", "one", "0"},
+		{"SET_QUOTA", "a@b", "0", "0"},
+	}
+	for _, frames := range malformed {
+		resps := handleTestRequest(serv, frames...)
+		if len(resps) != 1 || !strings.HasPrefix(string(resps[0][0]), "ERROR ") {
+			t.Error("Expected an error for:", frames)
+		}
+	}
+}
+
+func TestPubTopic(t *testing.T) {
+	t.Parallel()
+
+	event := eventstore.StoredEvent{
+		Event: eventstore.Event{Stream: eventstore.StreamName("mystream")},
+	}
+	if string(pubTopic(event)) != "mystream" {
+		t.Error("Wrong default tenant topic:", string(pubTopic(event)))
+	}
+	event.Tenant = "acme"
+	if string(pubTopic(event)) != "@acme/mystream" {
+		t.Error("Wrong tenant topic:", string(pubTopic(event)))
+	}
+}
+
+func TestPublishTenantTopicStream(t *testing.T) {
+	t.Parallel()
+
+	serv := &Server{
+		params: InitParams{
+			Store: setupInMemoryeventstore(),
+		},
+	}
+	resps := handleTestRequest(serv, "PUBLISH", "@acme/x", "data")
+	if len(resps) != 1 || string(resps[0][0]) != "ERROR stream name is reserved" {
+		t.Error("Published a stream looking like a tenant topic:", resps)
+	}
+}
+
+func TestStreamQuotaCommands(t *testing.T) {
+	t.Parallel()
+
+	serv := &Server{
+		params: InitParams{
+			Store: setupInMemoryeventstore(),
+		},
+	}
+	resps := handleTestRequest(serv, "SET_QUOTA", "", "0", "0", "stream-max-events=1")
+	if len(resps) != 1 || string(resps[0][0]) != "QUOTA_SET" {
+		t.Fatal("Unexpected response:", resps)
+	}
+	handleTestRequest(serv, "PUBLISH", "a", "data")
+	handleTestRequest(serv, "PUBLISH", "b", "12")
+	resps = handleTestRequest(serv, "PUBLISH", "a", "more")
+	if len(resps) != 1 || string(resps[0][0]) != "ERROR stream quota exceeded" {
+		t.Error("Expected the stream quota to be exceeded:", resps)
+	}
+
+	resps = handleTestRequest(serv, "STREAM_STATS", "", "")
+	expected := [][]string{
+		{"STREAM_STAT", "a", "1", "4"},
+		{"STREAM_STAT", "b", "1", "2"},
+		{"END"},
+	}
+	if len(resps) != len(expected) {
+		t.Fatal("Unexpected response:", resps)
+	}
+	for i, frames := range expected {
+		if len(resps[i]) != len(frames) {
+			t.Error("Wrong response", i, ":", resps[i])
+			continue
+		}
+		for j, frame := range frames {
+			if string(resps[i][j]) != frame {
+				t.Error("Wrong frame", j, "in response", i, ":", string(resps[i][j]))
+			}
+		}
+	}
+
+	malformed := [][]string{
+		{"SET_QUOTA", "", "0", "0", "stream-max-events"},
+		{"SET_QUOTA", "", "0", "0", "unknown=1"},
+		{"SET_QUOTA", "", "0", "0", "stream-max-bytes=many"},
+		{"STREAM_STATS", ""},
+		{"STREAM_STATS", "", "many"},
+	}
+	for _, frames := range malformed {
+		resps := handleTestRequest(serv, frames...)
+		if len(resps) != 1 || !strings.HasPrefix(string(resps[0][0]), "ERROR ") {
+			t.Error("Expected an error for:", frames)
+		}
+	}
+}
+
+func TestCompactCommand(t *testing.T) {
+	t.Parallel()
+
+	serv := &Server{
+		params: InitParams{
+			Store: setupInMemoryeventstore(),
+		},
+	}
+	handleTestRequest(serv, "PUBLISH", "mystream", "data")
+	for _, frames := range [][]string{{"", ""}, {"a", "n"}} {
+		resps := handleTestRequest(serv, "COMPACT", frames[0], frames[1])
+		if len(resps) != 1 || string(resps[0][0]) != "COMPACTED" {
+			t.Error("Unexpected response:", resps)
+		}
+	}
+	resps := handleTestRequest(serv, "QUERY", "mystream", "", "")
+	if len(resps) != 2 || string(resps[0][2]) != "data" {
+		t.Error("Compaction lost events:", resps)
+	}
+	resps = handleTestRequest(serv, "COMPACT", "")
+	if len(resps) != 1 || !strings.HasPrefix(string(resps[0][0]), "ERROR ") {
+		t.Error("Expected an error:", resps)
+	}
+}
+
+func TestInterceptedPublish(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	es.AddInterceptor(func(tenant string, event *eventstore.Event) error {
+		if len(event.Data) == 0 {
+			return errors.New("empty event")
+		}
+		return nil
+	})
+	serv := &Server{
+		params: InitParams{
+			Store: es,
+		},
+	}
+	resps := handleTestRequest(serv, "PUBLISH", "mystream", "")
+	if len(resps) != 1 || string(resps[0][0]) != "ERROR empty event" {
+		t.Error("Expected the event to be rejected:", resps)
+	}
+	resps = handleTestRequest(serv, "PUBLISH", "mystream", "data")
+	if len(resps) != 1 || string(resps[0][0]) != "PUBLISHED" {
+		t.Error("Unexpected response:", resps)
+	}
+}
+
+func TestSetReadOnlyCommand(t *testing.T) {
+	t.Parallel()
+
+	serv := &Server{
+		params: InitParams{
+			Store: setupInMemoryeventstore(),
+		},
+	}
+	resps := handleTestRequest(serv, "SET_READ_ONLY", "true")
+	if len(resps) != 1 || string(resps[0][0]) != "READ_ONLY_SET" {
+		t.Fatal("Unexpected response:", resps)
+	}
+	resps = handleTestRequest(serv, "PUBLISH", "mystream", "data")
+	if len(resps) != 1 || string(resps[0][0]) != "ERROR event store is read-only" {
+		t.Error("PUBLISH was not refused:", resps)
+	}
+	resps = handleTestRequest(serv, "QUERY", "mystream", "", "")
+	if len(resps) != 1 || string(resps[0][0]) != "END" {
+		t.Error("QUERY failed:", resps)
+	}
+	resps = handleTestRequest(serv, "STATS")
+	found := false
+	for _, resp := range resps {
+		if len(resp) == 3 && string(resp[1]) == "read_only" {
+			found = string(resp[2]) == "1"
+		}
+	}
+	if !found {
+		t.Error("STATS did not report read-only mode:", resps)
+	}
+
+	resps = handleTestRequest(serv, "SET_READ_ONLY", "maybe")
+	if len(resps) != 1 || !strings.HasPrefix(string(resps[0][0]), "ERROR ") {
+		t.Error("Expected an error:", resps)
+	}
+	resps = handleTestRequest(serv, "SET_READ_ONLY", "false")
+	if len(resps) != 1 || string(resps[0][0]) != "READ_ONLY_SET" {
+		t.Fatal("Unexpected response:", resps)
+	}
+	resps = handleTestRequest(serv, "PUBLISH", "mystream", "data")
+	if len(resps) != 1 || string(resps[0][0]) != "PUBLISHED" {
+		t.Error("PUBLISH failed:", resps)
+	}
+}
+
+func TestMinPosition(t *testing.T) {
+	t.Parallel()
+
+	serv := &Server{
+		params: InitParams{
+			Store: setupInMemoryeventstore(),
+			PositionTimeout: 10 * time.Millisecond,
+		},
+	}
+	resps := handleTestRequest(serv, "PUBLISH", "mystream", "data")
+	if len(resps) != 1 || len(resps[0]) != 3 || string(resps[0][0]) != "PUBLISHED" {
+		t.Fatal("Unexpected response:", resps)
+	}
+	position := string(resps[0][2])
+
+	resps = handleTestRequest(serv, "MIN_POSITION", position, "QUERY", "mystream", "", "")
+	if len(resps) != 2 || string(resps[0][2]) != "data" {
+		t.Error("Unexpected response:", resps)
+	}
+	resps = handleTestRequest(serv, "MIN_POSITION", "\x05", "TENANT", "acme", "STREAMS", "", "")
+	if len(resps) != 1 || string(resps[0][0]) != "ERROR timed out waiting for position" {
+		t.Error("Expected a timeout:", resps)
+	}
+	resps = handleTestRequest(serv, "MIN_POSITION", position, "PUBLISH", "mystream", "data")
+	if len(resps) != 1 || string(resps[0][0]) != "ERROR PUBLISH can't wait for a position." {
+		t.Error("Unexpected response:", resps)
+	}
+}
+
+func TestSealStreamCommand(t *testing.T) {
+	t.Parallel()
+
+	serv := &Server{
+		params: InitParams{
+			Store: setupInMemoryeventstore(),
+		},
+	}
+	handleTestRequest(serv, "PUBLISH", "open", "data")
+	handleTestRequest(serv, "PUBLISH", "order", "placed")
+	resps := handleTestRequest(serv, "SEAL_STREAM", "order")
+	if len(resps) != 1 || string(resps[0][0]) != "STREAM_SEALED" {
+		t.Fatal("Unexpected response:", resps)
+	}
+	resps = handleTestRequest(serv, "PUBLISH", "order", "shipped")
+	if len(resps) != 1 || string(resps[0][0]) != "ERROR stream is sealed" {
+		t.Error("Published to a sealed stream:", resps)
+	}
+	resps = handleTestRequest(serv, "SEAL_STREAM", "missing")
+	if len(resps) != 1 || string(resps[0][0]) != "ERROR no such stream" {
+		t.Error("Unexpected response:", resps)
+	}
+
+	resps = handleTestRequest(serv, "STREAMS", "", "")
+	if len(resps) != 4 {
+		t.Fatal("Unexpected response:", resps)
+	}
+	if len(resps[1]) != 2 || string(resps[1][1]) != "open" {
+		t.Error("Wrong open stream:", resps[1])
+	}
+	if len(resps[2]) != 3 || string(resps[2][1]) != "order" || string(resps[2][2]) != "SEALED" {
+		t.Error("Sealed stream was not marked:", resps[2])
+	}
+	resps = handleTestRequest(serv, "STREAM_STATS", "order", "1")
+	if len(resps) != 2 || len(resps[0]) != 5 || string(resps[0][4]) != "SEALED" {
+		t.Error("Sealed stream was not marked:", resps)
+	}
+}
+
+func TestLeaseCommands(t *testing.T) {
+	t.Parallel()
+
+	serv := &Server{
+		params: InitParams{
+			Store: setupInMemoryeventstore(),
+		},
+	}
+	resps := handleTestRequest(serv, "ACQUIRE", "order", "1h")
+	if len(resps) != 1 || len(resps[0]) != 2 || string(resps[0][0]) != "ACQUIRED" {
+		t.Fatal("Unexpected response:", resps)
+	}
+	token := string(resps[0][1])
+	resps = handleTestRequest(serv, "ACQUIRE", "order", "1h")
+	if len(resps) != 1 || string(resps[0][0]) != "ERROR stream is leased" {
+		t.Error("Leased a stream twice:", resps)
+	}
+	resps = handleTestRequest(serv, "ACQUIRE", "other", "soon")
+	if len(resps) != 1 || !strings.HasPrefix(string(resps[0][0]), "ERROR ") {
+		t.Error("Expected an error:", resps)
+	}
+
+	resps = handleTestRequest(serv, "PUBLISH", "order", "data")
+	if len(resps) != 1 || string(resps[0][0]) != "ERROR stream is leased" {
+		t.Error("Published to a leased stream:", resps)
+	}
+	resps = handleTestRequest(serv, "FENCE", token, "PUBLISH", "order", "data")
+	if len(resps) != 1 || string(resps[0][0]) != "PUBLISHED" {
+		t.Error("Lease holder could not publish:", resps)
+	}
+	resps = handleTestRequest(serv, "FENCE", "x", "PUBLISH", "order", "data")
+	if len(resps) != 1 || string(resps[0][0]) != "ERROR Malformed fencing token." {
+		t.Error("Unexpected response:", resps)
+	}
+	resps = handleTestRequest(serv, "FENCE", token, "QUERY", "order", "", "")
+	if len(resps) != 1 || string(resps[0][0]) != "ERROR QUERY can't be fenced." {
+		t.Error("Unexpected response:", resps)
+	}
+
+	resps = handleTestRequest(serv, "RENEW", "order", token, "1h")
+	if len(resps) != 1 || string(resps[0][0]) != "RENEWED" {
+		t.Error("Unexpected response:", resps)
+	}
+	resps = handleTestRequest(serv, "RELEASE", "order", token)
+	if len(resps) != 1 || string(resps[0][0]) != "RELEASED" {
+		t.Error("Unexpected response:", resps)
+	}
+	resps = handleTestRequest(serv, "FENCE", token, "PUBLISH", "order", "data")
+	if len(resps) != 1 || string(resps[0][0]) != "ERROR stale fencing token" {
+		t.Error("Published with a released lease:", resps)
+	}
+	resps = handleTestRequest(serv, "RELEASE", "order", token)
+	if len(resps) != 1 || string(resps[0][0]) != "ERROR stale fencing token" {
+		t.Error("Released a lease twice:", resps)
+	}
+	resps = handleTestRequest(serv, "ACQUIRE", "order", "1h")
+	if len(resps) != 1 || string(resps[0][1]) <= token {
+		t.Error("Fencing token did not increase:", resps)
+	}
+}
+
+func TestLeaseAudit(t *testing.T) {
+	t.Parallel()
+
+	serv := &Server{
+		params: InitParams{
+			Store: setupInMemoryeventstore(),
+		},
+	}
+	resps := handleTestRequest(serv, "ACQUIRE", "order", "1h")
+	if len(resps) != 1 || string(resps[0][0]) != "ACQUIRED" {
+		t.Fatal("Unexpected response:", resps)
+	}
+	token := string(resps[0][1])
+	handleTestRequest(serv, "RENEW", "order", token, "2h")
+	handleTestRequest(serv, "RELEASE", "order", token)
+	// Failed commands are not recorded.
+	handleTestRequest(serv, "RELEASE", "order", token)
+
+	resps = handleTestRequest(serv, "QUERY", "$audit", "", "")
+	expected := []struct {
+		action string
+		arguments []string
+	}{
+		{"ACQUIRE", []string{"order", "1h", token}},
+		{"RENEW", []string{"order", token, "2h"}},
+		{"RELEASE", []string{"order", token}},
+	}
+	if len(resps) != len(expected)+1 {
+		t.Fatal("Wrong number of audit entries:", resps)
+	}
+	for i, exp := range expected {
+		var entry eventstore.AuditEntry
+		if err := json.Unmarshal(resps[i][2], &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.Action != exp.action || strings.Join(entry.Arguments, " ") != strings.Join(exp.arguments, " ") {
+			t.Error("Wrong audit entry:", entry)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+	"github.com/JensRantil/gorewind/eventstore"
+)
+
+// How long a snapshot is kept after it was last used, unless
+// InitParams.SnapshotTimeout says otherwise.
+const DefaultSnapshotTimeout = time.Minute
+
+// The number of snapshots that can be open at the same time.
+const maxOpenSnapshots = 1000
+
+var errNoSuchSnapshot = errors.New("No such snapshot.")
+
+// A snapshot opened through SNAPSHOT_OPEN.
+type snapshotSession struct {
+	snapshot *eventstore.Snapshot
+	// The number of requests currently using the snapshot.
+	users int
+	// When the snapshot expires, unless it is in use.
+	expires time.Time
+	// Whether it has been closed or has expired. Released once the
+	// last user is done.
+	closed bool
+}
+
+// Keeps the snapshots opened by clients, indexed by token. Snapshots
+// expire if they have not been used for a while. The zero value is
+// ready to use.
+type snapshotSessions struct {
+	lock sync.Mutex
+	sessions map[string]*snapshotSession
+}
+
+// Take a snapshot of an event store. Returns the token to refer to it
+// with.
+func (s *snapshotSessions) open(estore *eventstore.EventStore, timeout time.Duration) (string, error) {
+	bToken := make([]byte, 16)
+	if _, err := rand.Read(bToken); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(bToken)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.sessions) >= maxOpenSnapshots {
+		return "", errors.New("Too many open snapshots.")
+	}
+	snapshot, err := estore.Snapshot()
+	if err != nil {
+		return "", err
+	}
+	if s.sessions == nil {
+		s.sessions = make(map[string]*snapshotSession)
+	}
+	s.sessions[token] = &snapshotSession{
+		snapshot: snapshot,
+		expires: time.Now().Add(timeout),
+	}
+	time.AfterFunc(timeout, func() {
+		s.expire(token)
+	})
+	return token, nil
+}
+
+// Get the snapshot of a token for a request. Snapshots can only be used
+// by the tenant they were taken for. Must be followed by a call to
+// release once the request is done.
+func (s *snapshotSessions) acquire(token, tenant string) (*eventstore.Snapshot, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	session, exists := s.sessions[token]
+	if !exists || session.closed || session.snapshot.TenantName() != tenant {
+		return nil, errNoSuchSnapshot
+	}
+	session.users++
+	return session.snapshot, nil
+}
+
+// Mark a request done with a snapshot. The timeout starts over.
+func (s *snapshotSessions) release(token string, timeout time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	session := s.sessions[token]
+	if session == nil {
+		return
+	}
+	session.users--
+	if session.closed {
+		if session.users == 0 {
+			delete(s.sessions, token)
+			session.snapshot.Release()
+		}
+		return
+	}
+	session.expires = time.Now().Add(timeout)
+	time.AfterFunc(timeout, func() {
+		s.expire(token)
+	})
+}
+
+// Close the snapshot of a token. Requests using it finish first.
+func (s *snapshotSessions) close(token, tenant string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	session, exists := s.sessions[token]
+	if !exists || session.closed || session.snapshot.TenantName() != tenant {
+		return errNoSuchSnapshot
+	}
+	s.closeSession(token, session)
+	return nil
+}
+
+// Close a snapshot if it has not been used within its timeout. Called
+// by a timer set whenever the timeout starts over, so a call may be for
+// an earlier timeout that no longer applies.
+func (s *snapshotSessions) expire(token string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	session, exists := s.sessions[token]
+	if !exists || session.closed || session.users > 0 {
+		return
+	}
+	if time.Now().Before(session.expires) {
+		return
+	}
+	s.closeSession(token, session)
+}
+
+// Close all snapshots.
+func (s *snapshotSessions) closeAll() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for token, session := range s.sessions {
+		if !session.closed {
+			s.closeSession(token, session)
+		}
+	}
+}
+
+// Must be called with the lock held.
+func (s *snapshotSessions) closeSession(token string, session *snapshotSession) {
+	session.closed = true
+	if session.users == 0 {
+		delete(s.sessions, token)
+		session.snapshot.Release()
+	}
+}
+
+// The number of open snapshots.
+func (s *snapshotSessions) count() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	count := 0
+	for _, session := range s.sessions {
+		if !session.closed {
+			count++
+		}
+	}
+	return count
+}
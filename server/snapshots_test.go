@@ -0,0 +1,133 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSnapshotCommands(t *testing.T) {
+	t.Parallel()
+
+	serv := &Server{
+		params: InitParams{
+			Store: setupInMemoryeventstore(),
+		},
+	}
+	handleTestRequest(serv, "PUBLISH", "mystream", "before")
+	resps := handleTestRequest(serv, "SNAPSHOT_OPEN")
+	if len(resps) != 1 || len(resps[0]) != 2 || string(resps[0][0]) != "SNAPSHOT" {
+		t.Fatal("Unexpected response:", resps)
+	}
+	token := string(resps[0][1])
+	handleTestRequest(serv, "PUBLISH", "mystream", "after")
+	handleTestRequest(serv, "PUBLISH", "otherstream", "after")
+
+	resps = handleTestRequest(serv, "SNAPSHOT", token, "QUERY", "mystream", "", "")
+	if len(resps) != 2 || string(resps[0][2]) != "before" {
+		t.Error("Snapshot saw later events:", resps)
+	}
+	resps = handleTestRequest(serv, "SNAPSHOT", token, "STREAMS", "", "")
+	if len(resps) != 2 || string(resps[0][1]) != "mystream" {
+		t.Error("Snapshot saw later streams:", resps)
+	}
+	resps = handleTestRequest(serv, "QUERY", "mystream", "", "")
+	if len(resps) != 3 {
+		t.Error("Query without snapshot missed events:", resps)
+	}
+
+	resps = handleTestRequest(serv, "SNAPSHOT", token, "PUBLISH", "mystream", "x")
+	if len(resps) != 1 || string(resps[0][0]) != "ERROR PUBLISH can't be used with a snapshot." {
+		t.Error("Unexpected response:", resps)
+	}
+	resps = handleTestRequest(serv, "TENANT", "acme", "SNAPSHOT", token, "QUERY", "mystream", "", "")
+	if len(resps) != 1 || string(resps[0][0]) != "ERROR No such snapshot." {
+		t.Error("Snapshot was used by another tenant:", resps)
+	}
+	resps = handleTestRequest(serv, "SNAPSHOT", token)
+	if len(resps) != 1 || string(resps[0][0]) != "ERROR Wrong number of frames for SNAPSHOT." {
+		t.Error("Unexpected response:", resps)
+	}
+
+	resps = handleTestRequest(serv, "SNAPSHOT_CLOSE", token)
+	if len(resps) != 1 || string(resps[0][0]) != "SNAPSHOT_CLOSED" {
+		t.Error("Unexpected response:", resps)
+	}
+	resps = handleTestRequest(serv, "SNAPSHOT", token, "QUERY", "mystream", "", "")
+	if len(resps) != 1 || string(resps[0][0]) != "ERROR No such snapshot." {
+		t.Error("Closed snapshot was used:", resps)
+	}
+	resps = handleTestRequest(serv, "SNAPSHOT_CLOSE", token)
+	if len(resps) != 1 || string(resps[0][0]) != "ERROR No such snapshot." {
+		t.Error("Snapshot was closed twice:", resps)
+	}
+}
+
+func TestSnapshotExpiry(t *testing.T) {
+	t.Parallel()
+
+	estore := setupInMemoryeventstore()
+	var sessions snapshotSessions
+	timeout := 10 * time.Millisecond
+	token, err := sessions.open(estore, timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Snapshots in use don't expire.
+	if _, err := sessions.acquire(token, ""); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * timeout)
+	if sessions.count() != 1 {
+		t.Fatal("Snapshot in use expired.")
+	}
+	sessions.release(token, timeout)
+	if _, err := sessions.acquire(token, ""); err != nil {
+		t.Fatal(err)
+	}
+	sessions.release(token, timeout)
+
+	deadline := time.Now().Add(time.Second)
+	for sessions.count() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Snapshot did not expire.")
+		}
+		time.Sleep(timeout)
+	}
+	if _, err := sessions.acquire(token, ""); err != errNoSuchSnapshot {
+		t.Error("Expired snapshot was used:", err)
+	}
+
+	// Closing a snapshot in use releases it once done.
+	token, err = sessions.open(estore, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sessions.acquire(token, ""); err != nil {
+		t.Fatal(err)
+	}
+	sessions.closeAll()
+	if sessions.count() != 0 || len(sessions.sessions) != 1 {
+		t.Error("Snapshot in use was released.")
+	}
+	sessions.release(token, time.Hour)
+	if len(sessions.sessions) != 0 {
+		t.Error("Closed snapshot was not released.")
+	}
+}
@@ -0,0 +1,75 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A named statistic reported by the STATS command.
+type stat struct {
+	name string
+	value string
+}
+
+// Counters exposed through the STATS command. The zero value is ready to
+// use.
+type serverStats struct {
+	lock sync.Mutex
+	started time.Time
+	counters map[string]uint64
+}
+
+func (s *serverStats) increment(name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.counters == nil {
+		s.counters = make(map[string]uint64)
+	}
+	s.counters[name]++
+}
+
+// Return all counters, and the uptime if known, sorted by name.
+func (s *serverStats) list() []stat {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	res := make([]stat, 0, len(s.counters) + 1)
+	for name, value := range s.counters {
+		res = append(res, stat{name, strconv.FormatUint(value, 10)})
+	}
+	if !s.started.IsZero() {
+		uptime := int64(time.Since(s.started) / time.Second)
+		res = append(res, stat{"uptime", strconv.FormatInt(uptime, 10)})
+	}
+	sort.Sort(statsByName(res))
+	return res
+}
+
+type statsByName []stat
+
+func (s statsByName) Len() int {
+	return len(s)
+}
+func (s statsByName) Less(i, j int) bool {
+	return s[i].name < s[j].name
+}
+func (s statsByName) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
@@ -0,0 +1,53 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+
+import (
+	"testing"
+	"time"
+)
+
+
+func TestServerStats(t *testing.T) {
+	t.Parallel()
+
+	var stats serverStats
+	if len(stats.list()) != 0 {
+		t.Error("Expected no stats.")
+	}
+
+	stats.increment("requests")
+	stats.increment("requests")
+	stats.increment("published")
+	stats.started = time.Now()
+
+	list := stats.list()
+	expected := []stat{
+		{"published", "1"},
+		{"requests", "2"},
+		{"uptime", "0"},
+	}
+	if len(list) != len(expected) {
+		t.Fatal("Wrong stats:", list)
+	}
+	for i := range expected {
+		if list[i] != expected[i] {
+			t.Error("Expected:", expected[i], "Was:", list[i])
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package webui
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"github.com/JensRantil/gorewind/eventstore"
+)
+
+// Escapes label values in the Prometheus text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Write a metric header in the Prometheus text format.
+func writeMetricHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+// Serves storage accounting in the Prometheus text format. Only totals
+// are served, unless the streams parameter is set. Then the usage of
+// every stream is served as well, a page at a time like the stream
+// listing, since a label per stream can make for a lot of series.
+func (ui *WebUI) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	usage, err := ui.store.Usage()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var streams []eventstore.StreamUsage
+	if r.FormValue("streams") != "" {
+		var start eventstore.StreamName
+		if sStart := r.FormValue("start"); sStart != "" {
+			start = eventstore.StreamName(sStart)
+		}
+		streams, err = ui.store.StreamUsages(start, pageSize(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetricHeader(w, "gorewind_events", "gauge",
+	"Number of events stored.")
+	fmt.Fprintf(w, "gorewind_events %d\n", usage.Events)
+	writeMetricHeader(w, "gorewind_bytes", "gauge",
+	"Size of the event data stored.")
+	fmt.Fprintf(w, "gorewind_bytes %d\n", usage.Bytes)
+	writeMetricHeader(w, "gorewind_soft_quota_warnings_total", "counter",
+	"Number of times a soft quota was exceeded.")
+	fmt.Fprintf(w, "gorewind_soft_quota_warnings_total %d\n",
+	ui.store.SoftQuotaWarnings())
+	if streams == nil {
+		return
+	}
+
+	writeMetricHeader(w, "gorewind_stream_events", "gauge",
+	"Number of events stored per stream.")
+	for _, s := range streams {
+		fmt.Fprintf(w, "gorewind_stream_events{stream=\"%s\"} %d\n",
+		labelEscaper.Replace(string(s.Stream)), s.Events)
+	}
+	writeMetricHeader(w, "gorewind_stream_bytes", "gauge",
+	"Size of the event data stored per stream.")
+	for _, s := range streams {
+		fmt.Fprintf(w, "gorewind_stream_bytes{stream=\"%s\"} %d\n",
+		labelEscaper.Replace(string(s.Stream)), s.Bytes)
+	}
+}
@@ -0,0 +1,89 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package webui
+
+import (
+	"html/template"
+)
+
+const header = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Gorewind</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+pre { background: #f4f4f4; padding: 0.5em; margin: 0; }
+td { vertical-align: top; padding: 0.2em 1em 0.2em 0; }
+.id { font-family: monospace; }
+</style>
+</head>
+<body>
+<p><a href="/">Streams</a> | <a href="/tail">Live tail</a></p>
+`
+
+const footer = `</body>
+</html>
+`
+
+var streamsTemplate = template.Must(template.New("streams").Parse(header + `
+<h1>Streams</h1>
+<ul>
+{{range .Streams}}<li><a href="/stream?name={{.Name}}">{{.Name}}</a>{{if .Sealed}} (sealed){{end}}</li>
+{{else}}<li>No streams.</li>
+{{end}}</ul>
+{{if .Next}}<p><a href="/?start={{.Next}}&amp;limit={{.Limit}}">Next page</a></p>{{end}}
+` + footer))
+
+var streamTemplate = template.Must(template.New("stream").Parse(header + `
+<h1>Stream {{.Stream}}{{if .Sealed}} (sealed){{end}}</h1>
+<table>
+<tr><th>Id</th><th>Data</th></tr>
+{{range .Events}}<tr><td class="id">{{.Id}}{{if .Redacted}} (redacted){{end}}</td><td><pre>{{.Data.Text}}</pre></td></tr>
+{{else}}<tr><td colspan="2">No events.</td></tr>
+{{end}}</table>
+{{if .Next}}<p><a href="/stream?name={{.Stream}}&amp;after={{.Next}}&amp;limit={{.Limit}}">Next page</a></p>{{end}}
+` + footer))
+
+var tailTemplate = template.Must(template.New("tail").Parse(header + `
+<h1>Live tail</h1>
+<form action="/tail">
+Stream prefix: <input name="prefix" value="{{.}}"> <input type="submit" value="Tail">
+</form>
+<table id="events">
+<tr><th>Stream</th><th>Id</th><th>Data</th></tr>
+</table>
+<script>
+var source = new EventSource("/tail/events?prefix=" + encodeURIComponent({{.}}));
+source.onmessage = function(msg) {
+	var event = JSON.parse(msg.data);
+	var row = document.createElement("tr");
+	var id = event.redacted ? event.id + " (redacted)" : event.id;
+	[event.stream, id, event.data].forEach(function(text, i) {
+		var cell = document.createElement("td");
+		var content = document.createElement(i == 2 ? "pre" : "span");
+		content.textContent = text;
+		if (i == 1) {
+			content.className = "id";
+		}
+		cell.appendChild(content);
+		row.appendChild(cell);
+	});
+	document.getElementById("events").appendChild(row);
+};
+</script>
+` + footer))
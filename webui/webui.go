@@ -0,0 +1,291 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// A read-only web interface for browsing an event store. Lists streams,
+// pages through the events of a stream and shows newly published events
+// live. Event data that is valid JSON is shown pretty-printed. Storage
+// metrics are served at /metrics in the Prometheus text format.
+package webui
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"github.com/JensRantil/gorewind/eventstore"
+)
+
+// Number of streams or events shown per page unless specified.
+const defaultPageSize = 50
+
+// Upper bound for the page size a client can ask for.
+const maxPageSize = 1000
+
+// Number of published events buffered per live tail before events are
+// dropped.
+const tailBufferSize = 100
+
+// The web interface. Implements http.Handler.
+type WebUI struct {
+	store *eventstore.EventStore
+	mux *http.ServeMux
+}
+
+// Create a new web interface for an event store.
+func New(estore *eventstore.EventStore) *WebUI {
+	ui := &WebUI{
+		store: estore,
+		mux: http.NewServeMux(),
+	}
+	ui.mux.HandleFunc("/", ui.handleStreams)
+	ui.mux.HandleFunc("/stream", ui.handleStream)
+	ui.mux.HandleFunc("/tail", ui.handleTail)
+	ui.mux.HandleFunc("/tail/events", ui.handleTailEvents)
+	ui.mux.HandleFunc("/metrics", ui.handleMetrics)
+	return ui
+}
+
+func (ui *WebUI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "The web interface is read-only.",
+		http.StatusMethodNotAllowed)
+		return
+	}
+	ui.mux.ServeHTTP(w, r)
+}
+
+// Parse the page size of a request.
+func pageSize(r *http.Request) int {
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit <= 0 {
+		return defaultPageSize
+	}
+	if limit > maxPageSize {
+		return maxPageSize
+	}
+	return limit
+}
+
+// Event data prepared for display.
+type renderedData struct {
+	Text string
+	IsJSON bool
+}
+
+// Pretty-print data if it is valid JSON.
+func renderData(data []byte) renderedData {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, data, "", "  "); err == nil {
+		return renderedData{buf.String(), true}
+	}
+	return renderedData{string(data), false}
+}
+
+func (ui *WebUI) render(w http.ResponseWriter, t *template.Template, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := t.Execute(w, data); err != nil {
+		log.Println("Could not render page:", err)
+	}
+}
+
+type listedStream struct {
+	Name string
+	Sealed bool
+}
+
+type streamsPage struct {
+	Streams []listedStream
+	Next string
+	Limit int
+}
+
+func (ui *WebUI) handleStreams(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	limit := pageSize(r)
+	var start eventstore.StreamName
+	if sStart := r.FormValue("start"); sStart != "" {
+		start = eventstore.StreamName(sStart)
+	}
+
+	page := streamsPage{Limit: limit}
+	// Fetching one extra stream to know where the next page starts.
+	for stream := range ui.store.ListStreams(start, limit + 1) {
+		if len(page.Streams) == limit {
+			page.Next = string(stream)
+			continue
+		}
+		meta, err := ui.store.StreamMetadata(stream)
+		if err != nil {
+			log.Println("Could not load stream metadata:", err)
+		}
+		page.Streams = append(page.Streams,
+		listedStream{string(stream), meta.Sealed})
+	}
+	ui.render(w, streamsTemplate, page)
+}
+
+type renderedEvent struct {
+	Id string
+	Data renderedData
+	Redacted bool
+}
+
+type streamPage struct {
+	Stream string
+	Sealed bool
+	Events []renderedEvent
+	Next string
+	Limit int
+}
+
+func (ui *WebUI) handleStream(w http.ResponseWriter, r *http.Request) {
+	stream := r.FormValue("name")
+	if stream == "" {
+		http.Error(w, "Missing stream name.", http.StatusBadRequest)
+		return
+	}
+	limit := pageSize(r)
+
+	var fromId []byte
+	if sFrom := r.FormValue("after"); sFrom != "" {
+		var err error
+		if fromId, err = hex.DecodeString(sFrom); err != nil {
+			http.Error(w, "Malformed event id.", http.StatusBadRequest)
+			return
+		}
+	}
+	events, err := ui.store.Query(eventstore.QueryRequest{
+		Stream: []byte(stream),
+		FromId: fromId,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	meta, err := ui.store.StreamMetadata(eventstore.StreamName(stream))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page := streamPage{
+		Stream: stream,
+		Sealed: meta.Sealed,
+		Limit: limit,
+	}
+	for event := range events {
+		if fromId != nil && bytes.Compare(event.Id, fromId) == 0 {
+			// Only showing events after the given one.
+			continue
+		}
+		if len(page.Events) == limit {
+			page.Next = page.Events[limit-1].Id
+			// Draining to not leak the querying goroutine.
+			for _ = range events {
+			}
+			break
+		}
+		page.Events = append(page.Events, renderedEvent{
+			hex.EncodeToString(event.Id),
+			renderData(event.Data),
+			event.Redacted,
+		})
+	}
+	ui.render(w, streamTemplate, page)
+}
+
+func (ui *WebUI) handleTail(w http.ResponseWriter, r *http.Request) {
+	ui.render(w, tailTemplate, r.FormValue("prefix"))
+}
+
+// A published event as sent to the live tail.
+type tailEvent struct {
+	Stream string `json:"stream"`
+	Id string `json:"id"`
+	Data string `json:"data"`
+	IsJSON bool `json:"isJSON"`
+	Redacted bool `json:"redacted"`
+}
+
+// Streams newly published events as server-sent events.
+func (ui *WebUI) handleTailEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported.", http.StatusInternalServerError)
+		return
+	}
+	prefix := []byte(r.FormValue("prefix"))
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Publishing blocks until every registered channel has received
+	// the event. To not let a slow browser hold up writes, events are
+	// dropped rather than queued once the buffer is full.
+	pubchan := make(chan eventstore.StoredEvent)
+	live := make(chan eventstore.StoredEvent, tailBufferSize)
+	go func() {
+		for event := range pubchan {
+			select {
+			case live <- event:
+			default:
+			}
+		}
+	}()
+	ui.store.RegisterPublishedEventsChannel(pubchan)
+	defer func() {
+		ui.store.UnregisterPublishedEventsChannel(pubchan)
+		close(pubchan)
+	}()
+
+	done := r.Context().Done()
+	for {
+		select {
+		case <-done:
+			return
+		case event := <-live:
+			if !bytes.HasPrefix(event.Stream, prefix) {
+				continue
+			}
+			data := renderData(event.Data)
+			msg, err := json.Marshal(tailEvent{
+				string(event.Stream),
+				hex.EncodeToString(event.Id),
+				data.Text,
+				data.IsJSON,
+				event.Redacted,
+			})
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", msg); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,272 @@
+// gorewind is an event store server written in Python that talks ZeroMQ.
+// Copyright (C) 2013  Jens Rantil
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package webui
+
+
+import (
+	"testing"
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+	"github.com/JensRantil/gorewind/eventstore"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+
+func setupInMemoryeventstore() *eventstore.EventStore {
+	stor := &storage.MemStorage{}
+	es, err := eventstore.New(stor, nil)
+	if err != nil {
+		panic(err)
+	}
+	return es
+}
+
+func addTestEvent(t *testing.T, es *eventstore.EventStore, stream, data string) {
+	_, err := es.Add(eventstore.Event{
+		Stream: eventstore.StreamName(stream),
+		Data: []byte(data),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getPage(t *testing.T, ts *httptest.Server, path string) (int, string) {
+	resp, err := http.Get(ts.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestListStreams(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	for _, stream := range []string{"a", "b", "c"} {
+		addTestEvent(t, es, stream, "data")
+	}
+	ts := httptest.NewServer(New(es))
+	defer ts.Close()
+
+	status, body := getPage(t, ts, "/?limit=2")
+	if status != http.StatusOK {
+		t.Fatal("Wrong status:", status)
+	}
+	if !strings.Contains(body, "name=a") || !strings.Contains(body, "name=b") {
+		t.Error("Streams were not listed:", body)
+	}
+	if strings.Contains(body, "name=c") {
+		t.Error("Page was not limited:", body)
+	}
+	if !strings.Contains(body, "start=c") {
+		t.Error("Missing link to next page:", body)
+	}
+
+	status, _ = getPage(t, ts, "/nonexisting")
+	if status != http.StatusNotFound {
+		t.Error("Wrong status:", status)
+	}
+}
+
+func TestBrowseStream(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	addTestEvent(t, es, "mystream", `{"a":1}`)
+	addTestEvent(t, es, "mystream", "plain")
+	addTestEvent(t, es, "mystream", "<script>")
+	ts := httptest.NewServer(New(es))
+	defer ts.Close()
+
+	status, body := getPage(t, ts, "/stream?name=mystream&limit=2")
+	if status != http.StatusOK {
+		t.Fatal("Wrong status:", status)
+	}
+	if !strings.Contains(body, "{\n  &#34;a&#34;: 1\n}") {
+		t.Error("JSON was not pretty-printed:", body)
+	}
+	if !strings.Contains(body, "plain") {
+		t.Error("Second event was not shown:", body)
+	}
+	if !strings.Contains(body, "after=01") {
+		t.Fatal("Missing link to next page:", body)
+	}
+
+	status, body = getPage(t, ts, "/stream?name=mystream&after=01")
+	if status != http.StatusOK {
+		t.Fatal("Wrong status:", status)
+	}
+	if strings.Contains(body, "plain") {
+		t.Error("Next page included earlier events:", body)
+	}
+	if !strings.Contains(body, "&lt;script&gt;") {
+		t.Error("Event data was not escaped:", body)
+	}
+
+	status, _ = getPage(t, ts, "/stream?name=mystream&after=zz")
+	if status != http.StatusBadRequest {
+		t.Error("Wrong status for malformed id:", status)
+	}
+}
+
+func TestSealedStream(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	addTestEvent(t, es, "open", "data")
+	addTestEvent(t, es, "sealed", "data")
+	if err := es.SealStream(eventstore.StreamName("sealed")); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(New(es))
+	defer ts.Close()
+
+	_, body := getPage(t, ts, "/")
+	if strings.Count(body, "(sealed)") != 1 || !strings.Contains(body, "sealed</a> (sealed)") {
+		t.Error("Sealed stream was not marked:", body)
+	}
+	_, body = getPage(t, ts, "/stream?name=sealed")
+	if !strings.Contains(body, "<h1>Stream sealed (sealed)</h1>") {
+		t.Error("Sealed stream was not marked:", body)
+	}
+	_, body = getPage(t, ts, "/stream?name=open")
+	if strings.Contains(body, "(sealed)") {
+		t.Error("Open stream was marked as sealed:", body)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(New(setupInMemoryeventstore()))
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL + "/stream", "text/plain", strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Error("Wrong status:", resp.StatusCode)
+	}
+}
+
+func TestLiveTail(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	ts := httptest.NewServer(New(es))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/tail/events?prefix=my")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Error("Wrong content type:", ct)
+	}
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if scanner.Text() != "" {
+				lines <- scanner.Text()
+			}
+		}
+	}()
+
+	// The handler registers asynchronously with respect to the
+	// response headers, so publish until something arrives.
+	deadline := time.After(5 * time.Second)
+	for {
+		addTestEvent(t, es, "other", "ignored")
+		addTestEvent(t, es, "mystream", "data")
+		select {
+		case line := <-lines:
+			expected := `data: {"stream":"mystream","id":`
+			if !strings.HasPrefix(line, expected) {
+				t.Error("Wrong event:", line)
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("No event was received.")
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+
+	es := setupInMemoryeventstore()
+	addTestEvent(t, es, "mystream", "data")
+	addTestEvent(t, es, `my"stream`, "12")
+	ts := httptest.NewServer(New(es))
+	defer ts.Close()
+
+	status, body := getPage(t, ts, "/metrics")
+	if status != http.StatusOK {
+		t.Fatal("Wrong status:", status)
+	}
+	expected := []string{
+		"gorewind_events 2\n",
+		"gorewind_bytes 6\n",
+		"gorewind_soft_quota_warnings_total 0\n",
+	}
+	for _, line := range expected {
+		if !strings.Contains(body, line) {
+			t.Errorf("Missing %q in: %s", line, body)
+		}
+	}
+	if strings.Contains(body, "gorewind_stream_") {
+		t.Error("Per-stream metrics were served by default:", body)
+	}
+
+	status, body = getPage(t, ts, "/metrics?streams=1")
+	if status != http.StatusOK {
+		t.Fatal("Wrong status:", status)
+	}
+	expected = []string{
+		"gorewind_events 2\n",
+		`gorewind_stream_events{stream="mystream"} 1` + "\n",
+		`gorewind_stream_bytes{stream="mystream"} 4` + "\n",
+		`gorewind_stream_bytes{stream="my\"stream"} 2` + "\n",
+	}
+	for _, line := range expected {
+		if !strings.Contains(body, line) {
+			t.Errorf("Missing %q in: %s", line, body)
+		}
+	}
+
+	_, body = getPage(t, ts, "/metrics?streams=1&start=mystream&limit=1")
+	if !strings.Contains(body, `{stream="mystream"}`) ||
+	strings.Contains(body, `{stream="my\"stream"}`) {
+		t.Error("Wrong page of per-stream metrics:", body)
+	}
+}